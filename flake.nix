@@ -71,7 +71,49 @@
     # Enables `nix fmt` at root of repo to format all nix files
     formatter = forAllSystems (system: nixpkgs.legacyPackages.${system}.alejandra);
 
+    packages = forAllSystems (system: let
+      pkgs = nixpkgs.legacyPackages.${system};
+    in {
+      doomctl = pkgs.buildGoModule {
+        pname = "doomctl";
+        version = self.shortRev or "dirty";
+        src = ./tools;
+        vendorHash = null;
+        subPackages = ["cmd/doomctl"];
+        nativeBuildInputs = [pkgs.makeWrapper];
+        postInstall = ''
+          wrapProgram $out/bin/doomctl --prefix PATH : ${pkgs.lib.makeBinPath [pkgs.openssl pkgs.sops]}
+        '';
+        meta.mainProgram = "doomctl";
+      };
+    });
+
+    # Per-host facts read by `doomctl inventory`
+    inventory = import ./lib/inventory.nix {inherit (nixpkgs) lib;} {
+      inherit (self) nixosConfigurations darwinConfigurations;
+    };
+
+    checks.x86_64-linux = let
+      pkgs = nixpkgs.legacyPackages.x86_64-linux;
+    in
+      import ./tests {inherit pkgs inputs;}
+      // {
+        conflicts = import ./lib/conflicts.nix {inherit pkgs;} {
+          inherit (self) nixosConfigurations;
+        };
+        hardware = import ./lib/hardware-check.nix {inherit pkgs;} {
+          inherit (self) nixosConfigurations;
+        };
+        # builds doomctl, which runs its Go tests
+        inherit (self.packages.x86_64-linux) doomctl;
+      };
+
     darwinConfigurations = {
+      mac1chng = nix-darwin.lib.darwinSystem {
+        system = "aarch64-darwin";
+        specialArgs = {inherit inputs outputs;};
+        modules = [./machines/mac1chng/configuration.nix];
+      };
       mair = nix-darwin.lib.darwinSystem {
         system = "x86_64-darwin"; # Specify system for mair
         specialArgs = {inherit inputs outputs;};
@@ -85,6 +127,12 @@
     };
 
     nixosConfigurations = {
+      dsk1chng = nixpkgs.lib.nixosSystem {
+        system = "x86_64-linux";
+        specialArgs = {inherit inputs outputs;};
+        modules = [./machines/dsk1chng/configuration.nix];
+      };
+
       iso1chng = nixpkgs.lib.nixosSystem {
         system = "x86_64-linux";
         specialArgs = {inherit inputs outputs;};
@@ -113,12 +161,42 @@
         modules = [./machines/noir/configuration.nix];
       };
 
+      svr1chng = nixpkgs.lib.nixosSystem {
+        system = "x86_64-linux";
+        specialArgs = {inherit inputs outputs;};
+        modules = [./machines/svr1chng/configuration.nix];
+      };
+
+      svr2chng = nixpkgs.lib.nixosSystem {
+        system = "x86_64-linux";
+        specialArgs = {inherit inputs outputs;};
+        modules = [./machines/svr2chng/configuration.nix];
+      };
+
+      svr3chng = nixpkgs.lib.nixosSystem {
+        system = "x86_64-linux";
+        specialArgs = {inherit inputs outputs;};
+        modules = [./machines/svr3chng/configuration.nix];
+      };
+
       vm = nixpkgs.lib.nixosSystem {
         system = "aarch64-linux";
         specialArgs = {inherit inputs outputs;};
         modules = [./machines/vm/configuration.nix];
       };
 
+      vmnixos = nixpkgs.lib.nixosSystem {
+        system = "x86_64-linux";
+        specialArgs = {inherit inputs outputs;};
+        modules = [./machines/vmnixos/configuration.nix];
+      };
+
+      workchng = nixpkgs.lib.nixosSystem {
+        system = "x86_64-linux";
+        specialArgs = {inherit inputs outputs;};
+        modules = [./machines/workchng/configuration.nix];
+      };
+
       zinc = nixpkgs.lib.nixosSystem {
         system = "x86_64-linux";
         specialArgs = {inherit inputs outputs;};
@@ -0,0 +1,141 @@
+# Fleet-wide checks that no single host's module system can make: the same
+# server name served by two hosts, a port opened twice in one firewall, two
+# services on one host binding the same port, and a tunnel on one host sending
+# traffic to a port another host only serves locally. Run by `nix flake check`.
+{pkgs}: {nixosConfigurations}:
+with pkgs.lib; let
+  hosts = mapAttrs (_: s: s.config) nixosConfigurations;
+
+  # Everything that binds a port: the services in doomlab.services plus the
+  # daemons modules enable without registering them.
+  listeners = cfg: let
+    nginx = cfg.services.nginx;
+    daemon = owner: tcp: udp: {
+      inherit owner tcp udp;
+      shared = [];
+    };
+  in
+    mapAttrsToList (owner: s: {
+      inherit owner;
+      inherit (s.ports) tcp udp shared;
+    }) (cfg.doomlab.services or {})
+    ++ optional cfg.services.openssh.enable (daemon "sshd" cfg.services.openssh.ports [])
+    ++ optional nginx.enable (daemon "nginx"
+      (unique ([nginx.defaultHTTPListenPort nginx.defaultSSLListenPort]
+        ++ filter (p: p != null) (concatMap (v: map (l: l.port) v.listen) (attrValues nginx.virtualHosts))))
+      [])
+    ++ optional cfg.services.avahi.enable {
+      owner = "avahi";
+      tcp = [];
+      udp = [5353];
+      shared = [5353];
+    }
+    ++ mapAttrsToList (name: t: daemon "cloudflared-${name}" [t.metricsPort] []) (cfg.doomlab.cloudflared.tunnels or {});
+
+  portClashes = host: cfg: let
+    claims = concatMap (l:
+      map (port: {
+        inherit (l) owner;
+        key = "tcp/${toString port}";
+        shared = elem port l.shared;
+      })
+      l.tcp
+      ++ map (port: {
+        inherit (l) owner;
+        key = "udp/${toString port}";
+        shared = elem port l.shared;
+      })
+      l.udp) (listeners cfg);
+    owners = cs: unique (map (c: c.owner) cs);
+  in
+    mapAttrsToList (key: cs: "${host}: ${key} is bound by ${concatStringsSep ", " (owners cs)}")
+    (filterAttrs (_: cs: length (owners cs) > 1 && !all (c: c.shared) cs) (groupBy (c: c.key) claims));
+
+  firewallOverlaps = host: cfg: let
+    fw = cfg.networking.firewall;
+    shared = concatMap (l: l.shared) (listeners cfg);
+    expand = rules: proto:
+      rules."allowed${proto}Ports" ++ concatMap (r: range r.from r.to) rules."allowed${proto}PortRanges";
+    # the firewall module mirrors the global rules into `default`
+    scopes = {global = fw;} // removeAttrs fw.interfaces ["default"];
+    overlaps = proto: scope: ports: let
+      repeated = attrNames (filterAttrs (p: n: n > 1 && !elem (toInt p) shared)
+        (mapAttrs (_: length) (groupBy toString ports)));
+    in
+      optional (repeated != [])
+      "${host}: ${toLower proto} ${concatStringsSep ", " repeated} opened more than once (${scope})";
+  in
+    optionals fw.enable (concatLists (mapAttrsToList (scope: rules:
+      concatMap (proto:
+        overlaps proto scope (
+          expand rules proto
+          ++ optionals (scope != "global") (expand fw proto)
+        )) ["TCP" "UDP"])
+    scopes));
+
+  # Replicated tunnels are fine; the same name in two nginx configs is not,
+  # as DNS can only point it at one of them.
+  duplicateServerNames = let
+    claims = concatLists (mapAttrsToList (host: cfg:
+      optionals cfg.services.nginx.enable (concatLists (mapAttrsToList (vhost: v:
+        map (name: {inherit host vhost name;})
+        ([
+            (
+              if v.serverName != null
+              then v.serverName
+              else vhost
+            )
+          ]
+          ++ v.serverAliases))
+      cfg.services.nginx.virtualHosts)))
+    hosts);
+    real = filter (c: !elem c.name ["localhost" "_" ""]) claims;
+  in
+    mapAttrsToList (name: cs: "server name ${name} is served by ${concatMapStringsSep ", " (c: "${c.host} (${c.vhost})") cs}")
+    (filterAttrs (_: cs: length cs > 1) (groupBy (c: c.name) real));
+
+  # Replica ingress like http://svr2chng:8096 crosses hosts, so the port must
+  # not be local on the origin host, or be open to the tailnet. An origin
+  # that is no host of the flake cannot be checked at all, so it fails the
+  # evaluation rather than pass unseen.
+  unreachableOrigins = host: cfg:
+    concatLists (mapAttrsToList (tunnel: t:
+      concatLists (mapAttrsToList (hostname: rule: let
+        m = builtins.match "(https?)://(\\[[^]]*]|[^:/]+)(:([0-9]+))?.*" rule.service;
+        origin = elemAt m 1;
+        port =
+          if elemAt m 3 != null
+          then toInt (elemAt m 3)
+          else if head m == "https"
+          then 443
+          else 80;
+        remote = m != null && origin != host && !elem origin ["localhost" "127.0.0.1" "[::1]"];
+        services = attrValues (
+          if hosts ? ${origin}
+          then hosts.${origin}.doomlab.services or {}
+          else throw "${host}: tunnel ${tunnel} sends ${hostname} to ${origin}, which is not in nixosConfigurations"
+        );
+        local = concatMap (s: s.ports.local) services;
+        tailnet = concatMap (s: s.ports.tailnet) services;
+      in
+        optional (remote && elem port local && !elem port tailnet)
+        "${host}: tunnel ${tunnel} sends ${hostname} to ${origin}:${toString port}, which ${origin} only serves locally; add it to the service's ports.tailnet")
+      t.ingress))
+    (cfg.doomlab.cloudflared.tunnels or {}));
+
+  errors =
+    duplicateServerNames
+    ++ concatLists (mapAttrsToList portClashes hosts)
+    ++ concatLists (mapAttrsToList firewallOverlaps hosts)
+    ++ concatLists (mapAttrsToList unreachableOrigins hosts);
+in
+  pkgs.runCommand "doomlab-conflicts" {} (
+    if errors == []
+    then "touch $out"
+    else ''
+      cat >&2 <<'EOF'
+      ${concatStringsSep "\n" errors}
+      EOF
+      exit 1
+    ''
+  )
@@ -0,0 +1,84 @@
+# Checks what modules/nixos/hardware.nix derives from the sample nixos-facter
+# reports tools/internal/facter parses in its tests, and that every machine
+# with a report loads its network drivers in the initrd for remote unlock.
+# Run by `nix flake check`.
+{pkgs}: {nixosConfigurations}:
+with pkgs.lib; let
+  evalReport = report:
+    (import (pkgs.path + "/nixos/lib/eval-config.nix") {
+      system = null;
+      modules = [
+        ./../modules/nixos/hardware.nix
+        {
+          doomlab.hardware.report = report;
+          hardware.enableRedistributableFirmware = true;
+          system.stateVersion = "24.11";
+        }
+      ];
+    })
+    .config;
+
+  # What each sample must come out as
+  samples = {
+    # AMD laptop board with Wi-Fi, which is no use to remote unlock
+    "report.json" = {
+      interfaces = ["enp1s0"];
+      networkDrivers = ["r8169"];
+      initrd = ["nvme" "xhci_pci" "usbhid"];
+      kvm = "kvm-amd";
+      vendor = "amd";
+    };
+    # Intel mini PC with SATA and NVMe disks, USB boot and an i225 NIC
+    "intel.json" = {
+      interfaces = ["enp2s0"];
+      networkDrivers = ["igc"];
+      initrd = ["xhci_pci" "ahci" "nvme" "usbhid" "usb_storage" "sd_mod"];
+      kvm = "kvm-intel";
+      vendor = "intel";
+    };
+  };
+
+  sampleErrors = file: want: let
+    cfg = evalReport (./../tools/internal/facter/testdata + "/${file}");
+    expect = name: actual: expected:
+      optional (actual != expected)
+      "${file}: ${name} is ${builtins.toJSON actual}, expected ${builtins.toJSON expected}";
+    missing = name: have: wanted:
+      optional (subtractLists have wanted != [])
+      "${file}: ${name} lacks ${concatStringsSep ", " (subtractLists have wanted)}";
+    other =
+      if want.vendor == "amd"
+      then "intel"
+      else "amd";
+  in
+    expect "nixpkgs.hostPlatform" cfg.nixpkgs.hostPlatform.system "x86_64-linux"
+    ++ expect "doomlab.hardware.interfaces" cfg.doomlab.hardware.interfaces want.interfaces
+    ++ expect "doomlab.hardware.networkDrivers" cfg.doomlab.hardware.networkDrivers want.networkDrivers
+    ++ missing "boot.initrd.availableKernelModules" cfg.boot.initrd.availableKernelModules want.initrd
+    ++ optional (intersectLists cfg.boot.initrd.availableKernelModules want.networkDrivers != [])
+    "${file}: the network driver is in the initrd without remote unlock"
+    ++ missing "boot.kernelModules" cfg.boot.kernelModules [want.kvm]
+    ++ expect "hardware.cpu.${want.vendor}.updateMicrocode" cfg.hardware.cpu.${want.vendor}.updateMicrocode true
+    ++ expect "hardware.cpu.${other}.updateMicrocode" cfg.hardware.cpu.${other}.updateMicrocode false;
+
+  unlockErrors = concatLists (mapAttrsToList (host: s: let
+      cfg = s.config;
+      drivers = cfg.doomlab.hardware.networkDrivers or [];
+      lacking = subtractLists cfg.boot.initrd.availableKernelModules drivers;
+    in
+      optional (cfg.boot.initrd.network.enable && cfg.doomlab.hardware.report or null != null && lacking != [])
+      "${host}: remote unlock lacks the network drivers ${concatStringsSep ", " lacking} from its report")
+    nixosConfigurations);
+
+  errors = concatLists (mapAttrsToList sampleErrors samples) ++ unlockErrors;
+in
+  pkgs.runCommand "doomlab-hardware" {} (
+    if errors == []
+    then "touch $out"
+    else ''
+      cat >&2 <<'EOF'
+      ${concatStringsSep "\n" errors}
+      EOF
+      exit 1
+    ''
+  )
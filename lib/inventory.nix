@@ -0,0 +1,124 @@
+# What each host runs, read from its evaluated configuration so the report
+# stays in step with the imports. Exposed as the flake's `inventory` output
+# and rendered by `doomctl inventory`.
+{lib}:
+with lib; let
+  ports = fw: {
+    tcp = fw.allowedTCPPorts;
+    udp = fw.allowedUDPPorts;
+    tcpRanges = fw.allowedTCPPortRanges;
+    udpRanges = fw.allowedUDPPortRanges;
+  };
+
+  # The class of machine comes from the profile it imports; only the
+  # installer images are built without one.
+  profile = name: cfg:
+    cfg.doomlab.profile or (
+      if cfg.system.build ? isoImage
+      then "installer"
+      else throw "${name} imports no profile from modules/profiles, so doomlab.profile is unset"
+    );
+
+  # Services declare their state and backups in services/_registry.nix;
+  # darwin hosts and unconverted modules fall back to empty values.
+  common = name: cfg: {
+    inherit name;
+    system = cfg.nixpkgs.hostPlatform.system;
+    hostname =
+      if cfg.networking.hostName or null != null
+      then cfg.networking.hostName
+      else name;
+    services = cfg.doomlab.services or {};
+    secrets =
+      mapAttrsToList (secret: s: {
+        name = secret;
+        file = baseNameOf (toString s.sopsFile);
+        owner = s.owner or "root";
+      })
+      (cfg.sops.secrets or {});
+  };
+
+  nixos = name: cfg: let
+    nginx = cfg.services.nginx;
+    persistence = attrValues (filterAttrs (_: p: p.enable or true) cfg.environment.persistence or {});
+    timers = cfg.systemd.timers;
+  in
+    common name cfg
+    // {
+      kind = "nixos";
+      roles =
+        [(profile name cfg)]
+        ++ optional cfg.boot.initrd.network.ssh.enable "remote-unlock"
+        ++ optional cfg.system.autoUpgrade.enable "auto-update";
+
+      firewall =
+        {inherit (cfg.networking.firewall) enable;}
+        // ports cfg.networking.firewall
+        // {
+          # the firewall module mirrors the global rules into `default`
+          interfaces = mapAttrs (_: ports) (removeAttrs cfg.networking.firewall.interfaces ["default"]);
+        };
+
+      vhosts = optionals nginx.enable (mapAttrsToList (vhost: v: {
+          name = vhost;
+          serverName =
+            if v.serverName != null
+            then v.serverName
+            else vhost;
+          aliases = v.serverAliases;
+          tls = v.forceSSL || v.onlySSL || v.addSSL;
+          issuer = cfg.doomlab.acme.vhosts.${vhost} or null;
+          upstreams = unique (filter (p: p != null) (mapAttrsToList (_: l: l.proxyPass) v.locations));
+          clientCert = cfg.doomlab.nginx.hardening.${vhost}.requireClientCert or false;
+          allow = cfg.doomlab.nginx.hardening.${vhost}.allow or [];
+        })
+        nginx.virtualHosts);
+
+      tunnels =
+        mapAttrsToList (hostname: p: {
+          inherit hostname;
+          inherit (p) service tunnels;
+        })
+        (cfg.doomlab.cloudflared.public or {});
+
+      persist = concatMap (p:
+        map (d: d.directory or d) p.directories
+        ++ map (f: f.file or f) p.files)
+      persistence;
+
+      backups =
+        mapAttrsToList (unit: _: let
+          service = removePrefix "backup-" unit;
+        in {
+          name = service;
+          inherit unit;
+          schedule = timers.${unit}.timerConfig.OnCalendar or null;
+          paths = cfg.doomlab.services.${service}.backups or [];
+        })
+        (filterAttrs (unit: _: hasPrefix "backup-" unit) cfg.systemd.services);
+    };
+
+  darwin = name: cfg:
+    common name cfg
+    // {
+      kind = "darwin";
+      roles = [(profile name cfg)];
+      firewall = {
+        enable = cfg.networking.applicationFirewall.enable or false;
+        tcp = [];
+        udp = [];
+        tcpRanges = [];
+        udpRanges = [];
+        interfaces = {};
+      };
+      vhosts = [];
+      tunnels = [];
+      persist = [];
+      backups = [];
+    };
+in {
+  nixosConfigurations,
+  darwinConfigurations,
+}:
+  mapAttrs (name: s: nixos name s.config) nixosConfigurations
+  // mapAttrs (name: s: darwin name s.config) darwinConfigurations
@@ -0,0 +1,97 @@
+# Address arithmetic for eval-time checks of doomlab.network and the modules
+# that depend on it: parsing IPv4 and IPv6 CIDRs, subnet membership and
+# overlap.
+{lib}:
+with lib; let
+  pow2 = n: foldl' (acc: _: acc * 2) 1 (range 1 n);
+
+  hexDigits = listToAttrs (imap0 (i: c: nameValuePair c i) (stringToCharacters "0123456789abcdef"));
+  fromHex = s: foldl' (acc: c: acc * 16 + hexDigits.${c}) 0 (stringToCharacters (toLower s));
+
+  # Addresses are a list of groups: four 8-bit octets or eight 16-bit hextets
+  parseIPv4 = s: let
+    m = builtins.match "([0-9]{1,3})\\.([0-9]{1,3})\\.([0-9]{1,3})\\.([0-9]{1,3})" s;
+    octets = map toInt m;
+  in
+    if m == null || any (o: o > 255) octets
+    then null
+    else {
+      family = 4;
+      width = 8;
+      groups = octets;
+    };
+
+  parseIPv6 = s: let
+    halves = splitString "::" s;
+    groupsOf = part:
+      if part == ""
+      then []
+      else splitString ":" part;
+    parts = map groupsOf halves;
+    given = concatLists parts;
+    hextets =
+      if length halves == 1
+      then given
+      else head parts ++ genList (_: "0") (8 - length given) ++ last parts;
+  in
+    if
+      (length halves == 1 && length given == 8 || length halves == 2 && length given < 8)
+      && all (g: builtins.match "[0-9a-fA-F]{1,4}" g != null) given
+    then {
+      family = 6;
+      width = 16;
+      groups = map fromHex hextets;
+    }
+    else null;
+
+  parseAddress = s:
+    if hasInfix ":" s
+    then parseIPv6 s
+    else parseIPv4 s;
+
+  # the groups of address with everything past prefix bits cleared
+  mask = prefix: a:
+    imap0 (i: g: let
+      keep = max 0 (min a.width (prefix - i * a.width));
+    in
+      g - mod g (pow2 (a.width - keep)))
+    a.groups;
+
+  parseCidr = s: let
+    m = builtins.match "([^/]+)/([0-9]{1,3})" s;
+    address = parseAddress (head m);
+    prefix = toInt (elemAt m 1);
+  in
+    if m == null || address == null || prefix > length address.groups * address.width
+    then null
+    else address // {inherit prefix;};
+
+  sameNetwork = prefix: a: b: a.family == b.family && mask prefix a == mask prefix b;
+
+  format = a:
+    if a.family == 4
+    then concatMapStringsSep "." toString a.groups
+    else concatMapStringsSep ":" (g: toLower (toHexString g)) a.groups;
+in {
+  isAddress = s: parseAddress s != null;
+  isCidr = s: parseCidr s != null;
+  isIPv6 = s: hasInfix ":" s;
+
+  # "10.0.10.2/24" -> "10.0.10.0/24"; IPv6 comes back uncompressed
+  subnetOf = s: let
+    c = parseCidr s;
+  in "${format (c // {groups = mask c.prefix c;})}/${toString c.prefix}";
+
+  # whether an address, with or without a prefix, lies inside subnet
+  contains = subnet: address: let
+    s = parseCidr subnet;
+    a = parseAddress (head (splitString "/" address));
+  in
+    s != null && a != null && sameNetwork s.prefix s a;
+
+  overlaps = a: b: let
+    x = parseCidr a;
+    y = parseCidr b;
+  in
+    x != null && y != null && sameNetwork (min x.prefix y.prefix) x y;
+}
@@ -1,37 +1,12 @@
 {
-  inputs,
-  outputs,
-  ...
-}: {
   imports = [
-    inputs.impermanence.nixosModules.impermanence
-    inputs.home-manager.nixosModules.home-manager
-
     ./hardware-configuration.nix
 
-    ./../../modules/nixos/base.nix
-    ./../../modules/nixos/desktop.nix
+    ./../../modules/profiles/desktop.nix
     ./../../modules/nixos/amdgpu.nix
 
     ./../../services/tailscale.nix
   ];
 
-  home-manager = {
-    extraSpecialArgs = {inherit inputs outputs;};
-    useGlobalPkgs = true;
-    useUserPackages = true;
-    users = {
-      orther = {
-        imports = [
-          ./../../modules/home-manager/base.nix
-          ./../../modules/home-manager/fonts.nix
-          ./../../modules/home-manager/alacritty.nix
-          ./../../modules/home-manager/1password.nix
-          ./../../modules/home-manager/desktop.nix
-        ];
-      };
-    };
-  };
-
   networking.hostName = "dsk1chng";
 }
@@ -1,32 +1,10 @@
 {
-  inputs,
-  outputs,
-  ...
-}: {
   imports = [
-    inputs.home-manager.darwinModules.home-manager
-
     ./hardware-configuration.nix
 
-    ./../../modules/macos/base.nix
+    ./../../modules/profiles/workstation.nix
   ];
 
-  home-manager = {
-    extraSpecialArgs = {inherit inputs outputs;};
-    useGlobalPkgs = true;
-    useUserPackages = true;
-    users = {
-      orther = {
-        imports = [
-          ./../../modules/home-manager/base.nix
-          ./../../modules/home-manager/fonts.nix
-          ./../../modules/home-manager/alacritty.nix
-          ./../../modules/home-manager/1password.nix
-        ];
-      };
-    };
-  };
-
   networking = {
     hostName = "mac1chng";
     computerName = "mac1chng";
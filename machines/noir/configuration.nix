@@ -1,20 +1,12 @@
 {
-  inputs,
-  outputs,
-  lib,
-  ...
-}: {
   imports = [
-    inputs.impermanence.nixosModules.impermanence
-    inputs.home-manager.nixosModules.home-manager
     #inputs.nixarr.nixosModules.default
 
     ./hardware-configuration.nix
 
-    ./../../modules/nixos/base.nix
-    ./../../modules/nixos/remote-unlock.nix
-    ./../../modules/nixos/auto-update.nix
+    ./../../modules/profiles/server.nix
 
+    ./../../services/_cloudflared.nix
     ./../../services/nas.nix
     ./../../services/tailscale.nix
     #./../../services/netdata.nix
@@ -22,47 +14,38 @@
     #./../../services/nixarr.nix
   ];
 
-  home-manager = {
-    extraSpecialArgs = {inherit inputs outputs;};
-    useGlobalPkgs = true;
-    useUserPackages = true;
-    users = {
-      orther = {
-        imports = [
-          ./../../modules/home-manager/base.nix
-        ];
+  home-manager.users.orther = {
+    programs.git = {
+      enable = true;
+      userName = "Brandon Orther";
+      userEmail = "brandon@orther.dev";
+    };
 
-        programs.git = {
-          enable = true;
-          userName = "Brandon Orther";
-          userEmail = "brandon@orther.dev";
-        };
-        
-        programs.ssh = {
-          enable = true;
-          matchBlocks = {
-            "github.com" = {
-              hostname = "github.com";
-              identityFile = "~/.ssh/id_ed25519";
-            };
-            # Add more hosts as needed
-          };
+    programs.ssh = {
+      enable = true;
+      matchBlocks = {
+        "github.com" = {
+          hostname = "github.com";
+          identityFile = "~/.ssh/id_ed25519";
         };
+        # Add more hosts as needed
       };
     };
   };
 
-  networking = {
-    hostName = "noir";
-    useDHCP = false;
-    interfaces.enp2s0.useDHCP = true;
-    useNetworkd = true;
-    networkmanager.enable = lib.mkForce false; # Override base.nix NetworkManager setting
+  # Replica connector so watch.orther.dev and scrypted.orther.dev survive
+  # svr2chng's connector going away
+  doomlab.cloudflared.tunnels."doomlab-01" = {
+    sopsFile = ./../../secrets/cloudflare-tunnel;
+    replica = true;
+    ingress = {
+      "watch.orther.dev".service = "http://svr2chng:8096";
+      "scrypted.orther.dev" = {
+        service = "https://svr3chng:10444";
+        noTLSVerify = true;
+      };
+    };
   };
 
-  # Disable problematic wait services during NetworkManager -> systemd-networkd transition
-  systemd.services = {
-    "NetworkManager-wait-online".enable = lib.mkForce false;
-    "systemd-networkd-wait-online".enable = lib.mkForce false;
-  };
+  networking.hostName = "noir";
 }
@@ -1,34 +1,22 @@
-{
-  inputs,
-  outputs,
-  ...
-}: {
+{inputs, ...}: {
   imports = [
-    inputs.impermanence.nixosModules.impermanence
-    inputs.home-manager.nixosModules.home-manager
     inputs.nixarr.nixosModules.default
 
     ./hardware-configuration.nix
 
-    ./../../modules/nixos/base.nix
-    ./../../modules/nixos/remote-unlock.nix
-    ./../../modules/nixos/auto-update.nix
+    ./../../modules/profiles/server.nix
 
     ./../../services/tailscale.nix
     # ./../../services/netdata.nix
     ./../../services/nixarr.nix
   ];
 
-  home-manager = {
-    extraSpecialArgs = {inherit inputs outputs;};
-    useGlobalPkgs = true;
-    useUserPackages = true;
-    users = {
-      orther = {
-        imports = [
-          ./../../modules/home-manager/base.nix
-        ];
-      };
+  doomlab.cloudflared.tunnels."doomlab-01" = {
+    sopsFile = ./../../secrets/cloudflare-tunnel;
+    # Scrypted runs on svr3chng, which connects as a replica
+    ingress."scrypted.orther.dev" = {
+      service = "https://svr3chng:10444";
+      noTLSVerify = true;
     };
   };
 
@@ -1,36 +1,26 @@
 {
-  inputs,
-  outputs,
-  ...
-}: {
   imports = [
-    inputs.impermanence.nixosModules.impermanence
-    inputs.home-manager.nixosModules.home-manager
-
     ./hardware-configuration.nix
 
-    ./../../modules/nixos/base.nix
-    ./../../modules/nixos/remote-unlock.nix
-    ./../../modules/nixos/auto-update.nix
+    ./../../modules/profiles/server.nix
 
     ./../../services/tailscale.nix
     # ./../../services/netdata.nix
+    ./../../services/home-assistant.nix
     ./../../services/homebridge.nix
     ./../../services/scrypted.nix
   ];
 
-  home-manager = {
-    extraSpecialArgs = {inherit inputs outputs;};
-    useGlobalPkgs = true;
-    useUserPackages = true;
-    users = {
-      orther = {
-        imports = [
-          ./../../modules/home-manager/base.nix
-        ];
-      };
-    };
+  # Replica connector carrying scrypted.orther.dev, which the other
+  # doomlab-01 connectors send here
+  doomlab.cloudflared.tunnels."doomlab-01" = {
+    sopsFile = ./../../secrets/cloudflare-tunnel;
+    replica = true;
+    ingress."watch.orther.dev".service = "http://svr2chng:8096";
   };
 
   networking.hostName = "svr3chng";
+
+  # NVR recordings on the data disk, out of the NVMe and the nightly backup
+  doomlab.scrypted.recordings.path = "/fun/nvr";
 }
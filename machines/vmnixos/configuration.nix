@@ -1,18 +1,8 @@
 {
-  inputs,
-  outputs,
-  ...
-}: {
   imports = [
-    #inputs.impermanence.nixosModules.impermanence
-    inputs.home-manager.nixosModules.home-manager
-    #inputs.nixarr.nixosModules.default
-
     ./hardware-configuration.nix
 
-    ./../../modules/nixos/base.nix
-    #./../../modules/nixos/remote-unlock.nix
-    #./../../modules/nixos/auto-update.nix
+    ./../../modules/profiles/server.nix
 
     #./../../services/tailscale.nix
     #./../../services/netdata.nix
@@ -20,18 +10,9 @@
     #./../../services/nixarr.nix
   ];
 
-  home-manager = {
-    extraSpecialArgs = {inherit inputs outputs;};
-    useGlobalPkgs = true;
-    useUserPackages = true;
-    users = {
-      orther = {
-        imports = [
-          ./../../modules/home-manager/base.nix
-        ];
-      };
-    };
-  };
+  # Local VM without an encrypted disk that is upgraded by hand
+  boot.initrd.network.enable = false;
+  system.autoUpgrade.enable = false;
 
   networking.hostName = "vmnixos";
 }
@@ -1,29 +1,9 @@
 {
-  inputs,
-  outputs,
-  ...
-}: {
   imports = [
-    inputs.home-manager.nixosModules.home-manager
-    inputs.nixos-wsl.nixosModules.default
-
     ./hardware-configuration.nix
 
-    ./../../modules/wsl/base.nix
+    ./../../modules/profiles/wsl.nix
   ];
 
-  home-manager = {
-    extraSpecialArgs = {inherit inputs outputs;};
-    useGlobalPkgs = true;
-    useUserPackages = true;
-    users = {
-      orther = {
-        imports = [
-          ./../../modules/home-manager/base.nix
-        ];
-      };
-    };
-  };
-
   networking.hostName = "workchng";
 }
@@ -1,18 +1,8 @@
 {
-  inputs,
-  outputs,
-  ...
-}: {
   imports = [
-    inputs.impermanence.nixosModules.impermanence
-    inputs.home-manager.nixosModules.home-manager
-    #inputs.nixarr.nixosModules.default
-
     ./hardware-configuration.nix
 
-    ./../../modules/nixos/base.nix
-    ./../../modules/nixos/remote-unlock.nix
-    ./../../modules/nixos/auto-update.nix
+    ./../../modules/profiles/server.nix
 
     ./../../services/tailscale.nix
     #./../../services/netdata.nix
@@ -20,23 +10,5 @@
     #./../../services/nixarr.nix
   ];
 
-  home-manager = {
-    extraSpecialArgs = {inherit inputs outputs;};
-    useGlobalPkgs = true;
-    useUserPackages = true;
-    users = {
-      orther = {
-        imports = [
-          ./../../modules/home-manager/base.nix
-        ];
-      };
-    };
-  };
-
-  networking = {
-    hostName = "zinc";
-    useDHCP = false;
-    interfaces.enp1s0.useDHCP = true;
-    useNetworkd = true;
-  };
+  networking.hostName = "zinc";
 }
@@ -0,0 +1,20 @@
+{
+  inputs,
+  lib,
+  ...
+}:
+# What every machine of the fleet carries whatever it runs on, imported by the
+# NixOS, nix-darwin and WSL base modules.
+{
+  # The commit this system was built from, read by `doomctl drift`. Builds
+  # from a tree with uncommitted changes carry the dirty revision.
+  system.configurationRevision = inputs.self.rev or inputs.self.dirtyRev or null;
+  environment.etc."doomlab-revision".text = builtins.toJSON {
+    rev = inputs.self.rev or inputs.self.dirtyRev or "unknown";
+    dirty = !(inputs.self ? rev);
+    lastModified = inputs.self.lastModified or 0;
+  };
+
+  # Trust the internal ACME CA (services/step-ca.nix) once it has been created
+  security.pki.certificateFiles = lib.optional (builtins.pathExists ./../pki/internal-ca/root_ca.crt) ./../pki/internal-ca/root_ca.crt;
+}
@@ -1,7 +1,7 @@
-{
+{lib, ...}: {
   # inspo: https://github.com/reckenrode/nixos-configs/blob/main/hosts/meteion/configuration.nix
   system.autoUpgrade = {
-    enable = true;
+    enable = lib.mkDefault true;
     dates = "*-*-* 07:00:00";
     randomizedDelaySec = "1h";
     flake = "github:orther/doomlab";
@@ -7,7 +7,12 @@
   imports = [
     inputs.sops-nix.nixosModules.sops
 
+    ./../_fleet.nix
+
     ./_packages.nix
+    ./hardware.nix
+    ./network.nix
+    ./resources.nix
   ];
 
   boot.loader = {
@@ -65,20 +70,8 @@
     fstrim.enable = true;
   };
 
-  networking = {
-    firewall.enable = true;
-    networkmanager.enable = true;
-  };
-
-  ##systemd.services.NetworkManager-wait-online.enabled = false;
-  ##systemd.services.systemd-networkd-wait-online.enable = false;
-  # inspo: https://github.com/NixOS/nixpkgs/issues/180175#issuecomment-1658731959
-  #systemd.services.NetworkManager-wait-online = {
-  #  #enable = false;
-  #  serviceConfig = {
-  #    ExecStart = ["" "${pkgs.networkmanager}/bin/nm-online -q"];
-  #  };
-  #};
+  # How the network is managed is up to the profile (modules/profiles)
+  networking.firewall.enable = true;
 
   programs.zsh.enable = true;
   security.sudo.wheelNeedsPassword = false;
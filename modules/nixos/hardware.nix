@@ -0,0 +1,78 @@
+{
+  config,
+  lib,
+  ...
+}:
+# Hardware settings derived from a nixos-facter report committed next to the
+# machine (`just hardware <host>` captures it), instead of module lists copied
+# from nixos-generate-config and driver names looked up by hand.
+with lib; let
+  cfg = config.doomlab.hardware;
+  report = importJSON cfg.report;
+  hw = report.hardware or {};
+
+  driversOf = devices: concatMap (d: d.driver_modules or []) devices;
+  subClass = name: filter (d: (d.sub_class.name or null) == name);
+
+  cpu = head (hw.cpu or [{}]);
+  vendor =
+    {
+      GenuineIntel = "intel";
+      AuthenticAMD = "amd";
+    }
+    .${cpu.vendor_name or ""}
+    or null;
+  virtualization =
+    if elem "vmx" (cpu.features or [])
+    then "kvm-intel"
+    else if elem "svm" (cpu.features or [])
+    then "kvm-amd"
+    else null;
+
+  ethernet = subClass "Ethernet" (hw.network_interface or []);
+in {
+  options.doomlab.hardware = {
+    report = mkOption {
+      description = "nixos-facter report of this machine, e.g. ./facter.json";
+      type = types.nullOr types.path;
+      default = null;
+    };
+
+    interfaces = mkOption {
+      description = "Wired network interfaces found in the report";
+      type = types.listOf types.str;
+      readOnly = true;
+      default =
+        if cfg.report == null
+        then []
+        else unique (concatMap (i: i.unix_device_names or []) ethernet);
+      defaultText = literalExpression "wired interfaces from the report";
+    };
+
+    networkDrivers = mkOption {
+      description = "Kernel modules of the wired network controllers in the report, which remote unlock loads in the initrd";
+      type = types.listOf types.str;
+      readOnly = true;
+      default =
+        if cfg.report == null
+        then []
+        else unique (driversOf (subClass "Ethernet controller" (hw.network_controller or [])) ++ driversOf ethernet);
+      defaultText = literalExpression "drivers of the wired network controllers in the report";
+    };
+  };
+
+  config = mkIf (cfg.report != null) {
+    nixpkgs.hostPlatform = mkDefault report.system;
+
+    # what the initrd needs to find and mount the disks, and a keyboard to
+    # type the passphrase on
+    boot.initrd.availableKernelModules = unique (driversOf (
+      hw.storage_controller or [] ++ hw.disk or [] ++ hw.usb_controller or [] ++ hw.firewire_controller or [] ++ hw.keyboard or []
+    ));
+    boot.kernelModules = optional (virtualization != null) virtualization;
+
+    hardware.cpu = optionalAttrs (vendor != null) {
+      ${vendor}.updateMicrocode = mkDefault config.hardware.enableRedistributableFirmware;
+    };
+  };
+}
@@ -0,0 +1,319 @@
+{
+  config,
+  lib,
+  ...
+}:
+# Static addressing, VLANs, bridges and bonds on systemd-networkd, checked
+# when the configuration evaluates rather than when a host drops off the
+# network. Hosts that declare nothing keep the DHCP and SLAAC their profile
+# sets up. Every link is dual-stack unless told otherwise.
+with lib; let
+  cfg = config.doomlab.network;
+  net = import ./../../lib/net.nix {inherit lib;};
+
+  cidr = types.addCheck types.str net.isCidr // {description = "IPv4 or IPv6 address with prefix length";};
+  address = types.addCheck types.str net.isAddress // {description = "IPv4 or IPv6 address";};
+  ipv4 = types.addCheck address (a: !net.isIPv6 a) // {description = "IPv4 address";};
+  ipv6 = types.addCheck address net.isIPv6 // {description = "IPv6 address";};
+
+  linkOptions = {
+    addresses = mkOption {
+      description = "Static addresses with their prefix length";
+      type = types.listOf cidr;
+      default = [];
+      example = ["192.168.1.10/24" "fd00:10::10/64"];
+    };
+    gateway = mkOption {
+      description = "IPv4 default gateway, inside one of the addresses' subnets";
+      type = types.nullOr ipv4;
+      default = null;
+    };
+    gateway6 = mkOption {
+      description = ''
+        IPv6 default gateway, inside one of the addresses' subnets or
+        link-local. Not needed where the router sends advertisements.
+      '';
+      type = types.nullOr ipv6;
+      default = null;
+    };
+    dns = mkOption {
+      description = "DNS servers used while this link is up";
+      type = types.listOf address;
+      default = [];
+    };
+    dhcp = mkEnableOption "DHCPv4 on this link";
+    ipv6 = mkOption {
+      description = ''
+        How the link gets IPv6 addresses besides `addresses`: `auto` takes
+        SLAAC addresses and routes from router advertisements and asks
+        DHCPv6 when they say to, `dhcpv6` always asks DHCPv6 as well, and
+        `static` ignores advertisements.
+      '';
+      type = types.enum ["auto" "dhcpv6" "static"];
+      default = "auto";
+    };
+  };
+
+  membersOption = what:
+    mkOption {
+      description = "Links ${what}; they carry no addresses of their own";
+      type = types.listOf types.str;
+      default = [];
+    };
+
+  # names a bridge or bond takes over
+  ports = concatMap (b: b.interfaces) (attrValues cfg.bridges ++ attrValues cfg.bonds);
+  portOf = name:
+    findFirst (n: elem name cfg.bridges.${n}.interfaces) null (attrNames cfg.bridges);
+  bondOf = name:
+    findFirst (n: elem name cfg.bonds.${n}.interfaces) null (attrNames cfg.bonds);
+
+  # everything with addresses or DHCP
+  links = cfg.interfaces // cfg.vlans // cfg.bridges // cfg.bonds;
+  declared = attrNames links;
+  names = unique (declared ++ ports);
+
+  kinds = [cfg.interfaces cfg.vlans cfg.bridges cfg.bonds];
+  duplicateNames = filter (n: count (k: k ? ${n}) kinds > 1) declared;
+
+  hasL3 = l: l.addresses != [] || l.gateway != null || l.gateway6 != null || l.dns != [] || l.dhcp;
+  vlansOn = parent: attrNames (filterAttrs (_: v: v.parent == parent) cfg.vlans);
+  # a link with nothing set that only carries VLANs gets no addresses at all
+  carrierOnly = name: l: !hasL3 l && vlansOn name != [];
+
+  addresses = concatLists (mapAttrsToList (name: l: map (a: {inherit name a;}) l.addresses) links);
+  clashes = filter (x: any (y: x.name != y.name && net.overlaps x.a y.a) addresses) addresses;
+
+  l3Network = name: l: {
+    matchConfig.Name = name;
+    address = l.addresses;
+    gateway = optional (l.gateway != null) l.gateway ++ optional (l.gateway6 != null) l.gateway6;
+    inherit (l) dns;
+    vlan = vlansOn name;
+    networkConfig =
+      if carrierOnly name l
+      then {
+        DHCP = "no";
+        LinkLocalAddressing = "no";
+        IPv6AcceptRA = false;
+      }
+      else {
+        DHCP =
+          if l.dhcp && l.ipv6 == "dhcpv6"
+          then "yes"
+          else if l.dhcp
+          then "ipv4"
+          else if l.ipv6 == "dhcpv6"
+          then "ipv6"
+          else "no";
+        IPv6AcceptRA = l.ipv6 != "static";
+      };
+    # a DHCPv6 lease only comes with a router advertisement unless asked for
+    dhcpV6Config = mkIf (l.ipv6 == "dhcpv6") {WithoutRA = "solicit";};
+    linkConfig.RequiredForOnline =
+      if carrierOnly name l
+      then "carrier"
+      else "routable";
+  };
+
+  portNetwork = name: {
+    matchConfig.Name = name;
+    networkConfig =
+      if portOf name != null
+      then {Bridge = portOf name;}
+      else {Bond = bondOf name;};
+    linkConfig.RequiredForOnline = "enslaved";
+  };
+in {
+  options.doomlab.network = {
+    interfaces = mkOption {
+      description = "Physical interfaces by kernel name";
+      type = types.attrsOf (types.submodule {options = linkOptions;});
+      default = {};
+      example = literalExpression ''
+        {
+          enp1s0 = {
+            addresses = ["192.168.1.10/24"];
+            gateway = "192.168.1.1";
+            dns = ["192.168.1.1"];
+          };
+        }
+      '';
+    };
+
+    vlans = mkOption {
+      description = "Tagged VLAN subinterfaces";
+      type = types.attrsOf (types.submodule {
+        options =
+          linkOptions
+          // {
+            id = mkOption {
+              description = "802.1Q VLAN id";
+              type = types.ints.between 1 4094;
+            };
+            parent = mkOption {
+              description = "Interface, bond or bridge the VLAN is tagged on";
+              type = types.str;
+            };
+          };
+      });
+      default = {};
+      example = literalExpression ''
+        {
+          cameras = {
+            id = 10;
+            parent = "enp1s0";
+            addresses = ["10.0.10.2/24"];
+          };
+        }
+      '';
+    };
+
+    bridges = mkOption {
+      description = "Bridges, e.g. for virtual machines to share a wired interface";
+      type = types.attrsOf (types.submodule {
+        options = linkOptions // {interfaces = membersOption "attached to the bridge";};
+      });
+      default = {};
+    };
+
+    bonds = mkOption {
+      description = "Link aggregation of several interfaces";
+      type = types.attrsOf (types.submodule {
+        options =
+          linkOptions
+          // {
+            interfaces = membersOption "aggregated by the bond";
+            mode = mkOption {
+              description = "Bonding mode; 802.3ad needs LACP on the switch ports";
+              type = types.enum ["active-backup" "802.3ad" "balance-alb"];
+              default = "active-backup";
+            };
+          };
+      });
+      default = {};
+    };
+  };
+
+  config = mkIf (names != []) {
+    assertions =
+      [
+        {
+          assertion = duplicateNames == [];
+          message = "doomlab.network: ${concatStringsSep ", " duplicateNames} declared as more than one kind of link";
+        }
+        {
+          assertion = all (n: stringLength n <= 15) names;
+          message = "doomlab.network: interface names are at most 15 characters";
+        }
+        {
+          assertion = length ports == length (unique ports);
+          message = "doomlab.network: an interface can be in only one bridge or bond";
+        }
+        {
+          assertion = count (l: l.gateway != null) (attrValues links) <= 1;
+          message = "doomlab.network: only one link can set the IPv4 default gateway";
+        }
+        {
+          assertion = count (l: l.gateway6 != null) (attrValues links) <= 1;
+          message = "doomlab.network: only one link can set the IPv6 default gateway";
+        }
+        {
+          assertion = clashes == [];
+          message = "doomlab.network: ${concatStringsSep ", " (unique (map (x: x.name) clashes))} have overlapping subnets";
+        }
+        {
+          assertion = !config.networking.networkmanager.enable;
+          message = "doomlab.network configures systemd-networkd and cannot be used with NetworkManager";
+        }
+      ]
+      ++ map (name: {
+        assertion = !(links ? ${name}) || !hasL3 links.${name} && vlansOn name == [];
+        message = "doomlab.network: ${name} is in a bridge or bond and cannot have addresses, DHCP or VLANs";
+      })
+      ports
+      ++ mapAttrsToList (name: b: {
+        assertion = b.interfaces != [] && all (i: !(cfg.bridges ? ${i} || cfg.bonds ? ${i} || cfg.vlans ? ${i})) b.interfaces;
+        message = "doomlab.network.bonds.${name} needs physical interfaces to aggregate";
+      })
+      cfg.bonds
+      ++ mapAttrsToList (name: b: {
+        assertion = all (i: !(cfg.bridges ? ${i})) b.interfaces;
+        message = "doomlab.network.bridges.${name} cannot contain another bridge";
+      })
+      cfg.bridges
+      ++ mapAttrsToList (name: v: {
+        assertion = links ? ${v.parent} && !(elem v.parent ports);
+        message = "doomlab.network.vlans.${name}: parent ${v.parent} must be declared in doomlab.network and not be in a bridge or bond";
+      })
+      cfg.vlans
+      ++ mapAttrsToList (name: v: {
+        assertion = count (w: w.parent == v.parent && w.id == v.id) (attrValues cfg.vlans) == 1;
+        message = "doomlab.network.vlans.${name}: VLAN ${toString v.id} is tagged on ${v.parent} twice";
+      })
+      cfg.vlans
+      ++ mapAttrsToList (name: l: {
+        assertion = l.gateway == null || any (a: net.contains a l.gateway) l.addresses;
+        message = "doomlab.network: gateway ${toString l.gateway} of ${name} is not in any of its subnets";
+      })
+      links
+      ++ mapAttrsToList (name: l: {
+        assertion = l.gateway6 == null || net.contains "fe80::/10" l.gateway6 || any (a: net.contains a l.gateway6) l.addresses;
+        message = "doomlab.network: gateway6 ${toString l.gateway6} of ${name} is neither link-local nor in any of its subnets";
+      })
+      links;
+
+    networking = {
+      useNetworkd = true;
+      useDHCP = false;
+    };
+
+    systemd.network = {
+      enable = true;
+
+      netdevs =
+        mapAttrs' (name: v:
+          nameValuePair "20-${name}" {
+            netdevConfig = {
+              Kind = "vlan";
+              Name = name;
+            };
+            vlanConfig.Id = v.id;
+          })
+        cfg.vlans
+        // mapAttrs' (name: _:
+          nameValuePair "20-${name}" {
+            netdevConfig = {
+              Kind = "bridge";
+              Name = name;
+            };
+          })
+        cfg.bridges
+        // mapAttrs' (name: b:
+          nameValuePair "20-${name}" {
+            netdevConfig = {
+              Kind = "bond";
+              Name = name;
+            };
+            bondConfig =
+              {
+                Mode = b.mode;
+                MIIMonitorSec = "100ms";
+              }
+              // optionalAttrs (b.mode == "802.3ad") {
+                LACPTransmitRate = "fast";
+                TransmitHashPolicy = "layer3+4";
+              };
+          })
+        cfg.bonds;
+
+      networks = listToAttrs (map (name:
+        nameValuePair "30-${name}" (
+          if elem name ports
+          then portNetwork name
+          else l3Network name links.${name}
+        ))
+      names);
+    };
+  };
+}
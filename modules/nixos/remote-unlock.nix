@@ -1,12 +1,75 @@
-{config, ...}: {
-  boot.kernelParams = ["ip=dhcp"];
-  boot.initrd.network = {
-    enable = true;
-    ssh = {
-      enable = true;
-      shell = "/bin/cryptsetup-askpass";
-      authorizedKeys = config.users.users.orther.openssh.authorizedKeys.keys;
-      hostKeys = ["/nix/secret/initrd/ssh_host_ed25519_key"];
+{
+  config,
+  lib,
+  ...
+}: let
+  cfg = config.doomlab.remoteUnlock;
+  enable = config.boot.initrd.network.enable;
+  # The scripted initrd unless a host opts into systemd's, which runs
+  # networkd but ignores boot.initrd.luks.reusePassphrases
+  systemd = config.boot.initrd.systemd.enable;
+in {
+  imports = [
+    ./hardware.nix
+  ];
+
+  options.doomlab.remoteUnlock.dhcp4 = lib.mkOption {
+    description = ''
+      Whether the scripted initrd waits for a DHCPv4 lease (`ip=dhcp`). It
+      waits forever without a DHCPv4 server, so turn it off on IPv6-only
+      networks, where SLAAC alone reaches the passphrase prompt.
+    '';
+    type = lib.types.bool;
+    default = true;
+  };
+
+  config = {
+    boot.kernelParams = lib.mkIf (enable && !systemd && cfg.dhcp4) ["ip=dhcp"];
+    # The initrd needs the NIC driver to get an address. Machines with a
+    # hardware report get it from there; the rest list it in their
+    # hardware-configuration.nix.
+    boot.initrd.availableKernelModules = lib.mkIf enable config.doomlab.hardware.networkDrivers;
+    boot.initrd.network = {
+      enable = lib.mkDefault true;
+      ssh = {
+        inherit enable;
+        shell = lib.mkIf (!systemd) "/bin/cryptsetup-askpass";
+        authorizedKeys = config.users.users.orther.openssh.authorizedKeys.keys;
+        hostKeys = ["/nix/secret/initrd/ssh_host_ed25519_key"];
+      };
+      # The kernel takes SLAAC addresses from router advertisements on any
+      # link that is up, but ipconfig only keeps the one it leased on. Bring
+      # them all up and give the router a few seconds to advertise.
+      postCommands = lib.mkIf (!systemd) ''
+        for iface in $(ls /sys/class/net); do
+          [ "$iface" = lo ] || ip link set dev "$iface" up
+        done
+        for i in 1 2 3 4 5 6 7 8 9 10; do
+          ip -6 address show | grep -q 'scope global' && break
+          sleep 1
+        done
+      '';
+    };
+
+    boot.initrd.systemd = lib.mkIf (enable && systemd) {
+      network = {
+        enable = true;
+        networks."10-wired" = {
+          matchConfig.Name = "en* eth*";
+          networkConfig = {
+            DHCP = "yes";
+            IPv6AcceptRA = true;
+          };
+        };
+      };
+      # Logging in answers the passphrase prompts
+      users.root.shell = "/bin/systemd-tty-ask-password-agent";
     };
+
+    warnings = lib.optional (enable && systemd && config.boot.initrd.luks.reusePassphrases) ''
+      ${config.networking.hostName} unlocks remotely in the systemd initrd,
+      which ignores boot.initrd.luks.reusePassphrases: every LUKS device
+      asks for its passphrase.
+    '';
   };
 }
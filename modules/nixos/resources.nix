@@ -0,0 +1,149 @@
+{
+  config,
+  lib,
+  ...
+}:
+# Resource budgets per class of service, so a Jellyfin transcode or a
+# Nextcloud preview run slows its own class down instead of pushing the rest
+# of an 8GB host into the OOM killer. Each class is a slice under
+# doomlab.slice; services put their units in one with
+# `doomlab.resources.classes.<class>.units`, and backup-<name> jobs of
+# services in the registry land in `backups` on their own. `doomctl
+# resources` reports usage against the budgets.
+with lib; let
+  cfg = config.doomlab.resources;
+
+  sliceOf = class: "doomlab-${class}.slice";
+
+  backupUnits = map (name: "backup-${name}.service") (attrNames (filterAttrs (_: s: s.backups != []) (config.doomlab.services or {})));
+  unitsOf = class: c:
+    c.units ++ optionals (class == "backups") backupUnits;
+
+  # Modules may list the same unit in the same class; only a unit in two
+  # classes is a conflict
+  assigned = unique (concatLists (mapAttrsToList (class: c: map (unit: {inherit class unit;}) (unitsOf class c)) cfg.classes));
+  claimedTwice = attrNames (filterAttrs (_: as: length as > 1) (groupBy (a: a.unit) assigned));
+in {
+  options.doomlab.resources.classes = mkOption {
+    description = "Budgets of each class of service, shared by all units in it";
+    type = types.attrsOf (types.submodule {
+      options = {
+        memoryHigh = mkOption {
+          description = "Memory use above which the class is throttled and reclaimed from, as bytes or a share of RAM";
+          type = types.str;
+        };
+        memoryMax = mkOption {
+          description = "Memory use the kernel OOM killer enforces inside the class";
+          type = types.str;
+        };
+        cpuWeight = mkOption {
+          description = "Share of CPU time under contention, relative to the default of 100";
+          type = types.ints.between 1 10000;
+        };
+        ioWeight = mkOption {
+          description = "Share of disk bandwidth under contention, relative to the default of 100";
+          type = types.ints.between 1 10000;
+        };
+        pressureLimit = mkOption {
+          description = ''
+            Memory pressure, the share of time tasks stall waiting for
+            memory, above which systemd-oomd kills the class's biggest
+            cgroup rather than letting it stall the host
+          '';
+          type = types.str;
+        };
+        killOnSwap = mkOption {
+          description = "Whether systemd-oomd may kill units in the class when swap runs out";
+          type = types.bool;
+          default = true;
+        };
+        units = mkOption {
+          description = "Service units in the class";
+          type = types.listOf (types.strMatching ".+\\.service");
+          default = [];
+        };
+      };
+    });
+    default = {};
+  };
+
+  config = {
+    # Sized for the 8GB M710q. Interactive services may use most of the
+    # memory but are last to be killed; background jobs and backups get
+    # little CPU and disk time whenever anything else wants it.
+    doomlab.resources.classes = {
+      interactive = mapAttrs (_: mkDefault) {
+        memoryHigh = "55%";
+        memoryMax = "70%";
+        cpuWeight = 200;
+        ioWeight = 200;
+        pressureLimit = "80%";
+        killOnSwap = false;
+      };
+      background = mapAttrs (_: mkDefault) {
+        memoryHigh = "20%";
+        memoryMax = "30%";
+        cpuWeight = 50;
+        ioWeight = 50;
+        pressureLimit = "50%";
+      };
+      backups = mapAttrs (_: mkDefault) {
+        memoryHigh = "10%";
+        memoryMax = "15%";
+        cpuWeight = 20;
+        ioWeight = 20;
+        pressureLimit = "50%";
+      };
+    };
+
+    # System jobs that build or churn in the background
+    doomlab.resources.classes.background.units =
+      optional config.system.autoUpgrade.enable "nixos-upgrade.service"
+      ++ optional config.nix.gc.automatic "nix-gc.service"
+      ++ optional config.virtualisation.podman.enable "podman-auto-update.service";
+
+    # PostgreSQL is shared by every service on the host that uses it, so it
+    # is budgeted and persisted here once rather than by each of them. They
+    # still list its unit and state in doomlab.services so a migration stops
+    # and copies it.
+    doomlab.resources.classes.interactive.units = optional config.services.postgresql.enable "postgresql.service";
+    environment.persistence."/nix/persist".directories = optional config.services.postgresql.enable "/var/lib/postgresql";
+
+    assertions = [
+      {
+        assertion = claimedTwice == [];
+        message = "doomlab.resources: ${concatStringsSep ", " claimedTwice} assigned to more than one class";
+      }
+    ];
+
+    systemd.oomd.enable = true;
+
+    systemd.slices = mapAttrs' (class: c:
+      nameValuePair "doomlab-${class}" {
+        description = "doomlab ${class} services";
+        sliceConfig = {
+          MemoryAccounting = true;
+          MemoryHigh = c.memoryHigh;
+          MemoryMax = c.memoryMax;
+          CPUWeight = c.cpuWeight;
+          IOWeight = c.ioWeight;
+          ManagedOOMMemoryPressure = "kill";
+          ManagedOOMMemoryPressureLimit = c.pressureLimit;
+          ManagedOOMSwap =
+            if c.killOnSwap
+            then "kill"
+            else "auto";
+        };
+      })
+    cfg.classes;
+
+    systemd.services = listToAttrs (map (a:
+      nameValuePair (removeSuffix ".service" a.unit) {
+        serviceConfig =
+          {Slice = sliceOf a.class;}
+          # oomd looks elsewhere first when the whole host is short
+          // optionalAttrs (a.class == "interactive") {ManagedOOMPreference = "avoid";};
+      })
+    assigned);
+  };
+}
@@ -0,0 +1,25 @@
+{
+  inputs,
+  outputs,
+  ...
+}:
+# What every NixOS profile starts from: root on tmpfs, the base system and
+# orther's home-manager setup. Machines add to home-manager.users.orther.
+{
+  imports = [
+    inputs.impermanence.nixosModules.impermanence
+    inputs.home-manager.nixosModules.home-manager
+
+    ./_profile.nix
+    ./../nixos/base.nix
+  ];
+
+  home-manager = {
+    extraSpecialArgs = {inherit inputs outputs;};
+    useGlobalPkgs = true;
+    useUserPackages = true;
+    users.orther.imports = [
+      ./../home-manager/base.nix
+    ];
+  };
+}
@@ -0,0 +1,9 @@
+{lib, ...}:
+# Records which profile a machine was built from, for `doomctl inventory` and
+# host selection by role. Shared by the NixOS and nix-darwin profiles.
+with lib; {
+  options.doomlab.profile = mkOption {
+    description = "Class of machine this host is, set by the profile it imports from modules/profiles";
+    type = types.enum ["server" "desktop" "workstation" "wsl"];
+  };
+}
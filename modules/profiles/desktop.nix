@@ -0,0 +1,19 @@
+# Machines with a screen: NetworkManager, GNOME, 1Password and the user's
+# home directories persisted.
+{
+  imports = [
+    ./_nixos.nix
+    ./../nixos/desktop.nix
+  ];
+
+  doomlab.profile = "desktop";
+
+  networking.networkmanager.enable = true;
+
+  home-manager.users.orther.imports = [
+    ./../home-manager/fonts.nix
+    ./../home-manager/alacritty.nix
+    ./../home-manager/1password.nix
+    ./../home-manager/desktop.nix
+  ];
+}
@@ -0,0 +1,31 @@
+{lib, ...}:
+# Headless machines: systemd-networkd with DHCP and SLAAC on every wired
+# interface, remote unlock of the encrypted disk and daily upgrades from main.
+# Turn either off with `boot.initrd.network.enable = false;` or
+# `system.autoUpgrade.enable = false;`.
+{
+  imports = [
+    ./_nixos.nix
+    ./../nixos/remote-unlock.nix
+    ./../nixos/auto-update.nix
+  ];
+
+  doomlab.profile = "server";
+
+  networking = {
+    useNetworkd = lib.mkDefault true;
+    useDHCP = lib.mkDefault false;
+  };
+
+  # Links declared in doomlab.network get their own, earlier networks; this
+  # catches the rest.
+  systemd.network.networks."99-wired" = {
+    matchConfig.Name = "en* eth*";
+    networkConfig = {
+      DHCP = "yes";
+      IPv6AcceptRA = true;
+    };
+  };
+  # Boot does not hang on interfaces without a cable
+  systemd.network.wait-online.anyInterface = lib.mkDefault true;
+}
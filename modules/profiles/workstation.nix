@@ -0,0 +1,28 @@
+{
+  inputs,
+  outputs,
+  ...
+}:
+# Macs, managed with nix-darwin.
+{
+  imports = [
+    inputs.home-manager.darwinModules.home-manager
+
+    ./_profile.nix
+    ./../macos/base.nix
+  ];
+
+  doomlab.profile = "workstation";
+
+  home-manager = {
+    extraSpecialArgs = {inherit inputs outputs;};
+    useGlobalPkgs = true;
+    useUserPackages = true;
+    users.orther.imports = [
+      ./../home-manager/base.nix
+      ./../home-manager/fonts.nix
+      ./../home-manager/alacritty.nix
+      ./../home-manager/1password.nix
+    ];
+  };
+}
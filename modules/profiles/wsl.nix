@@ -0,0 +1,26 @@
+{
+  inputs,
+  outputs,
+  ...
+}:
+# NixOS on WSL: no boot loader, disks or persistence to manage.
+{
+  imports = [
+    inputs.home-manager.nixosModules.home-manager
+    inputs.nixos-wsl.nixosModules.default
+
+    ./_profile.nix
+    ./../wsl/base.nix
+  ];
+
+  doomlab.profile = "wsl";
+
+  home-manager = {
+    extraSpecialArgs = {inherit inputs outputs;};
+    useGlobalPkgs = true;
+    useUserPackages = true;
+    users.orther.imports = [
+      ./../home-manager/base.nix
+    ];
+  };
+}
@@ -1,5 +1,6 @@
 {pkgs, ...}: {
   imports = [
+    ./../_fleet.nix
     ./_packages.nix
   ];
 
@@ -1,38 +1,362 @@
-{config, ...}: {
-  sops.secrets = {
-    "cloudflare-api-email" = {};
-    "cloudflare-api-key" = {};
-  };
+{
+  config,
+  pkgs,
+  lib,
+  ...
+}:
+with lib; let
+  cfg = config.doomlab.acme;
+  vhostsUsing = issuer: attrNames (filterAttrs (_: i: i == issuer) cfg.vhosts);
+
+  # Only one host talks to Let's Encrypt and Cloudflare for the wildcard;
+  # the others pull a copy from it over the tailnet, over TLS with the
+  # wildcard itself under this name.
+  wildcardDir = "/var/lib/acme/orther.dev";
+  shareName = "acme-share.orther.dev";
+  sharing = cfg.share.issuer != null;
+  issuing = !sharing || cfg.share.issuer == config.networking.hostName;
+  public = vhostsUsing "public" != [];
+  # a staging wildcard is for trying the issuer, never for the fleet
+  serving = public && sharing && issuing && !cfg.wildcard.staging;
+in {
+  imports = [
+    ./_alerts.nix
+    ./_internal-ca.nix
+  ];
 
-  # inspo: https://carjorvaz.com/posts/setting-up-wildcard-lets-encrypt-certificates-on-nixos/
-  security.acme = {
-    acceptTerms = true;
-    defaults.email = "brandon@orther.dev";
-
-    certs."orther.dev" = {
-      domain = "orther.dev";
-      extraDomainNames = ["*.orther.dev"];
-      dnsProvider = "cloudflare";
-      dnsPropagationCheck = true;
-      # inspo: https://go-acme.github.io/lego/dns/cloudflare/
-      credentialFiles = {
-        "CLOUDFLARE_DNS_API_TOKEN_FILE" = config.sops.secrets."cloudflare-api-key".path;
-      };
-      # fix DNS challenge query failing due to using local DNS server
-      extraLegoFlags = [ "--dns.resolvers" "1.1.1.1" ];
+  options = {
+    doomlab.acme.vhosts = mkOption {
+      description = ''
+        nginx virtual hosts served over TLS and the issuer of their
+        certificate: `public` uses the *.orther.dev wildcard from Let's
+        Encrypt, `internal` requests a certificate from the step-ca on the
+        LAN (services/step-ca.nix) and never shows up in CT logs.
+      '';
+      type = types.attrsOf (types.enum ["public" "internal"]);
+      default = {};
+      example = {
+        "cloud.orther.dev" = "public";
+        "grafana.doomlab.internal" = "internal";
+      };
     };
-  };
 
-  users.users.nginx.extraGroups = ["acme"];
+    doomlab.acme.wildcard = {
+      staging = mkOption {
+        description = ''
+          Whether to request the wildcard from Let's Encrypt's staging
+          environment, for trying ACME changes on real hosts without
+          burning production rate limits. Browsers will not trust it.
+        '';
+        type = types.bool;
+        default = false;
+      };
+      server = mkOption {
+        description = "ACME directory the wildcard is requested from";
+        type = types.str;
+        default =
+          if cfg.wildcard.staging
+          then "https://acme-staging-v02.api.letsencrypt.org/directory"
+          else "https://acme-v02.api.letsencrypt.org/directory";
+        defaultText = literalExpression "Let's Encrypt production, or staging when `staging` is set";
+      };
+      dnsProvider = mkOption {
+        description = "lego DNS provider used for the DNS-01 challenge";
+        type = types.str;
+        default = "cloudflare";
+      };
+      credentialFiles = mkOption {
+        description = "Files holding the DNS provider's credentials, keyed by lego environment variable";
+        type = types.attrsOf types.path;
+        default = optionalAttrs (cfg.wildcard.dnsProvider == "cloudflare") {
+          # inspo: https://go-acme.github.io/lego/dns/cloudflare/
+          "CLOUDFLARE_DNS_API_TOKEN_FILE" = config.sops.secrets."cloudflare-api-key".path;
+        };
+        defaultText = literalExpression ''{CLOUDFLARE_DNS_API_TOKEN_FILE = config.sops.secrets."cloudflare-api-key".path;}'';
+      };
+      environmentFile = mkOption {
+        description = "Extra lego environment for DNS providers configured through plain variables";
+        type = types.nullOr types.path;
+        default = null;
+      };
+      dnsResolvers = mkOption {
+        description = ''
+          Resolvers lego checks challenge records against, tried in order.
+          The LAN resolver caches stale answers, which made DNS challenges
+          fail. Both families are listed so IPv6-only hosts reach one.
+        '';
+        type = types.listOf types.str;
+        default = ["1.1.1.1:53" "[2606:4700:4700::1111]:53"];
+      };
+      propagationCheck = mkOption {
+        description = "Whether lego waits for the challenge record to propagate before asking for validation";
+        type = types.bool;
+        default = true;
+      };
+    };
 
-  networking.firewall.allowedTCPPorts = [
-    80
-    443
-  ];
+    doomlab.acme.share = {
+      issuer = mkOption {
+        description = ''
+          Host that requests the *.orther.dev wildcard and serves it to the
+          rest of the fleet, or null for every host to request its own. Set
+          it once `acme-share-htpasswd` and `acme-share-password` are in the
+          sops file.
+        '';
+        type = types.nullOr types.str;
+        default = null;
+        example = "svr1chng";
+      };
+      port = mkOption {
+        description = "Port the issuer serves the certificate on, reachable over the tailnet only";
+        type = types.port;
+        default = 8444;
+      };
+      htpasswdFile = mkOption {
+        description = "htpasswd file the issuer checks the `acme-share` user against";
+        type = types.path;
+        default = config.sops.secrets."acme-share-htpasswd".path;
+        defaultText = literalExpression ''config.sops.secrets."acme-share-htpasswd".path'';
+      };
+      passwordFile = mkOption {
+        description = "File holding the `acme-share` user's password the other hosts pull with";
+        type = types.path;
+        default = config.sops.secrets."acme-share-password".path;
+        defaultText = literalExpression ''config.sops.secrets."acme-share-password".path'';
+      };
+      minDaysLeft = mkOption {
+        description = ''
+          Alert when the installed wildcard expires in fewer days than this.
+          The issuer renews 30 days before expiry, so a copy this old is stale.
+        '';
+        type = types.ints.positive;
+        default = 20;
+      };
+    };
 
-  environment.persistence."/nix/persist" = {
-    directories = [
-      "/var/lib/acme"
-    ];
+    doomlab.acme.internalServer = mkOption {
+      description = "ACME directory of the internal step-ca";
+      type = types.str;
+      default = "https://${config.doomlab.internalCa.name}:8443/acme/acme/directory";
+      defaultText = literalExpression ''"https://''${config.doomlab.internalCa.name}:8443/acme/acme/directory"'';
+    };
   };
+
+  config = mkMerge [
+    {
+      assertions = [
+        {
+          assertion = vhostsUsing "internal" == [] || config.doomlab.internalCa.address != null;
+          message = "doomlab.internalCa.address must be set for internal vhosts; ${config.doomlab.internalCa.name} does not resolve otherwise";
+        }
+      ];
+
+      security.acme = {
+        acceptTerms = true;
+        defaults.email = "brandon@orther.dev";
+
+        # Internal names are validated over HTTP-01 by the step-ca host, so
+        # they must resolve to this host on the LAN or tailnet.
+        certs = genAttrs (vhostsUsing "internal") (_: {
+          server = cfg.internalServer;
+        });
+      };
+
+      services.nginx.virtualHosts =
+        mapAttrs (_: issuer:
+          {forceSSL = true;}
+          // (
+            if issuer == "internal"
+            then {enableACME = true;}
+            else if issuing
+            then {useACMEHost = "orther.dev";}
+            else {
+              sslCertificate = "${wildcardDir}/fullchain.pem";
+              sslCertificateKey = "${wildcardDir}/key.pem";
+              sslTrustedCertificate = "${wildcardDir}/chain.pem";
+            }
+          ))
+        cfg.vhosts;
+
+      users.users.nginx.extraGroups = ["acme"];
+
+      networking.firewall.allowedTCPPorts = [
+        80
+        443
+      ];
+
+      environment.persistence."/nix/persist" = {
+        directories = [
+          "/var/lib/acme"
+        ];
+      };
+    }
+
+    (mkIf (public && issuing) {
+      sops.secrets = mkIf (cfg.wildcard.dnsProvider == "cloudflare") {
+        "cloudflare-api-email" = {};
+        "cloudflare-api-key" = {};
+      };
+
+      # inspo: https://carjorvaz.com/posts/setting-up-wildcard-lets-encrypt-certificates-on-nixos/
+      security.acme.certs."orther.dev" = {
+        domain = "orther.dev";
+        extraDomainNames = ["*.orther.dev"];
+        inherit (cfg.wildcard) server dnsProvider credentialFiles environmentFile;
+        dnsPropagationCheck = cfg.wildcard.propagationCheck;
+        # fix DNS challenge query failing due to using local DNS server
+        extraLegoFlags = concatMap (r: ["--dns.resolvers" r]) cfg.wildcard.dnsResolvers;
+      };
+    })
+
+    (mkIf (public && sharing && issuing && cfg.wildcard.staging) {
+      warnings = [
+        ''
+          ${config.networking.hostName} requests a staging wildcard, so it is
+          not shared; the other hosts keep the certificate they have.
+        ''
+      ];
+    })
+
+    (mkIf serving {
+      sops.secrets."acme-share-htpasswd".owner = "nginx";
+
+      # The key never crosses the tailnet in the clear
+      services.nginx.virtualHosts.${shareName} = {
+        onlySSL = true;
+        useACMEHost = "orther.dev";
+        listen = [
+          {
+            addr = "0.0.0.0";
+            inherit (cfg.share) port;
+            ssl = true;
+          }
+          {
+            addr = "[::]";
+            inherit (cfg.share) port;
+            ssl = true;
+          }
+        ];
+        locations."/orther.dev/" = {
+          alias = "${wildcardDir}/";
+          extraConfig = ''
+            auth_basic "acme-share";
+            auth_basic_user_file ${cfg.share.htpasswdFile};
+          '';
+        };
+      };
+
+      networking.firewall.interfaces.tailscale0.allowedTCPPorts = [cfg.share.port];
+    })
+
+    (mkIf (public && !issuing) {
+      sops.secrets."acme-share-password" = {};
+
+      users.users.acme = {
+        isSystemUser = true;
+        group = "acme";
+        home = "/var/lib/acme";
+      };
+      users.groups.acme = {};
+
+      systemd.services."acme-share-pull" = {
+        description = "Fetch the orther.dev wildcard certificate from ${cfg.share.issuer}";
+        wants = ["network-online.target"];
+        after = ["network-online.target" "tailscaled.service"];
+        before = ["nginx.service"];
+        wantedBy = ["multi-user.target"];
+        onFailure = ["alert@%n.service"];
+        path = with pkgs; [coreutils curl diffutils gnugrep openssl systemd];
+        script = ''
+          mkdir -p ${wildcardDir}
+
+          # nginx refuses to start without a certificate, so bootstrap with a
+          # throwaway one until the issuer is reachable
+          if [ ! -e ${wildcardDir}/fullchain.pem ]; then
+            openssl req -x509 -newkey ec -pkeyopt ec_paramgen_curve:prime256v1 -nodes -days 1 \
+              -subj /CN=orther.dev -keyout ${wildcardDir}/key.pem -out ${wildcardDir}/fullchain.pem
+            cp ${wildcardDir}/fullchain.pem ${wildcardDir}/chain.pem
+          fi
+
+          tmp="$(mktemp -d)"
+          trap 'rm -rf "$tmp"' EXIT
+          for file in fullchain.pem chain.pem key.pem; do
+            curl --silent --show-error --fail --max-time 30 \
+              --user "acme-share:$(cat ${cfg.share.passwordFile})" \
+              --connect-to ${shareName}:${toString cfg.share.port}:${cfg.share.issuer}:${toString cfg.share.port} \
+              --output "$tmp/$file" \
+              https://${shareName}:${toString cfg.share.port}/orther.dev/$file
+          done
+
+          # Never install a copy that is broken, untrusted or older than
+          # what we have
+          openssl x509 -in "$tmp/fullchain.pem" -noout -checkend 0
+          if openssl x509 -in "$tmp/fullchain.pem" -noout -issuer | grep --quiet STAGING; then
+            echo "${cfg.share.issuer} serves a Let's Encrypt staging certificate"
+            exit 1
+          fi
+          if [ "$(openssl x509 -in "$tmp/fullchain.pem" -noout -pubkey)" != "$(openssl pkey -in "$tmp/key.pem" -pubout)" ]; then
+            echo "certificate and key from ${cfg.share.issuer} do not match"
+            exit 1
+          fi
+
+          if cmp --silent "$tmp/fullchain.pem" ${wildcardDir}/fullchain.pem; then
+            echo "wildcard certificate is up to date"
+            exit 0
+          fi
+          expiry() {
+            date --date "$(openssl x509 -in "$1" -noout -enddate | cut -d= -f2)" +%s
+          }
+          if [ "$(expiry "$tmp/fullchain.pem")" -lt "$(expiry ${wildcardDir}/fullchain.pem)" ]; then
+            echo "${cfg.share.issuer} serves an older certificate than the installed one"
+            exit 1
+          fi
+
+          install -m 0644 -o acme -g acme "$tmp/fullchain.pem" "$tmp/chain.pem" ${wildcardDir}/
+          install -m 0640 -o acme -g acme "$tmp/key.pem" ${wildcardDir}/
+          echo "installed new wildcard certificate from ${cfg.share.issuer}"
+          if systemctl is-active --quiet nginx.service; then
+            systemctl reload nginx.service
+          fi
+        '';
+        serviceConfig = {
+          Type = "oneshot";
+        };
+      };
+
+      systemd.timers."acme-share-pull" = {
+        description = "Fetch the orther.dev wildcard certificate from ${cfg.share.issuer}";
+        wantedBy = ["timers.target"];
+        timerConfig = {
+          OnCalendar = "hourly";
+          RandomizedDelaySec = "10m";
+        };
+      };
+    })
+
+    (mkIf public {
+      systemd.services."acme-expiry" = {
+        description = "Check the orther.dev wildcard certificate is not stale";
+        onFailure = ["alert@%n.service"];
+        path = [pkgs.openssl];
+        script = ''
+          if ! openssl x509 -in ${wildcardDir}/fullchain.pem -noout -checkend ${toString (cfg.share.minDaysLeft * 86400)}; then
+            echo "wildcard certificate expires $(openssl x509 -in ${wildcardDir}/fullchain.pem -noout -enddate | cut -d= -f2)"
+            exit 1
+          fi
+        '';
+        serviceConfig = {
+          Type = "oneshot";
+        };
+      };
+
+      systemd.timers."acme-expiry" = {
+        description = "Check the orther.dev wildcard certificate is not stale";
+        wantedBy = ["timers.target"];
+        timerConfig = {
+          OnCalendar = "daily";
+          RandomizedDelaySec = "1h";
+        };
+      };
+    })
+  ];
 }
@@ -0,0 +1,46 @@
+{
+  config,
+  pkgs,
+  lib,
+  ...
+}:
+with lib; let
+  cfg = config.doomlab.alerts;
+in {
+  options = {
+    doomlab.alerts.ntfyUrl = mkOption {
+      description = ''
+        ntfy topic URL that failure alerts are posted to. Alerts are always
+        written to the journal at priority crit; this adds a push notification.
+      '';
+      type = types.nullOr types.str;
+      default = null;
+      example = "https://ntfy.sh/doomlab-alerts";
+    };
+  };
+
+  config = {
+    # Units opt in with `onFailure = ["alert@%n.service"];`
+    systemd.services."alert@" = {
+      description = "Send failure alert for %i";
+      scriptArgs = "%i";
+      path = with pkgs; [curl systemd util-linux];
+      script = ''
+        unit="$1"
+        message="$(hostname): $unit failed"
+        logger --priority crit --tag doomlab-alert "$message"
+        ${optionalString (cfg.ntfyUrl != null) ''
+          journalctl --unit "$unit" --lines 20 --no-pager --output cat \
+            | curl --silent --show-error --max-time 30 \
+              --header "Title: $message" \
+              --header "Tags: warning" \
+              --data-binary @- \
+              ${escapeShellArg cfg.ntfyUrl}
+        ''}
+      '';
+      serviceConfig = {
+        Type = "oneshot";
+      };
+    };
+  };
+}
@@ -3,49 +3,217 @@
   pkgs,
   lib,
   ...
-}: {
-  sops.secrets = {
-    "cloudflare-tunnel" = {
-      owner = config.services.cloudflared.user;
-      inherit (config.services.cloudflared) group;
-      format = "binary";
-      sopsFile = ./../secrets/cloudflare-tunnel;
+}:
+# Tunnels are declared per host. Running the same tunnel (same credentials) on
+# two hosts makes Cloudflare treat them as replica connectors and fail over
+# between them. Only the primary connector routes DNS; replicas just connect.
+with lib; let
+  cfg = config.doomlab.cloudflared;
+  inherit (config.services.cloudflared) user group;
+
+  ingressOptions = {
+    service = mkOption {
+      description = "Origin the hostname is forwarded to";
+      type = types.str;
+      example = "http://localhost:8096";
     };
-    "cloudflare-token" = {
-      owner = config.services.cloudflared.user;
-      inherit (config.services.cloudflared) group;
-      format = "binary";
-      sopsFile = ./../secrets/cloudflare-cert.pem;
+    noTLSVerify = mkOption {
+      description = "Skip TLS verification of the origin, e.g. for self-signed https backends";
+      type = types.bool;
+      default = false;
     };
   };
 
-  environment.etc."cloudflared/cert.pem".source = config.sops.secrets."cloudflare-token".path;
+  ingressFor = name: tunnel:
+    mapAttrs (_: rule: {
+      inherit (rule) service;
+      originRequest = optionalAttrs rule.noTLSVerify {noTLSVerify = true;};
+    })
+    (
+      (filterAttrs (_: public: elem name public.tunnels) cfg.public)
+      // tunnel.ingress
+    );
+
+  routedTunnels = filterAttrs (_: tunnel: tunnel.routeDns) cfg.tunnels;
+in {
+  imports = [
+    ./_alerts.nix
+  ];
 
-  services.cloudflared = {
-    enable = true;
-    tunnels = {
-      "doomlab-01" = {
-        credentialsFile = config.sops.secrets."cloudflare-tunnel".path;
-        default = "http_status:404";
-        ingress = {
-          "watch.orther.dev" = {
-            service = "http://localhost:8096";
+  options = {
+    doomlab.cloudflared.tunnels = mkOption {
+      description = "Cloudflare tunnels this host runs a connector for";
+      default = {};
+      type = types.attrsOf (types.submodule ({config, ...}: {
+        options = {
+          sopsFile = mkOption {
+            description = "sops encrypted tunnel credentials JSON";
+            type = types.path;
+            example = literalExpression "./../secrets/cloudflare-tunnel";
+          };
+          replica = mkOption {
+            description = "Whether this connector is a failover replica of a tunnel whose primary runs on another host";
+            type = types.bool;
+            default = false;
+          };
+          routeDns = mkOption {
+            description = "Whether to point each ingress hostname at this tunnel on boot";
+            type = types.bool;
+            default = !config.replica;
+            defaultText = literalExpression "!replica";
+          };
+          ingress = mkOption {
+            description = ''
+              Extra ingress rules for this tunnel only. Replicas use this to
+              reach origins that run on the primary host.
+            '';
+            type = types.attrsOf (types.submodule {options = ingressOptions;});
+            default = {};
+            example = literalExpression ''
+              {"watch.orther.dev".service = "http://svr2chng:8096";}
+            '';
+          };
+          metricsPort = mkOption {
+            description = "Local port cloudflared exposes Prometheus metrics on, used by the health check";
+            type = types.port;
+            default = 20241;
           };
         };
-      };
+      }));
+    };
+
+    doomlab.cloudflared.public = mkOption {
+      description = ''
+        Hostnames that services publish through Cloudflare. Each becomes an
+        ingress rule on the tunnels listed in `tunnels`, which defaults to
+        every tunnel declared on the host. Nothing is published on hosts that
+        declare no tunnels.
+      '';
+      default = {};
+      type = types.attrsOf (types.submodule {
+        options =
+          ingressOptions
+          // {
+            tunnels = mkOption {
+              description = "Tunnels the hostname is published on";
+              type = types.listOf types.str;
+              default = attrNames cfg.tunnels;
+              defaultText = literalExpression "attrNames config.doomlab.cloudflared.tunnels";
+            };
+          };
+      });
+    };
+
+    doomlab.cloudflared.originCertFile = mkOption {
+      description = ''
+        Origin certificate (cert.pem from `cloudflared tunnel login`) used to
+        manage DNS routes. Only needed when a tunnel has `routeDns` set.
+      '';
+      type = types.nullOr types.path;
+      default = ./../secrets/cloudflare-cert.pem;
     };
   };
 
-  systemd.services = {
-    "cloudflared-route-tunnel" = {
-      description = "Point traffic to tunnel subdomain";
-      after = ["cloudflared-tunnel-doomlab-01.service"];
-      wants = ["cloudflared-tunnel-doomlab-01.service"];
-      wantedBy = ["default.target"];
-      serviceConfig = {
-        Type = "oneshot";
-        ExecStart = "${lib.getExe pkgs.cloudflared} tunnel route dns 'doomlab-01' 'watch.orther.dev'";
+  config = mkIf (cfg.tunnels != {}) {
+    assertions =
+      [
+        {
+          assertion = length (unique (mapAttrsToList (_: tunnel: tunnel.metricsPort) cfg.tunnels)) == length (attrNames cfg.tunnels);
+          message = "doomlab.cloudflared: every tunnel on a host needs its own metricsPort";
+        }
+        {
+          assertion = routedTunnels == {} || cfg.originCertFile != null;
+          message = "doomlab.cloudflared: routeDns requires originCertFile";
+        }
+      ]
+      ++ mapAttrsToList (hostname: public: {
+        assertion = all (name: hasAttr name cfg.tunnels) public.tunnels;
+        message = "doomlab.cloudflared.public.${hostname} references a tunnel that is not declared on this host";
+      })
+      cfg.public;
+
+    sops.secrets =
+      mapAttrs' (name: tunnel:
+        nameValuePair "cloudflare-tunnel-${name}" {
+          owner = user;
+          inherit group;
+          format = "binary";
+          inherit (tunnel) sopsFile;
+        })
+      cfg.tunnels
+      // optionalAttrs (routedTunnels != {}) {
+        "cloudflare-token" = {
+          owner = user;
+          inherit group;
+          format = "binary";
+          sopsFile = cfg.originCertFile;
+        };
       };
+
+    services.cloudflared = {
+      enable = true;
+      tunnels =
+        mapAttrs (name: tunnel: {
+          credentialsFile = config.sops.secrets."cloudflare-tunnel-${name}".path;
+          default = "http_status:404";
+          ingress = ingressFor name tunnel;
+        })
+        cfg.tunnels;
     };
+
+    systemd.services = mkMerge (mapAttrsToList (name: tunnel: let
+        unit = "cloudflared-tunnel-${name}.service";
+        metrics = "127.0.0.1:${toString tunnel.metricsPort}";
+      in
+        {
+          "cloudflared-tunnel-${name}".environment.TUNNEL_METRICS = metrics;
+
+          "cloudflared-health-${name}" = {
+            description = "Check Cloudflare tunnel ${name} has active connections";
+            after = [unit];
+            onFailure = ["alert@%n.service"];
+            path = with pkgs; [curl gawk];
+            script = ''
+              connections="$(curl --silent --fail --max-time 10 http://${metrics}/metrics \
+                | awk '/^cloudflared_tunnel_ha_connections / {print $2}')"
+              if awk -v c="''${connections:-0}" 'BEGIN {exit !(c < 1)}'; then
+                echo "tunnel ${name} has no active connections to Cloudflare"
+                exit 1
+              fi
+              echo "tunnel ${name} has $connections active connections"
+            '';
+            serviceConfig = {
+              Type = "oneshot";
+              DynamicUser = true;
+            };
+          };
+        }
+        // optionalAttrs tunnel.routeDns {
+          "cloudflared-route-${name}" = {
+            description = "Point traffic to tunnel ${name} subdomains";
+            after = [unit];
+            wants = [unit];
+            wantedBy = ["default.target"];
+            environment.TUNNEL_ORIGIN_CERT = config.sops.secrets."cloudflare-token".path;
+            script = concatMapStrings (hostname: ''
+              ${getExe pkgs.cloudflared} tunnel route dns --overwrite-dns ${escapeShellArg name} ${escapeShellArg hostname}
+            '') (attrNames (ingressFor name tunnel));
+            serviceConfig = {
+              Type = "oneshot";
+            };
+          };
+        })
+      cfg.tunnels);
+
+    systemd.timers = mapAttrs' (name: _:
+      nameValuePair "cloudflared-health-${name}" {
+        description = "Check Cloudflare tunnel ${name} has active connections";
+        wantedBy = ["timers.target"];
+        timerConfig = {
+          OnBootSec = "5m";
+          OnUnitActiveSec = "5m";
+        };
+      })
+    cfg.tunnels;
   };
 }
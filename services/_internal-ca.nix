@@ -0,0 +1,33 @@
+{
+  config,
+  lib,
+  ...
+}:
+# Where the internal step-ca (services/step-ca.nix) is found, shared by the CA
+# and the hosts requesting certificates from it so they agree on its name and
+# the one address it listens on.
+with lib; let
+  cfg = config.doomlab.internalCa;
+in {
+  options.doomlab.internalCa = {
+    name = mkOption {
+      description = "Name the CA's ACME directory is reached by and its TLS certificate is issued for";
+      type = types.str;
+      default = "ca.doomlab.internal";
+    };
+    address = mkOption {
+      description = ''
+        LAN or tailnet address of the step-ca host. The CA only listens
+        there, and `name` resolves to it through /etc/hosts, as nothing
+        else serves the internal domain.
+      '';
+      type = types.nullOr types.str;
+      default = null;
+      example = "10.4.0.10";
+    };
+  };
+
+  config = mkIf (cfg.address != null) {
+    networking.hosts.${cfg.address} = [cfg.name];
+  };
+}
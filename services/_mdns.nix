@@ -0,0 +1,66 @@
+{
+  config,
+  lib,
+  ...
+}:
+# mDNS does not cross subnets, so HomeKit on the camera VLAN is invisible to
+# phones and hubs on the LAN unless something repeats it. Avahi's reflector
+# does, between the interfaces and for the service types listed here only.
+with lib; let
+  cfg = config.doomlab.mdns;
+  enable = cfg.interfaces != [];
+in {
+  options.doomlab.mdns = {
+    interfaces = mkOption {
+      description = ''
+        Interfaces to reflect mDNS between, e.g. the LAN and the camera
+        VLAN. The reflector runs when at least two are listed.
+      '';
+      type = types.listOf types.str;
+      default = [];
+      example = ["eno1" "cameras"];
+    };
+    services = mkOption {
+      description = ''
+        Service types reflected between the interfaces; announcements of
+        anything else stay on the segment they came from. Modules that
+        need discovery across segments add theirs.
+      '';
+      type = types.listOf (types.strMatching "_[a-z0-9-]+\\._(tcp|udp)");
+      default = [];
+      example = ["_hap._tcp" "_homekit._tcp"];
+    };
+  };
+
+  config = mkIf enable {
+    assertions = [
+      {
+        assertion = length (unique cfg.interfaces) >= 2;
+        message = "doomlab.mdns.interfaces needs at least two interfaces to reflect between";
+      }
+      {
+        # without filters avahi reflects every service on every segment
+        assertion = cfg.services != [];
+        message = "doomlab.mdns.services must list the service types to reflect";
+      }
+    ];
+
+    services.avahi = {
+      enable = true;
+      reflector = true;
+      ipv4 = true;
+      ipv6 = true;
+      allowInterfaces = unique cfg.interfaces;
+      # This host's own services announce themselves; avahi only repeats
+      publish.enable = false;
+      extraConfig = ''
+        [reflector]
+        reflect-filters=${concatMapStringsSep "," (s: "${s}.local") (unique cfg.services)}
+      '';
+    };
+
+    networking.firewall.interfaces = genAttrs cfg.interfaces (_: {
+      allowedUDPPorts = [5353];
+    });
+  };
+}
@@ -1,8 +1,310 @@
 {
-  services.nginx = {
-    enable = true;
-    recommendedTlsSettings = true;
-    recommendedOptimisation = true;
-    recommendedGzipSettings = true;
+  config,
+  pkgs,
+  lib,
+  ...
+}:
+with lib; let
+  cfg = config.doomlab.nginx;
+
+  zoneName = vhost: path: "doomlab_" + replaceStrings ["." "-" "/" "~" " "] ["_" "_" "_" "_" "_"] "${vhost}${path}";
+
+  # Scanners and SEO crawlers that have no business on a homelab
+  badBots = [
+    "ahrefsbot"
+    "censys"
+    "dirbuster"
+    "gobuster"
+    "masscan"
+    "mj12bot"
+    "nikto"
+    "nmap"
+    "nuclei"
+    "semrushbot"
+    "sqlmap"
+    "wpscan"
+    "zgrab"
+  ];
+
+  rateLimitType = types.submodule {
+    options = {
+      rate = mkOption {
+        description = "Sustained request rate per client address";
+        type = types.str;
+        default = "20r/s";
+      };
+      burst = mkOption {
+        description = "Requests allowed above the rate before clients get 429";
+        type = types.ints.positive;
+        default = 40;
+      };
+    };
+  };
+
+  hardened = filterAttrs (_: vhost: vhost.enable) cfg.hardening;
+
+  # nginx only inherits add_header into locations that set none of their own
+  securityHeaders = vhost:
+    concatStringsSep "\n" (
+      optionals vhost.headers [
+        ''add_header Strict-Transport-Security "max-age=31536000; includeSubDomains" always;''
+        ''add_header X-Content-Type-Options "nosniff" always;''
+        ''add_header X-Frame-Options "SAMEORIGIN" always;''
+        ''add_header Referrer-Policy "strict-origin-when-cross-origin" always;''
+        ''add_header Permissions-Policy "camera=(), microphone=(), geolocation=()" always;''
+      ]
+      ++ optional (vhost.contentSecurityPolicy != null) ''add_header Content-Security-Policy "${vhost.contentSecurityPolicy}" always;''
+    );
+  mutualTls = any (vhost: vhost.requireClientCert) (attrValues hardened);
+  crl = cfg.clientCa.dir + "/crl.pem";
+
+  # Zones keyed by location path, with "" standing for the whole server
+  rateLimitsOf = vhost:
+    vhost.locationRateLimits // optionalAttrs (vhost.rateLimit != null) {"" = vhost.rateLimit;};
+
+  limitReq = name: path: limit: "limit_req zone=${zoneName name path} burst=${toString limit.burst} nodelay;";
+in {
+  options = {
+    doomlab.nginx.hardening = mkOption {
+      description = ''
+        Opt-in security profile for public virtual hosts, keyed by the
+        `services.nginx.virtualHosts` name it applies to.
+      '';
+      default = {};
+      type = types.attrsOf (types.submodule ({config, ...}: {
+        options = {
+          enable = mkOption {
+            description = "Whether to apply the security profile to this virtual host";
+            type = types.bool;
+            default = true;
+          };
+          headers = mkOption {
+            description = ''
+              Whether to send HSTS and the usual security headers. Disable for
+              services whose NixOS module already sends them, such as Nextcloud.
+            '';
+            type = types.bool;
+            default = true;
+          };
+          contentSecurityPolicy = mkOption {
+            description = "Content-Security-Policy header value, or null to leave it to the application";
+            type = types.nullOr types.str;
+            default = null;
+            example = "default-src 'self'; frame-ancestors 'self'";
+          };
+          rateLimit = mkOption {
+            description = ''
+              Request rate limit for the whole virtual host, or null for none.
+              Locations with their own entry in `locationRateLimits` use that instead.
+            '';
+            type = types.nullOr rateLimitType;
+            default = {};
+          };
+          locationRateLimits = mkOption {
+            description = "Stricter request rate limits for individual locations, keyed by location path";
+            type = types.attrsOf rateLimitType;
+            default = {};
+            example = literalExpression ''{"/login".rate = "1r/s";}'';
+          };
+          maxBodySize = mkOption {
+            description = ''
+              Largest request body accepted, or null to keep what the service
+              module configures (Nextcloud derives it from maxUploadSize).
+            '';
+            type = types.nullOr types.str;
+            default = "1m";
+            example = "16G";
+          };
+          allow = mkOption {
+            description = "Source networks allowed to reach the virtual host. Everyone is allowed when empty.";
+            type = types.listOf types.str;
+            default = [];
+            example = ["10.0.0.0/8" "100.64.0.0/10"];
+          };
+          requireClientCert = mkOption {
+            description = "Whether clients must present a certificate issued by the doomlab client CA";
+            type = types.bool;
+            default = false;
+          };
+          blockBots = mkOption {
+            description = "Whether to refuse known scanners and crawlers by user agent";
+            type = types.bool;
+            default = true;
+          };
+          headersSnippet = mkOption {
+            description = ''
+              The security headers as nginx config. A location that sets its
+              own `add_header` loses the server's, so it must `include` this.
+            '';
+            type = types.path;
+            readOnly = true;
+            default = pkgs.writeText "nginx-security-headers.conf" (securityHeaders config);
+            defaultText = literalMD "the `add_header` lines for `headers` and `contentSecurityPolicy`";
+          };
+        };
+      }));
+    };
+
+    doomlab.nginx.clientCa = {
+      enable = mkOption {
+        description = ''
+          Whether the client CA used for mutual TLS exists. It is created with
+          `doomctl ca init`, which commits its certificate and CRL to `dir`.
+        '';
+        type = types.bool;
+        default = pathExists (cfg.clientCa.dir + "/ca.crt");
+        defaultText = literalExpression ''pathExists "''${dir}/ca.crt"'';
+      };
+      dir = mkOption {
+        description = "Directory holding the client CA certificate and CRL";
+        type = types.path;
+        default = ./../pki/client-ca;
+      };
+      minDaysLeft = mkOption {
+        description = ''
+          Alert when the CRL expires in fewer days than this. nginx rejects
+          every client certificate once it has, until `doomctl ca crl`
+          regenerates it and the hosts are deployed.
+        '';
+        type = types.ints.positive;
+        default = 30;
+      };
+    };
+
+    doomlab.nginx.adminNetworks = mkOption {
+      description = ''
+        Networks trusted to reach admin UIs: loopback, the LAN and the
+        tailnet. On IPv6 the LAN is its unique local and link-local ranges;
+        global addresses are reachable from outside and never trusted.
+      '';
+      type = types.listOf types.str;
+      default = ["127.0.0.1" "::1" "10.0.0.0/8" "fc00::/7" "fe80::/10" "100.64.0.0/10" "fd7a:115c:a1e0::/48"];
+      readOnly = true;
+    };
+  };
+
+  imports = [
+    ./_alerts.nix
+  ];
+
+  config = {
+    assertions =
+      mapAttrsToList (name: vhost: {
+        assertion = vhost.requireClientCert -> cfg.clientCa.enable;
+        message = "doomlab.nginx.hardening.${name}.requireClientCert needs a client CA; run `doomctl ca init`";
+      })
+      hardened
+      ++ concatLists (mapAttrsToList (name: vhost:
+        mapAttrsToList (path: location: {
+          assertion = securityHeaders vhost == "" || !hasInfix "add_header" location.extraConfig || hasInfix "include ${vhost.headersSnippet};" location.extraConfig;
+          message = "services.nginx.virtualHosts.${name}.locations.\"${path}\" sets add_header, which drops the security headers; include doomlab.nginx.hardening.${name}.headersSnippet there";
+        })
+        (config.services.nginx.virtualHosts.${name}.locations or {}))
+      hardened);
+
+    services.nginx = {
+      enable = true;
+      recommendedTlsSettings = true;
+      recommendedOptimisation = true;
+      recommendedGzipSettings = true;
+
+      commonHttpConfig = mkIf (hardened != {}) ''
+        map $http_user_agent $doomlab_bad_bot {
+          default 0;
+          "~*(${concatStringsSep "|" badBots})" 1;
+        }
+
+        limit_req_status 429;
+        ${concatStrings (flatten (mapAttrsToList (name: vhost:
+          mapAttrsToList (path: limit: ''
+            limit_req_zone $binary_remote_addr zone=${zoneName name path}:10m rate=${limit.rate};
+          '')
+          (rateLimitsOf vhost))
+        hardened))}
+      '';
+
+      virtualHosts =
+        mapAttrs (name: vhost: {
+          extraConfig = concatStringsSep "\n" (
+            optional (securityHeaders vhost != "") "include ${vhost.headersSnippet};"
+            ++ optional (vhost.maxBodySize != null) "client_max_body_size ${vhost.maxBodySize};"
+            ++ optionals (vhost.allow != []) (map (network: "allow ${network};") vhost.allow ++ ["deny all;"])
+            ++ optionals vhost.requireClientCert [
+              "ssl_client_certificate ${cfg.clientCa.dir + "/ca.crt"};"
+              "ssl_crl ${crl};"
+              "ssl_verify_client on;"
+            ]
+            ++ optional (vhost.rateLimit != null) (limitReq name "" vhost.rateLimit)
+            ++ optional vhost.blockBots ''
+              if ($doomlab_bad_bot) {
+                return 403;
+              }
+            ''
+          );
+
+          locations =
+            mapAttrs (path: limit: {
+              extraConfig = limitReq name path limit;
+            })
+            vhost.locationRateLimits;
+        })
+        hardened;
+    };
+
+    systemd.services."client-crl-expiry" = mkIf mutualTls {
+      description = "Check the client CA's CRL is not about to expire";
+      onFailure = ["alert@%n.service"];
+      path = [pkgs.openssl];
+      script = ''
+        next="$(openssl crl -in ${crl} -noout -nextupdate | cut -d= -f2)"
+        if [ "$(date -d "$next" +%s)" -lt "$(date -d "+${toString cfg.clientCa.minDaysLeft} days" +%s)" ]; then
+          echo "client CA CRL expires $next; run \`doomctl ca crl\` and deploy"
+          exit 1
+        fi
+      '';
+      serviceConfig = {
+        Type = "oneshot";
+      };
+    };
+
+    systemd.timers."client-crl-expiry" = mkIf mutualTls {
+      description = "Check the client CA's CRL is not about to expire";
+      wantedBy = ["timers.target"];
+      timerConfig = {
+        OnCalendar = "daily";
+        RandomizedDelaySec = "1h";
+      };
+    };
+
+    # Ban clients that keep tripping rate limits or getting refused
+    services.fail2ban = mkIf (hardened != {}) {
+      enable = true;
+      bantime = "1h";
+      jails = {
+        nginx-limit-req.settings = {
+          enabled = true;
+          filter = "nginx-limit-req";
+          backend = "systemd";
+          journalmatch = "_SYSTEMD_UNIT=nginx.service";
+          maxretry = 10;
+          findtime = 60;
+        };
+
+        nginx-forbidden = {
+          filter.Definition = {
+            failregex = ''^<HOST> -[^"]*"[^"]*" 403 '';
+            ignoreregex = "";
+          };
+          settings = {
+            enabled = true;
+            filter = "nginx-forbidden";
+            logpath = "/var/log/nginx/access.log";
+            backend = "auto";
+            maxretry = 20;
+            findtime = 600;
+          };
+        };
+      };
+    };
   };
 }
@@ -0,0 +1,119 @@
+{
+  config,
+  lib,
+  ...
+}:
+# Each module in services/ describes what it runs here so doomctl can report
+# on the fleet, check for conflicts and move services between hosts without
+# re-reading every module.
+with lib; let
+  services = attrValues config.doomlab.services;
+  local = unique (concatMap (s: s.ports.local) services);
+  tailnet = unique (concatMap (s: s.ports.tailnet) services);
+
+  # Inserted at the top of nixos-fw, above anything that opens the port, so
+  # an app's own openFirewall cannot expose it. Later inserts land first.
+  localRules = action: suffix:
+    concatMapStrings (port: ''
+      ip46tables -${action} nixos-fw -p tcp --dport ${toString port} ! -i lo -j nixos-fw-refuse${suffix}
+    '')
+    local
+    + concatMapStrings (port: ''
+      ip46tables -${action} nixos-fw -p tcp --dport ${toString port} -i tailscale0 -j nixos-fw-accept${suffix}
+    '')
+    tailnet;
+in {
+  options = {
+    doomlab.services = mkOption {
+      description = "Services this host runs, as declared by the modules in services/";
+      default = {};
+      type = types.attrsOf (types.submodule {
+        options = {
+          description = mkOption {
+            description = "What the service is";
+            type = types.str;
+          };
+          units = mkOption {
+            description = "systemd units that make up the service, stopped while it is migrated";
+            type = types.listOf types.str;
+            default = [];
+          };
+          ports = {
+            tcp = mkOption {
+              description = "TCP ports the service listens on";
+              type = types.listOf types.port;
+              default = [];
+            };
+            udp = mkOption {
+              description = "UDP ports the service listens on";
+              type = types.listOf types.port;
+              default = [];
+            };
+            shared = mkOption {
+              description = ''
+                Ports the service binds with SO_REUSEPORT alongside other
+                services, such as mDNS on 5353. Only ports every claimant
+                marks as shared pass the conflict check in lib/conflicts.nix.
+              '';
+              type = types.listOf types.port;
+              default = [];
+            };
+            local = mkOption {
+              description = ''
+                TCP ports only nginx and tunnels on this host talk to. The
+                module binds them to loopback where the app allows it; either
+                way the firewall refuses them from other hosts, even when the
+                app opens them itself.
+              '';
+              type = types.listOf types.port;
+              default = [];
+            };
+            tailnet = mkOption {
+              description = ''
+                Local ports that connectors on other hosts still reach over
+                the tailnet, such as a replica tunnel's origin.
+              '';
+              type = types.listOf types.port;
+              default = [];
+            };
+          };
+          hostNetwork = mkOption {
+            description = "Whether the service runs in a container sharing the host's network namespace";
+            type = types.bool;
+            default = false;
+          };
+          persist = mkOption {
+            description = "State directories under /nix/persist that belong to the service";
+            type = types.listOf types.str;
+            default = [];
+          };
+          backups = mkOption {
+            description = "Paths the service's backup-<name> job snapshots with Kopia";
+            type = types.listOf types.str;
+            default = [];
+          };
+        };
+      });
+    };
+  };
+
+  config = mkIf (local != []) {
+    assertions =
+      mapAttrsToList (name: s: {
+        assertion = all (p: elem p s.ports.tcp) s.ports.local && all (p: elem p s.ports.local) s.ports.tailnet;
+        message = "doomlab.services.${name}: local ports must be among its tcp ports, and tailnet ports among its local ones";
+      })
+      config.doomlab.services
+      ++ [
+        {
+          assertion = !config.networking.nftables.enable;
+          message = "doomlab.services: refusing local ports needs the iptables firewall";
+        }
+      ];
+
+    networking.firewall = {
+      extraCommands = localRules "I" "";
+      extraStopCommands = localRules "D" " || true";
+    };
+  };
+}
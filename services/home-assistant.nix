@@ -0,0 +1,178 @@
+{
+  config,
+  pkgs,
+  lib,
+  ...
+}:
+# Home Assistant from nixpkgs rather than a container, so its integrations and
+# their Python dependencies are pinned with the rest of the system. It sits
+# next to Homebridge and Scrypted on the home automation host.
+with lib; let
+  cfg = config.doomlab.homeAssistant;
+  hass = config.services.home-assistant;
+  # sops leaves the top-level keys readable, so whether the secret has been
+  # added can be seen without decrypting
+  hasSecret = hasInfix "\nhome-assistant-secrets:" ("\n" + readFile ./../secrets/secrets.yaml);
+in {
+  imports = [
+    ./_acme.nix
+    ./_nginx.nix
+    ./_registry.nix
+  ];
+
+  options.doomlab.homeAssistant = {
+    domain = mkOption {
+      description = "Virtual host Home Assistant is served on";
+      type = types.str;
+      default = "ha.orther.dev";
+    };
+    secretsFile = mkOption {
+      description = ''
+        YAML file of the values the configuration refers to with
+        `!secret <name>`, linked to secrets.yaml in the config directory.
+        Defaults to the `home-assistant-secrets` sops secret once it exists;
+        without one the home's location is set during onboarding instead.
+      '';
+      type = types.nullOr types.str;
+      default =
+        if hasSecret
+        then config.sops.secrets."home-assistant-secrets".path
+        else null;
+      defaultText = literalExpression ''config.sops.secrets."home-assistant-secrets".path or null'';
+    };
+  };
+
+  config = {
+    warnings = optional (cfg.secretsFile == null) ''
+      Home Assistant on ${config.networking.hostName} has no secrets file, so
+      its location comes from onboarding. Add home-assistant-secrets to
+      secrets/secrets.yaml to declare it.
+    '';
+
+    doomlab.services.home-assistant = {
+      description = "Home Assistant home automation";
+      units = ["home-assistant.service"];
+      ports = {
+        tcp = [hass.config.http.server_port];
+        # zeroconf discovery, next to Homebridge's and Scrypted's responders
+        udp = [5353];
+        shared = [5353];
+        local = [hass.config.http.server_port];
+      };
+      hostNetwork = true;
+      persist = [hass.configDir];
+      backups = [hass.configDir];
+    };
+
+    doomlab.resources.classes.interactive.units = ["home-assistant.service"];
+
+    services.home-assistant = {
+      enable = true;
+      # Integrations set up in the UI need their component listed here to
+      # have its dependencies installed
+      extraComponents = [
+        "default_config"
+        "met"
+        "esphome"
+        # pairs with Homebridge's and Scrypted's bridges
+        "homekit_controller"
+      ];
+      config = {
+        default_config = {};
+        homeassistant =
+          {
+            name = "Home";
+            unit_system = "us_customary";
+            time_zone = config.time.timeZone;
+          }
+          // optionalAttrs (cfg.secretsFile != null) {
+            latitude = "!secret latitude";
+            longitude = "!secret longitude";
+            elevation = "!secret elevation";
+          };
+        # Only nginx talks to it, and its X-Forwarded-For is trusted
+        http = {
+          server_host = ["127.0.0.1" "::1"];
+          server_port = 8123;
+          use_x_forwarded_for = true;
+          trusted_proxies = ["127.0.0.1" "::1"];
+        };
+        # Keep what is configured in the UI alongside the declared config
+        "automation ui" = "!include automations.yaml";
+        "scene ui" = "!include scenes.yaml";
+        "script ui" = "!include scripts.yaml";
+      };
+    };
+
+    sops.secrets."home-assistant-secrets" = mkIf hasSecret {
+      owner = "hass";
+      restartUnits = ["home-assistant.service"];
+    };
+
+    doomlab.acme.vhosts.${cfg.domain} = "public";
+
+    doomlab.nginx.hardening.${cfg.domain} = {
+      allow = config.doomlab.nginx.adminNetworks;
+      requireClientCert = config.doomlab.nginx.clientCa.enable;
+      # Restoring a backup uploads the whole archive
+      maxBodySize = "1g";
+    };
+
+    services.nginx.virtualHosts.${cfg.domain} = {
+      locations."/" = {
+        recommendedProxySettings = true;
+        proxyWebsockets = true;
+        proxyPass = "http://127.0.0.1:${toString hass.config.http.server_port}";
+      };
+    };
+
+    sops.secrets."kopia-repository-token" = {};
+
+    systemd = {
+      tmpfiles.rules =
+        optional (cfg.secretsFile != null) "L+ ${hass.configDir}/secrets.yaml - - - - ${cfg.secretsFile}"
+        ++ [
+          # included above, and only written once something is created in the UI
+          "f ${hass.configDir}/automations.yaml 0644 hass hass - []"
+          "f ${hass.configDir}/scenes.yaml 0644 hass hass - []"
+          "f ${hass.configDir}/scripts.yaml 0644 hass hass - {}"
+        ];
+
+      services = {
+        "backup-home-assistant" = {
+          description = "Backup Home Assistant configuration with Kopia";
+          wantedBy = ["default.target"];
+          # warning: following line is needed to prevent race condition with homebridge.nix and scrypted.nix
+          after = ["backup-homebridge.service" "backup-scrypted.service"];
+          serviceConfig = {
+            User = "root";
+            ExecStartPre = "${pkgs.kopia}/bin/kopia repository connect from-config --token-file ${config.sops.secrets."kopia-repository-token".path}";
+            ExecStart = "${pkgs.kopia}/bin/kopia snapshot create ${hass.configDir}";
+            ExecStartPost = "${pkgs.kopia}/bin/kopia repository disconnect";
+          };
+        };
+      };
+
+      timers = {
+        "backup-home-assistant" = {
+          description = "Backup Home Assistant configuration with Kopia";
+          wantedBy = ["timers.target"];
+          timerConfig = {
+            OnCalendar = "*-*-* 4:00:00";
+            RandomizedDelaySec = "1h";
+          };
+        };
+      };
+    };
+
+    environment.persistence."/nix/persist" = {
+      directories = [
+        {
+          directory = hass.configDir;
+          user = "hass";
+          group = "hass";
+        }
+      ];
+    };
+  };
+}
@@ -6,9 +6,31 @@
 }: {
   imports = [
     ./_acme.nix
+    ./_mdns.nix
     ./_nginx.nix
+    ./_registry.nix
   ];
 
+  doomlab.services.homebridge = {
+    description = "Homebridge HomeKit bridge";
+    units = ["podman-homebridge.service"];
+    ports = {
+      tcp = [8581 50000 50001 50002] ++ lib.range 50100 50200;
+      udp = [5353];
+      shared = [5353];
+      # the UI's bind address is in the config.json Homebridge manages itself
+      local = [8581];
+    };
+    hostNetwork = true;
+    persist = ["/var/lib/homebridge"];
+    backups = ["/var/lib/homebridge"];
+  };
+
+  doomlab.resources.classes.interactive.units = ["podman-homebridge.service"];
+
+  # Bridges and child bridges are HomeKit accessories
+  doomlab.mdns.services = ["_hap._tcp"];
+
   # Initially generated using compose2nix v0.1.9.
   # inspo: https://github.com/homebridge/homebridge/wiki/Install-Homebridge-on-Docker
   # inspo: https://lmy.medium.com/from-ansible-to-nixos-3a117b140bec
@@ -51,17 +73,25 @@
           "--log-opt=max-file=1"
           "--log-opt=max-size=10mb"
           "--network=host"
-          "--dns=1.1.1.1,1.0.0.1" # without this, host DNS points to tailscale which doesn't work in container
+          "--cgroups=split" # run in the unit's cgroup, so its resource class applies
+          "--dns=1.1.1.1,1.0.0.1,2606:4700:4700::1111,2606:4700:4700::1001" # without this, host DNS points to tailscale which doesn't work in container
         ];
       };
     };
   };
 
+  doomlab.acme.vhosts."home.orther.dev" = "public";
+
+  doomlab.nginx.hardening."home.orther.dev" = {
+    allow = config.doomlab.nginx.adminNetworks;
+    requireClientCert = config.doomlab.nginx.clientCa.enable;
+    # Restoring a Homebridge backup uploads the whole archive
+    maxBodySize = "64m";
+  };
+
   services.nginx = {
     virtualHosts = {
       "home.orther.dev" = {
-        forceSSL = true;
-        useACMEHost = "orther.dev";
         locations."/" = {
           recommendedProxySettings = true;
           proxyPass = "http://127.0.0.1:8581";
@@ -0,0 +1,174 @@
+{
+  config,
+  pkgs,
+  lib,
+  ...
+}:
+# Immich for photos, next to Nextcloud so it can index what phones already
+# upload there. The NixOS module brings PostgreSQL with pgvecto.rs (24.11 has
+# no VectorChord yet) and a Redis of its own.
+with lib; let
+  cfg = config.doomlab.immich;
+  immich = config.services.immich;
+
+  # Originals and Immich's own database dumps; thumbnails and transcodes are
+  # regenerated from them
+  backupDirs = map (d: "${immich.mediaLocation}/${d}") ["backups" "library" "profile" "upload"];
+in {
+  imports = [
+    ./_acme.nix
+    ./_nginx.nix
+    ./_registry.nix
+  ];
+
+  options.doomlab.immich = {
+    domain = mkOption {
+      description = "Virtual host Immich is served on";
+      type = types.str;
+      default = "photos.orther.dev";
+    };
+    externalLibraries = mkOption {
+      description = ''
+        Directories Immich may index as external libraries, mounted read-only
+        into it. Add each one under Administration > External Libraries.
+      '';
+      type = types.listOf types.str;
+      default = optional config.services.nextcloud.enable "${config.services.nextcloud.datadir}/data";
+      defaultText = literalExpression ''optional config.services.nextcloud.enable "''${config.services.nextcloud.datadir}/data"'';
+      example = ["/fun/media/photos"];
+    };
+  };
+
+  config = {
+    doomlab.services.immich = {
+      description = "Immich photo library";
+      units = [
+        "immich-server.service"
+        "immich-machine-learning.service"
+        "redis-immich.service"
+        "postgresql.service"
+      ];
+      ports = {
+        tcp = [immich.port];
+        local = [immich.port];
+      };
+      persist = ["/var/cache/immich" "/var/lib/postgresql"];
+      backups = backupDirs;
+    };
+
+    doomlab.resources.classes = {
+      interactive.units = ["immich-server.service" "redis-immich.service"];
+      # face and object recognition of new uploads can wait
+      background.units = ["immich-machine-learning.service"];
+    };
+
+    services.immich = {
+      enable = true;
+      host = "127.0.0.1";
+      port = 2283;
+      # the data disk, not the NVMe
+      mediaLocation = mkDefault "/fun/immich";
+      # No GPU: video transcoding and machine learning run on the CPU
+      accelerationDevices = [];
+      machine-learning.environment = {
+        MACHINE_LEARNING_WORKERS = "1";
+        MACHINE_LEARNING_REQUEST_THREADS = "2";
+        # unload models between batches instead of holding gigabytes
+        MACHINE_LEARNING_MODEL_TTL = "300";
+      };
+      settings = {
+        server.externalDomain = "https://${cfg.domain}";
+        newVersionCheck.enabled = false;
+        ffmpeg = {
+          accel = "disabled";
+          # only transcode what browsers cannot play
+          transcode = "required";
+        };
+        job = {
+          thumbnailGeneration.concurrency = 2;
+          videoConversion.concurrency = 1;
+          smartSearch.concurrency = 1;
+          faceDetection.concurrency = 1;
+        };
+        library = {
+          scan = {
+            enabled = true;
+            cronExpression = "0 3 * * *";
+          };
+          watch.enabled = false;
+        };
+      };
+    };
+
+    # Read access through the nextcloud group; the bind keeps it read-only
+    # even where the group may write
+    users.users.immich.extraGroups = optional config.services.nextcloud.enable "nextcloud";
+    systemd.services.immich-server.serviceConfig.BindReadOnlyPaths = cfg.externalLibraries;
+
+    systemd.tmpfiles.rules = ["d ${immich.mediaLocation} 0750 immich immich"];
+
+    doomlab.acme.vhosts.${cfg.domain} = "public";
+
+    # The mobile apps upload whole videos and cannot present a client
+    # certificate, so the library is for the LAN and tailnet without one
+    doomlab.nginx.hardening.${cfg.domain} = {
+      allow = config.doomlab.nginx.adminNetworks;
+      maxBodySize = "50000m";
+      rateLimit = {
+        rate = "50r/s";
+        burst = 200;
+      };
+    };
+
+    services.nginx.virtualHosts.${cfg.domain}.locations."/" = {
+      recommendedProxySettings = true;
+      proxyWebsockets = true;
+      proxyPass = "http://127.0.0.1:${toString immich.port}";
+      extraConfig = ''
+        proxy_read_timeout 600s;
+        proxy_send_timeout 600s;
+      '';
+    };
+
+    sops.secrets."kopia-repository-token" = {};
+
+    systemd = {
+      services = {
+        "backup-immich" = {
+          description = "Backup Immich photos and database dumps with Kopia";
+          wantedBy = ["default.target"];
+          # warning: following line is needed to prevent race condition with nextcloud.nix
+          after = ["backup-nextcloud.service"];
+          serviceConfig = {
+            User = "root";
+            ExecStartPre = "${pkgs.kopia}/bin/kopia repository connect from-config --token-file ${config.sops.secrets."kopia-repository-token".path}";
+            ExecStart = "${pkgs.kopia}/bin/kopia snapshot create ${escapeShellArgs backupDirs}";
+            ExecStartPost = "${pkgs.kopia}/bin/kopia repository disconnect";
+          };
+        };
+      };
+
+      timers = {
+        "backup-immich" = {
+          description = "Backup Immich photos and database dumps with Kopia";
+          wantedBy = ["timers.target"];
+          timerConfig = {
+            # after Immich's own database dump at 02:00
+            OnCalendar = "*-*-* 4:00:00";
+            RandomizedDelaySec = "1h";
+          };
+        };
+      };
+    };
+
+    environment.persistence."/nix/persist" = {
+      directories = [
+        {
+          directory = "/var/cache/immich";
+          user = "immich";
+          group = "immich";
+        }
+      ];
+    };
+  };
+}
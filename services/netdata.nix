@@ -3,6 +3,17 @@
   pkgs,
   ...
 }: {
+  imports = [
+    ./_registry.nix
+  ];
+
+  doomlab.services.netdata = {
+    description = "Netdata monitoring agent";
+    units = ["netdata.service"];
+    ports.tcp = [19999];
+    persist = ["/var/lib/netdata"];
+  };
+
   sops.secrets."netdata-token" = {};
 
   services.netdata = {
@@ -7,8 +7,33 @@
   imports = [
     ./_acme.nix
     ./_nginx.nix
+    ./_registry.nix
   ];
 
+  doomlab.services.nextcloud = {
+    description = "Nextcloud file sync and sharing";
+    units = [
+      "phpfpm-nextcloud.service"
+      "nextcloud-cron.timer"
+      "redis-nextcloud.service"
+      "postgresql.service"
+    ];
+    persist = [
+      "/var/lib/nextcloud"
+      "/var/lib/postgresql"
+    ];
+    backups = ["/fun/nextcloud"];
+  };
+
+  # Background jobs, preview generation among them, run from the cron unit
+  doomlab.resources.classes = {
+    interactive.units = [
+      "phpfpm-nextcloud.service"
+      "redis-nextcloud.service"
+    ];
+    background.units = ["nextcloud-cron.service"];
+  };
+
   sops.secrets.nextcloud-adminpassfile = {
     owner = "nextcloud";
     group = "nextcloud";
@@ -58,14 +83,19 @@
         ];
       };
     };
+  };
 
-    nginx = {
-      virtualHosts = {
-        "${config.services.nextcloud.hostName}" = {
-          forceSSL = true;
-          useACMEHost = "orther.dev";
-        };
-      };
+  doomlab.acme.vhosts.${config.services.nextcloud.hostName} = "public";
+
+  # The nextcloud module already sends security headers and sets
+  # client_max_body_size from maxUploadSize, so only rate limits are added.
+  # Desktop and mobile sync clients are chatty.
+  doomlab.nginx.hardening.${config.services.nextcloud.hostName} = {
+    headers = false;
+    maxBodySize = null;
+    rateLimit = {
+      rate = "50r/s";
+      burst = 200;
     };
   };
 
@@ -105,7 +135,6 @@
   environment.persistence."/nix/persist" = {
     directories = [
       "/var/lib/nextcloud"
-      "/var/lib/postgresql"
     ];
   };
 }
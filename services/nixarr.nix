@@ -7,8 +7,40 @@
     ./_acme.nix
     ./_nginx.nix
     ./_cloudflared.nix
+    ./_registry.nix
   ];
 
+  doomlab.services.nixarr = {
+    description = "Jellyfin, the *arr apps and Transmission";
+    units = [
+      "jellyfin.service"
+      "prowlarr.service"
+      "radarr.service"
+      "sonarr.service"
+      "transmission.service"
+    ];
+    ports = {
+      tcp = [8096 9696 7878 8989 9091 46634];
+      udp = [46634];
+      # only the peer port is for other hosts
+      local = [8096 9696 7878 8989 9091];
+      # the replica tunnel on noir sends watch.orther.dev here
+      tailnet = [8096];
+    };
+    persist = ["/var/lib/nixarr"];
+  };
+
+  # Streaming is what people notice; the rest can wait
+  doomlab.resources.classes = {
+    interactive.units = ["jellyfin.service"];
+    background.units = [
+      "prowlarr.service"
+      "radarr.service"
+      "sonarr.service"
+      "transmission.service"
+    ];
+  };
+
   # temp
   # inspo: https://discourse.nixos.org/t/solved-sonarr-is-broken-in-24-11-unstable-aka-how-the-hell-do-i-use-nixpkgs-config-permittedinsecurepackages/56828/2
   nixpkgs.config.permittedInsecurePackages = [
@@ -48,6 +80,7 @@
         incomplete-dir-enabled = false;
         speed-limit-up = 500;
         speed-limit-up-enabled = true;
+        rpc-bind-address = "127.0.0.1";
         rpc-authentication-required = true;
         rpc-username = "orther";
         rpc-whitelist-enabled = false;
@@ -87,11 +120,40 @@
   ##  wireguard-tools
   ##];
 
+  # Jellyfin is reachable from outside through whichever tunnels the host runs
+  doomlab.cloudflared.public."watch.orther.dev".service = "http://localhost:8096";
+
+  doomlab.acme.vhosts = {
+    "watch.orther.dev" = "public";
+    "prowlarr.orther.dev" = "public";
+    "radarr.orther.dev" = "public";
+    "sonarr.orther.dev" = "public";
+    "transmission.orther.dev" = "public";
+  };
+
+  doomlab.nginx.hardening = let
+    admin = {
+      allow = config.doomlab.nginx.adminNetworks;
+      requireClientCert = config.doomlab.nginx.clientCa.enable;
+    };
+  in {
+    # Clients fetch artwork and segments in bursts while browsing and streaming
+    "watch.orther.dev" = {
+      rateLimit = {
+        rate = "50r/s";
+        burst = 200;
+      };
+      maxBodySize = "20m";
+    };
+    "prowlarr.orther.dev" = admin;
+    "radarr.orther.dev" = admin;
+    "sonarr.orther.dev" = admin;
+    "transmission.orther.dev" = admin;
+  };
+
   services.nginx = {
     virtualHosts = {
       "watch.orther.dev" = {
-        forceSSL = true;
-        useACMEHost = "orther.dev";
         locations."/" = {
           recommendedProxySettings = true;
           proxyPass = "http://127.0.0.1:8096";
@@ -99,8 +161,6 @@
       };
 
       "prowlarr.orther.dev" = {
-        forceSSL = true;
-        useACMEHost = "orther.dev";
         locations."/" = {
           recommendedProxySettings = true;
           proxyPass = "http://127.0.0.1:9696";
@@ -108,8 +168,6 @@
       };
 
       "radarr.orther.dev" = {
-        forceSSL = true;
-        useACMEHost = "orther.dev";
         locations."/" = {
           recommendedProxySettings = true;
           proxyPass = "http://127.0.0.1:7878";
@@ -117,8 +175,6 @@
       };
 
       "sonarr.orther.dev" = {
-        forceSSL = true;
-        useACMEHost = "orther.dev";
         locations."/" = {
           recommendedProxySettings = true;
           proxyPass = "http://127.0.0.1:8989";
@@ -126,8 +182,6 @@
       };
 
       "transmission.orther.dev" = {
-        forceSSL = true;
-        useACMEHost = "orther.dev";
         locations."/" = {
           proxyPass = "http://127.0.0.1:9091";
         };
@@ -138,6 +192,14 @@
   systemd = {
     tmpfiles.rules = ["d /var/lib/nixarr 0755 root root"];
 
+    # Servarr apps read config.xml overrides from the environment. Jellyfin
+    # has no such switch and is kept off the network by the firewall.
+    services = {
+      prowlarr.environment.PROWLARR__SERVER__BINDADDRESS = "127.0.0.1";
+      radarr.environment.RADARR__SERVER__BINDADDRESS = "127.0.0.1";
+      sonarr.environment.SONARR__SERVER__BINDADDRESS = "127.0.0.1";
+    };
+
     ## TODO: enable backing up Nixarr
     ##services = {
     ##  "backup-nixarr" = {
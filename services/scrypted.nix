@@ -3,144 +3,380 @@
   pkgs,
   lib,
   ...
-}: {
+}:
+with lib; let
+  cfg = config.doomlab.scrypted;
+  net = import ./../lib/net.nix {inherit lib;};
+  links = with config.doomlab.network; interfaces // vlans // bridges // bonds;
+
+  # Only trust the camera network where it is attached, so a spoofed source
+  # address on the LAN does not get through. HomeKit accessories mostly talk
+  # IPv6 link-local, which is only trusted on that link.
+  sources =
+    [cfg.cameras.network]
+    ++ optional (cfg.cameras.network6 != null) cfg.cameras.network6
+    ++ optional (cfg.cameras.interface != null) "fe80::/10";
+  iptables = source:
+    if net.isIPv6 source
+    then "ip6tables"
+    else "iptables";
+  onInterface = optionalString (cfg.cameras.interface != null) "-i ${cfg.cameras.interface} ";
+  cameraRules = action: suffix:
+    concatMapStrings (source:
+      concatMapStrings (proto: "${iptables source} -${action} nixos-fw -p ${proto} ${onInterface}--source ${source} -j nixos-fw-accept${suffix}\n")
+      ["tcp" "udp"])
+    sources;
+
+  # Recordings get a disk of their own: never the tmpfs root, the store or
+  # the persisted state Kopia snapshots every night
+  recordings = cfg.recordings.path;
+  mountOf = path: let
+    mounts = mapAttrsToList (_: fs: fs.mountPoint) config.fileSystems;
+    containing = filter (m: m == "/" || m == path || hasPrefix "${m}/" path) mounts;
+  in
+    last (sort (a: b: stringLength a < stringLength b) containing);
+  unsafeMounts = ["/" "/boot" "/nix" "/nix/persist"];
+  # the oldest recordings go while less than minFreePercent is free
+  maxUsedPercent = toString (100 - cfg.recordings.minFreePercent);
+  # only recordings, never the NVR's index and metadata next to them
+  isRecording = "\\( ${concatMapStringsSep " -o " (p: "-name ${escapeShellArg p}") cfg.recordings.patterns} \\)";
+
+  # Cloudflare tunnel connectors reach Scrypted through nginx on this port,
+  # this host's own on loopback and replicas over the tailnet
+  tunnelPort = 10444;
+in {
   imports = [
     ./_acme.nix
+    ./_cloudflared.nix
+    ./_mdns.nix
     ./_nginx.nix
+    ./_registry.nix
   ];
 
-  # Initially generated using compose2nix v0.1.9.
-  # Based off of https://github.com/koush/scrypted/blob/main/install/docker/docker-compose.yml
-
-  networking.firewall = {
-    # Homekit requires random port to connect with accessories. It is easier to
-    # whitelist an entire trusted network rather than tediously open ports for
-    # each camera.
-
-    # inspo: https://discourse.nixos.org/t/open-firewall-ports-only-towards-local-network/13037/2
-    extraCommands = ''
-      iptables -A nixos-fw -p tcp --source 10.0.10.0/24 -j nixos-fw-accept
-      iptables -A nixos-fw -p udp --source 10.0.10.0/24 -j nixos-fw-accept
-    '';
-    extraStopCommands = ''
-      iptables -D nixos-fw -p tcp --source 10.0.10.0/24 -j nixos-fw-accept || true
-      iptables -D nixos-fw -p udp --source 10.0.10.0/24 -j nixos-fw-accept || true
-    '';
+  options.doomlab.scrypted.recordings = {
+    path = mkOption {
+      description = ''
+        Where the NVR plugin keeps recordings, on a NAS share or data disk
+        mounted through fileSystems. Unset, they stay in /var/lib/scrypted
+        with the plugin state and end up in its nightly backup.
+      '';
+      type = types.nullOr types.str;
+      default = null;
+      example = "/mnt/nvr";
+    };
+    retentionDays = mkOption {
+      description = ''
+        Recordings older than this are deleted. Keep it above the retention
+        set in the NVR plugin, which should normally do the pruning.
+      '';
+      type = types.ints.positive;
+      default = 30;
+    };
+    minFreePercent = mkOption {
+      description = "Oldest recordings are deleted while the recordings filesystem has less free space than this";
+      type = types.ints.between 1 90;
+      default = 10;
+    };
+    patterns = mkOption {
+      description = ''
+        File name patterns of recording segments. Only these are ever
+        deleted; the NVR's index and metadata files stay.
+      '';
+      type = types.nonEmptyListOf types.str;
+      default = ["*.mp4" "*.m4s"];
+    };
   };
 
-  virtualisation.podman = {
-    enable = true;
-    autoPrune.enable = true;
-    dockerCompat = true;
-    defaultNetwork.settings = {
-      # Required for container networking to be able to use names.
-      dns_enabled = true;
+  options.doomlab.scrypted.cameras = {
+    network = mkOption {
+      description = "Subnet the cameras and HomeKit accessories are on, trusted on every port";
+      type = types.str;
+      default = "10.0.10.0/24";
+    };
+    network6 = mkOption {
+      description = "IPv6 prefix of the camera network, if it has one";
+      type = types.nullOr types.str;
+      default = null;
+      example = "fd00:10::/64";
+    };
+    interface = mkOption {
+      description = ''
+        doomlab.network link on the camera network, usually a VLAN. When set,
+        the camera network is only trusted on this link.
+      '';
+      type = types.nullOr types.str;
+      default = null;
+      example = "cameras";
     };
   };
 
-  virtualisation.oci-containers = {
-    backend = "podman";
-    containers = {
-      "scrypted" = {
-        image = "ghcr.io/koush/scrypted";
-        environment = {
-          SCRYPTED_DOCKER_AVAHI = "true";
-        };
-        volumes = [
-          "/var/lib/scrypted:/server/volume:rw"
-        ];
-        labels = {
-          "io.containers.autoupdate" = "registry";
-        };
-        log-driver = "journald";
-        extraOptions = [
-          "--log-opt=max-file=10"
-          "--log-opt=max-size=10m"
-          "--network=host"
-          "--security-opt=apparmor:unconfined"
-          "--dns=1.1.1.1,1.0.0.1" # without this, host DNS points to tailscale which doesn't work in container
-        ];
+  config = {
+    assertions =
+      optionals (recordings != null) [
+        {
+          assertion = !elem (mountOf recordings) unsafeMounts;
+          message = "doomlab.scrypted.recordings.path must be on a NAS share or data disk in fileSystems, not on ${mountOf recordings}";
+        }
+        {
+          assertion = recordings != "/var/lib/scrypted" && !hasPrefix "/var/lib/scrypted/" recordings;
+          message = "doomlab.scrypted.recordings.path must be outside /var/lib/scrypted, which is backed up";
+        }
+      ]
+      ++ optional (cfg.cameras.interface != null) {
+      assertion = let
+        link = links.${cfg.cameras.interface};
+      in
+        links
+        ? ${cfg.cameras.interface}
+        && (link.dhcp
+          || cfg.cameras.network6 != null && link.ipv6 != "static"
+          || any (a: net.contains cfg.cameras.network a || cfg.cameras.network6 != null && net.contains cfg.cameras.network6 a) link.addresses);
+      message = "doomlab.scrypted.cameras.interface must be a doomlab.network link with an address on the camera network";
+    };
+
+    doomlab.resources.classes.background.units = optional (recordings != null) "scrypted-recordings-prune.service";
+
+    doomlab.services.scrypted = {
+      description = "Scrypted camera hub and NVR";
+      units = ["podman-scrypted.service"];
+      ports = {
+        tcp = [10443 11080];
+        udp = [5353];
+        shared = [5353];
+      };
+      hostNetwork = true;
+      persist = ["/var/lib/scrypted"];
+      backups = ["/var/lib/scrypted"];
+    };
+
+    doomlab.resources.classes.interactive.units = ["podman-scrypted.service"];
+
+    # Cameras exposed to HomeKit are accessories; reflect them off the camera
+    # network once doomlab.mdns.interfaces joins it to the LAN
+    doomlab.mdns.services = ["_hap._tcp"];
+
+    # Initially generated using compose2nix v0.1.9.
+    # Based off of https://github.com/koush/scrypted/blob/main/install/docker/docker-compose.yml
+
+    networking.firewall = {
+      # Homekit requires random port to connect with accessories. It is easier to
+      # whitelist an entire trusted network rather than tediously open ports for
+      # each camera.
+
+      # inspo: https://discourse.nixos.org/t/open-firewall-ports-only-towards-local-network/13037/2
+      extraCommands = cameraRules "A" "";
+      extraStopCommands = cameraRules "D" " || true";
+    };
+
+    virtualisation.podman = {
+      enable = true;
+      autoPrune.enable = true;
+      dockerCompat = true;
+      defaultNetwork.settings = {
+        # Required for container networking to be able to use names.
+        dns_enabled = true;
       };
     };
-  };
 
-  services.nginx = {
-    virtualHosts = {
-      "scrypted.orther.dev" = {
-        forceSSL = true;
-        useACMEHost = "orther.dev";
-        locations."/" = {
-          recommendedProxySettings = true;
-          proxyPass = "https://127.0.0.1:10443";
+    virtualisation.oci-containers = {
+      backend = "podman";
+      containers = {
+        "scrypted" = {
+          image = "ghcr.io/koush/scrypted";
+          environment =
+            {
+              SCRYPTED_DOCKER_AVAHI = "true";
+            }
+            // optionalAttrs (recordings != null) {
+              SCRYPTED_NVR_VOLUME = "/nvr";
+            };
+          volumes =
+            [
+              "/var/lib/scrypted:/server/volume:rw"
+            ]
+            ++ optional (recordings != null) "${recordings}:/nvr:rw";
+          labels = {
+            "io.containers.autoupdate" = "registry";
+          };
+          log-driver = "journald";
+          extraOptions = [
+            "--log-opt=max-file=10"
+            "--log-opt=max-size=10m"
+            "--network=host"
+            "--cgroups=split" # run in the unit's cgroup, so its resource class applies
+            "--security-opt=apparmor:unconfined"
+            "--dns=1.1.1.1,1.0.0.1,2606:4700:4700::1111,2606:4700:4700::1001" # without this, host DNS points to tailscale which doesn't work in container
+          ];
         };
       };
     };
-  };
 
-  systemd = {
-    tmpfiles.rules = ["d /var/lib/scrypted 0755 root root"];
+    # Published on the tunnels this host runs. nginx's certificate is for
+    # orther.dev, not the name the connector dials.
+    doomlab.cloudflared.public."scrypted.orther.dev" = {
+      service = "https://localhost:${toString tunnelPort}";
+      noTLSVerify = true;
+    };
+
+    doomlab.acme.vhosts."scrypted.orther.dev" = "public";
+
+    doomlab.nginx.hardening."scrypted.orther.dev" = {
+      allow = config.doomlab.nginx.adminNetworks;
+      requireClientCert = config.doomlab.nginx.clientCa.enable;
+      # Plugin uploads and camera snapshots
+      maxBodySize = "64m";
+    };
+
+    # Tunnel traffic keeps the rate limits, headers and bot blocking, but
+    # neither the allow-list nor client certificates can apply: Cloudflare
+    # terminates TLS and every request comes from a connector. Scrypted's own
+    # login guards it.
+    doomlab.acme.vhosts.scrypted-tunnel = "public";
+
+    doomlab.nginx.hardening.scrypted-tunnel.maxBodySize = "64m";
+
+    services.nginx = {
+      virtualHosts = {
+        "scrypted.orther.dev" = {
+          locations."/" = {
+            recommendedProxySettings = true;
+            proxyPass = "https://127.0.0.1:10443";
+          };
+        };
 
-    targets = {
-      "podman-compose-scrypted-root" = {
-        unitConfig = {
-          Description = "Root target generated by compose2nix.";
+        scrypted-tunnel = {
+          serverName = "localhost";
+          # rate limits and bans go by the visitor, not the connector
+          extraConfig = ''
+            real_ip_header CF-Connecting-IP;
+            ${concatMapStrings (network: "set_real_ip_from ${network};\n") ["127.0.0.1" "::1" "100.64.0.0/10" "fd7a:115c:a1e0::/48"]}
+          '';
+          forceSSL = mkForce false;
+          onlySSL = true;
+          listen = [
+            {
+              addr = "0.0.0.0";
+              port = tunnelPort;
+              ssl = true;
+            }
+            {
+              addr = "[::]";
+              port = tunnelPort;
+              ssl = true;
+            }
+          ];
+          locations."/" = {
+            recommendedProxySettings = true;
+            proxyPass = "https://127.0.0.1:10443";
+          };
         };
-        wantedBy = ["multi-user.target"];
       };
     };
 
-    services = {
-      "podman-scrypted" = {
-        serviceConfig = {
-          Restart = lib.mkOverride 500 "always";
+    networking.firewall.interfaces.tailscale0.allowedTCPPorts = [tunnelPort];
+
+    systemd = {
+      tmpfiles.rules = ["d /var/lib/scrypted 0755 root root"];
+
+      targets = {
+        "podman-compose-scrypted-root" = {
+          unitConfig = {
+            Description = "Root target generated by compose2nix.";
+          };
+          wantedBy = ["multi-user.target"];
         };
-        partOf = [
-          "podman-compose-scrypted-root.target"
-        ];
-        wantedBy = [
-          "podman-compose-scrypted-root.target"
-        ];
       };
 
-      "backup-scrypted" = {
-        description = "Backup Scrypted installation with Kopia";
-        wantedBy = ["default.target"];
-        # warning: following line is needed to prevent race condition with homebridge.nix
-        after = ["backup-homebridge.service"];
-        serviceConfig = {
-          User = "root";
-          ExecStartPre = "${pkgs.kopia}/bin/kopia repository connect from-config --token-file ${config.sops.secrets."kopia-repository-token".path}";
-          ExecStart = "${pkgs.kopia}/bin/kopia snapshot create /var/lib/scrypted";
-          ExecStartPost = "${pkgs.kopia}/bin/kopia repository disconnect";
+      services = {
+        "podman-scrypted" = {
+          serviceConfig = {
+            Restart = lib.mkOverride 500 "always";
+          };
+          # Without the share Scrypted would record into the empty mountpoint
+          unitConfig.RequiresMountsFor = optional (recordings != null) recordings;
+          preStart = mkIf (recordings != null) (mkBefore "mkdir -p ${recordings}");
+          partOf = [
+            "podman-compose-scrypted-root.target"
+          ];
+          wantedBy = [
+            "podman-compose-scrypted-root.target"
+          ];
         };
-      };
-    };
 
-    timers = {
-      "podman-auto-update" = {
-        wantedBy = ["timers.target"];
-        timerConfig = {
-          OnCalendar = "*-*-* 7:00:00";
-          RandomizedDelaySec = "1h";
+        "scrypted-recordings-prune" = mkIf (recordings != null) {
+          description = "Delete expired Scrypted recordings and keep their disk from filling";
+          # like Scrypted, only ever touch the mounted share
+          unitConfig.RequiresMountsFor = [recordings];
+          path = with pkgs; [coreutils findutils];
+          script = ''
+            dir=${escapeShellArg recordings}
+            max=${maxUsedPercent}
+            # -xdev and no symlinks followed: nothing outside the share
+            find "$dir" -xdev -type f ${isRecording} -mtime +${toString cfg.recordings.retentionDays} -delete
+            # folders that emptied, but not the top-level ones the NVR made
+            find "$dir" -xdev -mindepth 2 -type d -empty -delete
+
+            used() { df --output=pcent "$dir" | tail -n 1 | tr -dc 0-9; }
+            if [ "$(used)" -gt "$max" ]; then
+              echo "$dir is $(used)% full, deleting the oldest recordings"
+              find "$dir" -xdev -type f ${isRecording} -printf '%T@ %p\0' | sort -zn | while IFS= read -r -d "" entry; do
+                [ "$(used)" -gt "$max" ] || break
+                rm -f -- "''${entry#* }"
+              done
+            fi
+          '';
+          serviceConfig.Type = "oneshot";
+        };
+
+        "backup-scrypted" = {
+          description = "Backup Scrypted installation with Kopia";
+          wantedBy = ["default.target"];
+          # warning: following line is needed to prevent race condition with homebridge.nix
+          after = ["backup-homebridge.service"];
+          serviceConfig = {
+            User = "root";
+            ExecStartPre = "${pkgs.kopia}/bin/kopia repository connect from-config --token-file ${config.sops.secrets."kopia-repository-token".path}";
+            ExecStart = "${pkgs.kopia}/bin/kopia snapshot create /var/lib/scrypted";
+            ExecStartPost = "${pkgs.kopia}/bin/kopia repository disconnect";
+          };
         };
       };
 
-      "backup-scrypted" = {
-        description = "Backup Scrypted installation with Kopia";
-        wantedBy = ["timers.target"];
-        timerConfig = {
-          OnCalendar = "*-*-* 4:00:00";
-          RandomizedDelaySec = "1h";
+      timers = {
+        "podman-auto-update" = {
+          wantedBy = ["timers.target"];
+          timerConfig = {
+            OnCalendar = "*-*-* 7:00:00";
+            RandomizedDelaySec = "1h";
+          };
+        };
+
+        "scrypted-recordings-prune" = mkIf (recordings != null) {
+          description = "Delete expired Scrypted recordings and keep their disk from filling";
+          wantedBy = ["timers.target"];
+          timerConfig = {
+            OnCalendar = "hourly";
+            RandomizedDelaySec = "5m";
+          };
+        };
+
+        "backup-scrypted" = {
+          description = "Backup Scrypted installation with Kopia";
+          wantedBy = ["timers.target"];
+          timerConfig = {
+            OnCalendar = "*-*-* 4:00:00";
+            RandomizedDelaySec = "1h";
+          };
         };
       };
     };
-  };
 
-  environment.persistence."/nix/persist" = {
-    directories = [
-      "/var/lib/scrypted"
-      # Commented out since this is already enabled in homebridge.nix
-      # /var/lib/containers
-    ];
+    environment.persistence."/nix/persist" = {
+      directories = [
+        "/var/lib/scrypted"
+        # Commented out since this is already enabled in homebridge.nix
+        # /var/lib/containers
+      ];
+    };
   };
 }
@@ -0,0 +1,144 @@
+{
+  config,
+  lib,
+  ...
+}:
+# Internal ACME server for LAN-only and tailnet-only names. Vhosts opt in with
+# `doomlab.acme.vhosts.<name> = "internal";` and every host trusts the root
+# through modules/nixos/base.nix and modules/macos/base.nix.
+with lib; let
+  cfg = config.doomlab.stepCa;
+  ca = config.doomlab.internalCa;
+  net = import ./../lib/net.nix {inherit lib;};
+in {
+  imports = [
+    ./_internal-ca.nix
+    ./_registry.nix
+  ];
+
+  options = {
+    doomlab.stepCa = {
+      enable = mkOption {
+        description = "Whether to run the CA. Defaults to on once the PKI in `pkiDir` has been created.";
+        type = types.bool;
+        default = pathExists (cfg.pkiDir + "/intermediate_ca.crt");
+        defaultText = literalExpression ''pathExists "''${pkiDir}/intermediate_ca.crt"'';
+      };
+      domain = mkOption {
+        description = "Internal domain the CA issues certificates for. Nothing outside it is signed.";
+        type = types.str;
+        default = "doomlab.internal";
+      };
+      port = mkOption {
+        description = "Port the ACME directory listens on";
+        type = types.port;
+        default = 8443;
+      };
+      pkiDir = mkOption {
+        description = "Directory holding the committed root and intermediate certificates";
+        type = types.path;
+        default = ./../pki/internal-ca;
+      };
+      intermediateKeyFile = mkOption {
+        description = "Password protected intermediate CA key";
+        type = types.str;
+        default = config.sops.secrets."internal-ca-intermediate-key".path;
+        defaultText = literalExpression ''config.sops.secrets."internal-ca-intermediate-key".path'';
+      };
+      passwordFile = mkOption {
+        description = "Password of the intermediate CA key";
+        type = types.str;
+        default = config.sops.secrets."internal-ca-password".path;
+        defaultText = literalExpression ''config.sops.secrets."internal-ca-password".path'';
+      };
+    };
+  };
+
+  config = mkMerge [
+    {
+      warnings = optional (!cfg.enable) ''
+        services/step-ca.nix is imported on ${config.networking.hostName} but
+        ${toString cfg.pkiDir} has not been created; see the README.
+      '';
+    }
+
+    (mkIf cfg.enable {
+      assertions = [
+        {
+          assertion = ca.address != null;
+          message = "doomlab.internalCa.address must be set to the LAN or tailnet address step-ca listens on";
+        }
+      ];
+
+      doomlab.services.step-ca = {
+        description = "Internal ACME certificate authority";
+        units = ["step-ca.service"];
+        ports.tcp = [cfg.port];
+        persist = ["/var/lib/step-ca"];
+      };
+
+      sops.secrets = {
+        "internal-ca-intermediate-key" = {
+          owner = "step-ca";
+          format = "binary";
+          sopsFile = ./../secrets/internal-ca-intermediate.key;
+        };
+        "internal-ca-password" = {};
+      };
+
+      services.step-ca = {
+        enable = true;
+        # only where ca.name resolves, never a public address
+        address =
+          if ca.address != null && net.isIPv6 ca.address
+          then "[${ca.address}]"
+          else toString ca.address;
+        inherit (cfg) port;
+        openFirewall = true;
+        intermediatePasswordFile = cfg.passwordFile;
+        settings = {
+          root = "${cfg.pkiDir}/root_ca.crt";
+          crt = "${cfg.pkiDir}/intermediate_ca.crt";
+          key = cfg.intermediateKeyFile;
+          dnsNames = [ca.name];
+          logger.format = "text";
+          db = {
+            type = "badgerv2";
+            dataSource = "/var/lib/step-ca/db";
+          };
+          authority = {
+            claims = {
+              defaultTLSCertDuration = "720h";
+              maxTLSCertDuration = "2160h";
+            };
+            # Refuse to sign anything outside the internal domain
+            policy.x509.allow.dns = [cfg.domain "*.${cfg.domain}"];
+            provisioners = [
+              {
+                type = "ACME";
+                name = "acme";
+                challenges = ["http-01"];
+              }
+            ];
+          };
+          tls = {
+            minVersion = 1.2;
+            maxVersion = 1.3;
+          };
+        };
+      };
+
+      # it cannot bind the address before it is up
+      systemd.services.step-ca = {
+        wants = ["network-online.target"];
+        after = ["network-online.target"] ++ optional config.services.tailscale.enable "tailscaled.service";
+      };
+
+      environment.persistence."/nix/persist" = {
+        directories = [
+          "/var/lib/step-ca"
+        ];
+      };
+    })
+  ];
+}
@@ -1,19 +1,58 @@
-{config, ...}: {
-  sops.secrets."tailscale-authkey" = {};
+{
+  config,
+  lib,
+  ...
+}:
+with lib; let
+  cfg = config.doomlab.tailscale;
+  net = import ./../lib/net.nix {inherit lib;};
 
-  services.tailscale = {
-    enable = true;
-    openFirewall = true;
-    authKeyFile = config.sops.secrets."tailscale-authkey".path;
-    useRoutingFeatures = "server";
-    extraUpFlags = [
-      "--advertise-routes=10.0.0.0/8"
-    ];
+  # the global and ULA prefixes this host is statically addressed in
+  lanPrefixes6 = unique (concatMap (l: map net.subnetOf (filter (a: net.isIPv6 a && !net.contains "fe80::/10" a) l.addresses)) (
+    with config.doomlab.network; attrValues (interfaces // vlans // bridges // bonds)
+  ));
+in {
+  imports = [
+    ./_registry.nix
+  ];
+
+  options.doomlab.tailscale.routes = mkOption {
+    description = ''
+      Subnets advertised to the tailnet. Besides the LAN's IPv4 range this
+      covers the IPv6 prefixes the host has static addresses in through
+      doomlab.network; add SLAAC-only prefixes by hand.
+    '';
+    type = types.listOf (types.addCheck types.str net.isCidr);
+    default = ["10.0.0.0/8"] ++ lanPrefixes6;
+    defaultText = literalExpression ''["10.0.0.0/8"] ++ IPv6 prefixes of doomlab.network addresses'';
+    example = ["10.0.0.0/8" "fd00:10::/64"];
   };
 
-  environment.persistence."/nix/persist" = {
-    directories = [
-      "/var/lib/tailscale"
-    ];
+  config = {
+    doomlab.services.tailscale = {
+      description = "Tailscale mesh VPN and subnet router";
+      units = ["tailscaled.service"];
+      ports.udp = [config.services.tailscale.port];
+      persist = ["/var/lib/tailscale"];
+    };
+
+    sops.secrets."tailscale-authkey" = {};
+
+    services.tailscale = {
+      enable = true;
+      openFirewall = true;
+      authKeyFile = config.sops.secrets."tailscale-authkey".path;
+      # forwards IPv4 and IPv6
+      useRoutingFeatures = "server";
+      extraUpFlags = [
+        "--advertise-routes=${concatStringsSep "," cfg.routes}"
+      ];
+    };
+
+    environment.persistence."/nix/persist" = {
+      directories = [
+        "/var/lib/tailscale"
+      ];
+    };
   };
 }
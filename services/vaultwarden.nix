@@ -0,0 +1,285 @@
+{
+  config,
+  pkgs,
+  lib,
+  ...
+}:
+# Self-hosted Bitwarden server for household and service accounts. Kopia
+# never reads the live database: backup-vaultwarden first takes a consistent
+# copy with vaultwarden-backup, and vaultwarden-restore puts one back.
+with lib; let
+  cfg = config.doomlab.vaultwarden;
+  postgres = cfg.database == "postgresql";
+  port = 8222;
+
+  # nixpkgs moved the data from bitwarden_rs with 24.11
+  dataDir =
+    if versionOlder config.system.stateVersion "24.11"
+    then "/var/lib/bitwarden_rs"
+    else "/var/lib/vaultwarden";
+  backupDir = "/var/backup/vaultwarden";
+
+  # Files next to the database that a restore needs; icon_cache is not one
+  keep = ["attachments" "sends" "config.json" "rsa_key.pem" "rsa_key.pub.pem"];
+
+  backup = pkgs.writeShellApplication {
+    name = "vaultwarden-backup";
+    runtimeInputs = with pkgs; [coreutils sqlite util-linux] ++ optional postgres config.services.postgresql.package;
+    text = ''
+      umask 077
+      dest=''${1:-${backupDir}}
+      mkdir -p "$(dirname "$dest")"
+      tmp=$(mktemp -d "$dest.XXXXXX")
+      trap 'rm -rf "$tmp"' EXIT
+
+      ${
+        if postgres
+        then ''
+          runuser -u postgres -- pg_dump --clean --if-exists vaultwarden > "$tmp/db.sql"
+        ''
+        else ''
+          # .backup copies a consistent snapshot while Vaultwarden writes
+          sqlite3 ${dataDir}/db.sqlite3 ".backup '$tmp/db.sqlite3'"
+          check=$(sqlite3 "$tmp/db.sqlite3" "PRAGMA integrity_check")
+          if [ "$check" != ok ]; then
+            echo "backup failed the integrity check: $check" >&2
+            exit 1
+          fi
+        ''
+      }
+      for f in ${escapeShellArgs keep}; do
+        if [ -e "${dataDir}/$f" ]; then
+          cp -a "${dataDir}/$f" "$tmp/"
+        fi
+      done
+
+      rm -rf "$dest"
+      mv "$tmp" "$dest"
+      trap - EXIT
+      echo "backed up Vaultwarden to $dest"
+    '';
+  };
+
+  restore = pkgs.writeShellApplication {
+    name = "vaultwarden-restore";
+    runtimeInputs = with pkgs; [coreutils systemd util-linux] ++ optional postgres config.services.postgresql.package;
+    text = ''
+      src=''${1:-${backupDir}}
+      if [ ! -e "$src/${
+        if postgres
+        then "db.sql"
+        else "db.sqlite3"
+      }" ]; then
+        echo "no Vaultwarden backup in $src" >&2
+        exit 1
+      fi
+
+      systemctl stop vaultwarden.service
+      ${
+        if postgres
+        then ''
+          runuser -u postgres -- psql --quiet --set ON_ERROR_STOP=1 vaultwarden < "$src/db.sql"
+        ''
+        else ''
+          rm -f ${dataDir}/db.sqlite3 ${dataDir}/db.sqlite3-wal ${dataDir}/db.sqlite3-shm
+          install -o vaultwarden -g vaultwarden -m 600 "$src/db.sqlite3" ${dataDir}/db.sqlite3
+        ''
+      }
+      for f in ${escapeShellArgs keep}; do
+        rm -rf "${dataDir}/$f"
+        if [ -e "$src/$f" ]; then
+          cp -a "$src/$f" ${dataDir}/
+          chown -R vaultwarden:vaultwarden "${dataDir}/$f"
+        fi
+      done
+      systemctl start vaultwarden.service
+      echo "restored Vaultwarden from $src"
+    '';
+  };
+in {
+  imports = [
+    ./_acme.nix
+    ./_nginx.nix
+    ./_registry.nix
+  ];
+
+  options.doomlab.vaultwarden = {
+    domain = mkOption {
+      description = "Virtual host Vaultwarden is served on";
+      type = types.str;
+      default = "vault.orther.dev";
+    };
+    database = mkOption {
+      description = "Database backend. PostgreSQL is shared with anything else on the host.";
+      type = types.enum ["sqlite" "postgresql"];
+      default = "sqlite";
+    };
+    environmentFile = mkOption {
+      description = ''
+        Environment file with ADMIN_TOKEN, ideally an argon2 hash from
+        `vaultwarden hash`, and SMTP_USERNAME and SMTP_PASSWORD if the relay
+        wants them
+      '';
+      type = types.str;
+      default = config.sops.secrets."vaultwarden-env".path;
+      defaultText = literalExpression ''config.sops.secrets."vaultwarden-env".path'';
+    };
+    smtp = {
+      host = mkOption {
+        description = "Mail relay invitations and verification mails are sent through";
+        type = types.str;
+        default = "127.0.0.1";
+      };
+      port = mkOption {
+        description = "Port of the mail relay";
+        type = types.port;
+        default = 25;
+      };
+      from = mkOption {
+        description = "Sender address of Vaultwarden's mails";
+        type = types.str;
+        default = "vault@orther.dev";
+      };
+    };
+  };
+
+  config = {
+    warnings = optional (elem cfg.smtp.host ["localhost" "127.0.0.1" "::1"] && !config.services.postfix.enable) ''
+      Vaultwarden on ${config.networking.hostName} sends mail through
+      ${cfg.smtp.host}:${toString cfg.smtp.port}, but no relay runs there;
+      invitations will fail until one does.
+    '';
+
+    doomlab.services.vaultwarden = {
+      description = "Vaultwarden password manager";
+      units = ["vaultwarden.service"] ++ optional postgres "postgresql.service";
+      ports = {
+        tcp = [port];
+        local = [port];
+      };
+      persist = [dataDir] ++ optional postgres "/var/lib/postgresql";
+      backups = [backupDir];
+    };
+
+    doomlab.resources.classes.interactive.units = ["vaultwarden.service"];
+
+    services.vaultwarden = {
+      enable = true;
+      dbBackend = cfg.database;
+      inherit (cfg) environmentFile;
+      config = {
+        DOMAIN = "https://${cfg.domain}";
+        SIGNUPS_ALLOWED = false;
+        INVITATIONS_ALLOWED = true;
+        SHOW_PASSWORD_HINT = false;
+        ROCKET_ADDRESS = "127.0.0.1";
+        ROCKET_PORT = port;
+        # set by nginx
+        IP_HEADER = "X-Real-IP";
+        SMTP_HOST = cfg.smtp.host;
+        SMTP_PORT = cfg.smtp.port;
+        # a local relay, which takes care of TLS to the outside
+        SMTP_SECURITY = "off";
+        SMTP_FROM = cfg.smtp.from;
+        SMTP_FROM_NAME = "doomlab Vaultwarden";
+        DATABASE_URL = mkIf postgres "postgresql:///vaultwarden?host=/run/postgresql";
+      };
+    };
+
+    services.postgresql = mkIf postgres {
+      enable = true;
+      ensureDatabases = ["vaultwarden"];
+      ensureUsers = [
+        {
+          name = "vaultwarden";
+          ensureDBOwnership = true;
+        }
+      ];
+    };
+
+    systemd.services.vaultwarden = mkIf postgres {
+      after = ["postgresql.service"];
+      requires = ["postgresql.service"];
+    };
+
+    sops.secrets."vaultwarden-env" = {
+      restartUnits = ["vaultwarden.service"];
+    };
+
+    environment.systemPackages = [backup restore];
+
+    doomlab.acme.vhosts.${cfg.domain} = "public";
+
+    # The Bitwarden apps cannot present a client certificate, so the vault is
+    # for the LAN and tailnet without one
+    doomlab.nginx.hardening.${cfg.domain} = {
+      allow = config.doomlab.nginx.adminNetworks;
+      # attachments go up to 500MB
+      maxBodySize = "525m";
+      locationRateLimits."/identity/connect/token" = {
+        rate = "10r/m";
+        burst = 5;
+      };
+    };
+
+    services.nginx.virtualHosts.${cfg.domain}.locations = {
+      "/" = {
+        recommendedProxySettings = true;
+        proxyWebsockets = true;
+        proxyPass = "http://127.0.0.1:${toString port}";
+      };
+      # logins, rate limited
+      "/identity/connect/token" = {
+        recommendedProxySettings = true;
+        proxyPass = "http://127.0.0.1:${toString port}";
+      };
+    };
+
+    sops.secrets."kopia-repository-token" = {};
+
+    systemd = {
+      services = {
+        "backup-vaultwarden" = {
+          description = "Backup Vaultwarden with Kopia";
+          wantedBy = ["default.target"];
+          after = optional postgres "postgresql.service";
+          serviceConfig = {
+            Type = "oneshot";
+            User = "root";
+            UMask = "0077";
+            PrivateTmp = true;
+            NoNewPrivileges = true;
+            ExecStartPre = "${pkgs.kopia}/bin/kopia repository connect from-config --token-file ${config.sops.secrets."kopia-repository-token".path}";
+            ExecStart = [
+              "${backup}/bin/vaultwarden-backup"
+              "${pkgs.kopia}/bin/kopia snapshot create ${backupDir}"
+            ];
+            ExecStartPost = "${pkgs.kopia}/bin/kopia repository disconnect";
+          };
+        };
+      };
+
+      timers = {
+        "backup-vaultwarden" = {
+          description = "Backup Vaultwarden with Kopia";
+          wantedBy = ["timers.target"];
+          timerConfig = {
+            OnCalendar = "*-*-* 4:00:00";
+            RandomizedDelaySec = "1h";
+          };
+        };
+      };
+    };
+
+    environment.persistence."/nix/persist" = {
+      directories = [
+        {
+          directory = dataDir;
+          user = "vaultwarden";
+          group = "vaultwarden";
+          mode = "0700";
+        }
+      ];
+    };
+  };
+}
@@ -0,0 +1,19 @@
+# Every test runs on an IPv6-only network: the nodes lose the IPv4 addresses
+# the test driver hands out and find each other by their IPv6 ones, so
+# anything that still assumes IPv4 fails here first.
+{lib, ...}:
+with lib; {
+  defaults = {
+    config,
+    nodes,
+    ...
+  }: {
+    networking = {
+      interfaces = listToAttrs (imap1 (i: _: nameValuePair "eth${toString i}" {ipv4.addresses = mkForce [];}) config.virtualisation.vlans);
+      primaryIPAddress = mkForce "";
+      extraHosts = mkForce (concatMapStrings (n: ''
+        ${n.networking.primaryIPv6Address} ${n.networking.hostName}
+      '') (attrValues nodes));
+    };
+  };
+}
@@ -0,0 +1,213 @@
+{hostPkgs, ...}: let
+  # TLS for Pebble's own API; the certificates it issues chain to a root it
+  # generates at startup and serves on the management port.
+  pki = hostPkgs.runCommand "test-pebble-tls" {nativeBuildInputs = [hostPkgs.step-cli];} ''
+    mkdir $out
+    step certificate create "Test Pebble Root" $out/root.crt $out/root.key \
+      --profile root-ca --no-password --insecure
+    step certificate create acme $out/cert.pem $out/key.pem \
+      --profile leaf --ca $out/root.crt --ca-key $out/root.key \
+      --san acme --not-after 8760h --no-password --insecure
+  '';
+
+  # The wildcard is shared from web to consumer with these credentials
+  password = "share-secret";
+  htpasswd = hostPkgs.runCommand "test-acme-share-htpasswd" {nativeBuildInputs = [hostPkgs.apacheHttpd];} ''
+    htpasswd -nbB acme-share ${password} > $out
+  '';
+  # A certificate that expired years ago, whose key also matches nothing the
+  # issuer has
+  expired = hostPkgs.runCommand "test-expired-wildcard" {nativeBuildInputs = [hostPkgs.step-cli];} ''
+    mkdir $out
+    step certificate create "*.orther.dev" $out/fullchain.pem $out/key.pem \
+      --profile self-signed --subtle --san "*.orther.dev" \
+      --not-before 2020-01-01T00:00:00Z --not-after 2020-01-02T00:00:00Z \
+      --no-password --insecure
+  '';
+
+  pebbleConfig = hostPkgs.writeText "pebble.json" (builtins.toJSON {
+    pebble = {
+      listenAddress = ":14000";
+      managementListenAddress = ":15000";
+      certificate = "${pki}/cert.pem";
+      privateKey = "${pki}/key.pem";
+      httpPort = 80;
+      tlsPort = 443;
+      ocspResponderURL = "";
+      externalAccountBindingRequired = false;
+    };
+  });
+in {
+  name = "acme-pebble";
+
+  nodes = {
+    acme = {pkgs, ...}: {
+      networking.firewall.enable = false;
+
+      systemd.services = {
+        pebble-challtestsrv = {
+          wantedBy = ["multi-user.target"];
+          serviceConfig.ExecStart = "${pkgs.pebble}/bin/pebble-challtestsrv -dns01 :8053 -management :8055 -http01 '' -https01 '' -tlsalpn01 '' -doh ''";
+        };
+
+        pebble = {
+          wantedBy = ["multi-user.target"];
+          after = ["pebble-challtestsrv.service"];
+          environment = {
+            PEBBLE_VA_NOSLEEP = "1";
+            PEBBLE_WFE_NONCEREJECT = "0";
+          };
+          serviceConfig.ExecStart = "${pkgs.pebble}/bin/pebble -config ${pebbleConfig} -dnsserver 127.0.0.1:8053";
+        };
+      };
+    };
+
+    # Requests the wildcard and shares it
+    web = {
+      inputs,
+      lib,
+      nodes,
+      pkgs,
+      ...
+    }: let
+      # lego's exec provider publishes TXT records in Pebble's test DNS server
+      challenge = pkgs.writeShellScript "pebble-challenge" ''
+        case "$1" in
+          present) ${pkgs.curl}/bin/curl --silent --fail --data "{\"host\":\"$2\",\"value\":\"$3\"}" http://acme:8055/set-txt ;;
+          cleanup) ${pkgs.curl}/bin/curl --silent --fail --data "{\"host\":\"$2\"}" http://acme:8055/clear-txt ;;
+        esac
+      '';
+    in {
+      imports = [
+        inputs.impermanence.nixosModules.impermanence
+        inputs.sops-nix.nixosModules.sops
+        ./../services/_acme.nix
+        ./../services/_nginx.nix
+      ];
+
+      security.pki.certificateFiles = ["${pki}/root.crt"];
+
+      doomlab.acme = {
+        share = {
+          issuer = "web";
+          htpasswdFile = htpasswd;
+        };
+        vhosts."test.orther.dev" = "public";
+        wildcard = {
+          server = "https://acme:14000/dir";
+          dnsProvider = "exec";
+          credentialFiles = {};
+          environmentFile = pkgs.writeText "lego-exec.env" "EXEC_PATH=${challenge}";
+          dnsResolvers = ["[${nodes.acme.networking.primaryIPv6Address}]:8053"];
+          propagationCheck = false;
+        };
+      };
+
+      services.nginx.virtualHosts."test.orther.dev".locations."/".return = "200 'wildcard ok'";
+      sops.secrets = lib.mkForce {};
+      # The tailnet stands in for the test network
+      networking.firewall.allowedTCPPorts = [8444];
+    };
+
+    # Pulls the wildcard from web instead of requesting its own
+    consumer = {
+      inputs,
+      lib,
+      pkgs,
+      ...
+    }: {
+      imports = [
+        inputs.impermanence.nixosModules.impermanence
+        inputs.sops-nix.nixosModules.sops
+        ./../services/_acme.nix
+        ./../services/_nginx.nix
+      ];
+
+      doomlab.acme = {
+        share = {
+          issuer = "web";
+          passwordFile = pkgs.writeText "acme-share-password" password;
+        };
+        vhosts."consumer.orther.dev" = "public";
+      };
+
+      services.nginx.virtualHosts."consumer.orther.dev".locations."/".return = "200 'shared ok'";
+      sops.secrets = lib.mkForce {};
+      # Pebble's roots only exist once it runs, so the script fetches them
+      systemd.services.acme-share-pull.environment.CURL_CA_BUNDLE = "/tmp/pebble-root.pem";
+      environment.systemPackages = [pkgs.curl];
+    };
+
+    client = {
+      nodes,
+      pkgs,
+      ...
+    }: {
+      networking.hosts = {
+        ${nodes.web.networking.primaryIPv6Address} = ["test.orther.dev"];
+        ${nodes.consumer.networking.primaryIPv6Address} = ["consumer.orther.dev"];
+      };
+      environment.systemPackages = [pkgs.curl];
+    };
+  };
+
+  testScript = ''
+    acme.start()
+    acme.wait_for_unit("pebble.service")
+    acme.wait_for_open_port(14000)
+
+    web.start()
+    client.start()
+    consumer.start()
+    web.wait_for_unit("acme-finished-orther.dev.target")
+    web.wait_for_unit("nginx.service")
+
+    with subtest("wildcard is issued by the configured directory"):
+        client.succeed("curl --silent --fail --cacert ${pki}/root.crt https://acme:15000/roots/0 > /tmp/pebble-root.pem")
+        client.succeed("curl --silent --fail --cacert /tmp/pebble-root.pem https://test.orther.dev/ | grep -q 'wildcard ok'")
+
+    wildcard = "/var/lib/acme/orther.dev"
+    issued = web.succeed(f"cat {wildcard}/fullchain.pem")
+
+    # Boots on a throwaway certificate, as it cannot verify web yet
+    consumer.wait_for_unit("nginx.service")
+    consumer.succeed("curl --silent --fail --cacert ${pki}/root.crt https://acme:15000/roots/0 > /tmp/pebble-root.pem")
+
+    with subtest("a consumer pulls the wildcard and reloads nginx"):
+        client.fail("curl --silent --fail --cacert /tmp/pebble-root.pem https://consumer.orther.dev/")
+        consumer.succeed("systemctl start acme-share-pull.service")
+        assert consumer.succeed(f"cat {wildcard}/fullchain.pem") == issued
+        client.succeed("curl --silent --fail --cacert /tmp/pebble-root.pem https://consumer.orther.dev/ | grep -q 'shared ok'")
+
+    key = consumer.succeed(f"cat {wildcard}/key.pem")
+
+    with subtest("the issuer's credentials are required"):
+        status = consumer.succeed(
+            "curl --silent --output /dev/null --write-out '%{http_code}' --cacert /tmp/pebble-root.pem"
+            " --connect-to acme-share.orther.dev:8444:web:8444 https://acme-share.orther.dev:8444/orther.dev/key.pem"
+        )
+        assert status == "401", status
+
+    # What web serves is swapped out behind nginx's back, which keeps
+    # terminating TLS with the real certificate
+    def serve(fullchain, key):
+        web.succeed(
+            f"install -m 0644 -o acme -g acme {fullchain} {wildcard}/fullchain.pem",
+            f"install -m 0640 -o acme -g acme {key} {wildcard}/key.pem",
+        )
+
+    web.succeed(f"cp -a {wildcard} /tmp/wildcard")
+
+    with subtest("an expired certificate is not installed"):
+        serve("${expired}/fullchain.pem", "${expired}/key.pem")
+        consumer.fail("systemctl start acme-share-pull.service")
+        consumer.succeed("journalctl -u acme-share-pull.service | grep -q 'Certificate will expire'")
+        assert consumer.succeed(f"cat {wildcard}/fullchain.pem") == issued
+
+    with subtest("a certificate with a mismatched key is not installed"):
+        serve("/tmp/wildcard/fullchain.pem", "${expired}/key.pem")
+        consumer.fail("systemctl start acme-share-pull.service")
+        consumer.succeed("journalctl -u acme-share-pull.service | grep -q 'do not match'")
+        assert consumer.succeed(f"cat {wildcard}/key.pem") == key
+  '';
+}
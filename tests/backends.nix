@@ -0,0 +1,79 @@
+{lib, ...}: {
+  name = "backends";
+
+  nodes = {
+    server = {pkgs, ...}: {
+      imports = [
+        ./../services/_nginx.nix
+        ./../services/_registry.nix
+      ];
+
+      # One backend that can bind loopback and one that listens everywhere and
+      # opens its own port, like Jellyfin with openFirewall
+      systemd.services = {
+        loopback-app = {
+          wantedBy = ["multi-user.target"];
+          serviceConfig.ExecStart = "${pkgs.python3}/bin/python3 -m http.server 9696 --bind 127.0.0.1 --directory ${pkgs.writeTextDir "index.html" "loopback app"}";
+        };
+        wildcard-app = {
+          wantedBy = ["multi-user.target"];
+          serviceConfig.ExecStart = "${pkgs.python3}/bin/python3 -m http.server 8096 --bind :: --directory ${pkgs.writeTextDir "index.html" "wildcard app"}";
+        };
+      };
+      networking.firewall.allowedTCPPorts = [80 8096];
+
+      doomlab.services.demo = {
+        description = "Backends behind nginx";
+        ports = {
+          tcp = [8096 9696];
+          local = [8096 9696];
+        };
+      };
+
+      services.nginx.virtualHosts = {
+        "wildcard.test" = {
+          default = true;
+          locations."/".proxyPass = "http://127.0.0.1:8096";
+        };
+        "loopback.test".locations."/".proxyPass = "http://127.0.0.1:9696";
+      };
+    };
+
+    client = {pkgs, ...}: {
+      environment.systemPackages = [pkgs.curl pkgs.netcat];
+    };
+  };
+
+  testScript = {nodes, ...}: let
+    local = nodes.server.doomlab.services.demo.ports.local;
+    public = lib.subtractLists local nodes.server.networking.firewall.allowedTCPPorts;
+  in ''
+    start_all()
+    server.wait_for_unit("nginx.service")
+    server.wait_for_open_port(8096)
+    server.wait_for_open_port(9696)
+    client.wait_for_unit("multi-user.target")
+
+    local = set(${builtins.toJSON local})
+    public = set(${builtins.toJSON public})
+
+    with subtest("every listening socket is public or refused"):
+        listening = set()
+        for line in server.succeed("ss -Hltn").splitlines():
+            address = line.split()[3]
+            if not address.startswith(("127.", "[::1]")):
+                listening.add(int(address.rsplit(":", 1)[1]))
+        reachable = {p for p in listening if client.execute(f"nc -z -w 2 server {p}")[0] == 0}
+        assert reachable <= public, f"reachable from the network but not public: {reachable - public}"
+        assert not reachable & local, f"local ports reachable: {reachable & local}"
+        assert 8096 in listening, "the wildcard backend should listen on every address"
+
+    with subtest("loopback backends do not listen on the network"):
+        server.succeed("ss -Hltn 'sport = :9696' | grep -q '127.0.0.1:9696'")
+        server.fail("ss -Hltn 'sport = :9696' | grep -v '127.0.0.1:9696' | grep -q .")
+
+    with subtest("nginx still reaches both"):
+        client.succeed("curl --silent --fail http://server/ | grep -q 'wildcard app'")
+        client.succeed("curl --silent --fail -H 'Host: loopback.test' http://server/ | grep -q 'loopback app'")
+  '';
+}
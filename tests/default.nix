@@ -0,0 +1,27 @@
+# NixOS VM tests, run with `nix flake check` or
+# `nix build .#checks.x86_64-linux.<name>`. They all run on an IPv6-only
+# network (_ipv6-only.nix).
+{
+  pkgs,
+  inputs,
+}: let
+  runTest = test:
+    pkgs.testers.runNixOSTest {
+      imports = [test ./_ipv6-only.nix];
+      node.specialArgs = {inherit inputs;};
+    };
+in {
+  acme-pebble = runTest ./acme-pebble.nix;
+  backends = runTest ./backends.nix;
+  home-assistant = runTest ./home-assistant.nix;
+  immich = runTest ./immich.nix;
+  mdns = runTest ./mdns.nix;
+  migrate = runTest ./migrate.nix;
+  network = runTest ./network.nix;
+  nginx-hardening = runTest ./nginx-hardening.nix;
+  remote-unlock = runTest ./remote-unlock.nix;
+  resources = runTest ./resources.nix;
+  scrypted-recordings = runTest ./scrypted-recordings.nix;
+  step-ca = runTest ./step-ca.nix;
+  vaultwarden = runTest ./vaultwarden.nix;
+}
@@ -0,0 +1,100 @@
+{hostPkgs, ...}: let
+  # Stands in for the sops secret
+  secrets = hostPkgs.writeText "home-assistant-secrets.yaml" ''
+    latitude: 45.52
+    longitude: -122.68
+    elevation: 15
+  '';
+in {
+  name = "home-assistant";
+
+  nodes = {
+    server = {
+      inputs,
+      lib,
+      ...
+    }: {
+      imports = [
+        inputs.impermanence.nixosModules.impermanence
+        inputs.sops-nix.nixosModules.sops
+        ./../modules/nixos/resources.nix
+        ./../services/home-assistant.nix
+      ];
+
+      doomlab.homeAssistant = {
+        domain = "ha.test";
+        secretsFile = "${secrets}";
+      };
+
+      # Plain HTTP without the wildcard certificate or client CA
+      doomlab.acme.vhosts = lib.mkForce {};
+      doomlab.nginx.clientCa.enable = false;
+      sops.secrets = lib.mkForce {};
+      # the Kopia repository token is one of those secrets
+      systemd.services.backup-home-assistant = lib.mkForce {};
+      systemd.timers.backup-home-assistant = lib.mkForce {};
+      services.nginx.virtualHosts."ha.test".default = true;
+      networking.firewall.allowedTCPPorts = [80];
+
+      # Only what onboarding and the API need, to keep the closure small
+      services.home-assistant.extraComponents = lib.mkForce ["default_config"];
+
+      virtualisation.memorySize = 2048;
+    };
+
+    client = {pkgs, ...}: {
+      environment.systemPackages = [pkgs.curl];
+    };
+  };
+
+  testScript = ''
+    import json
+
+    start_all()
+    server.wait_for_unit("home-assistant.service")
+    server.wait_for_unit("nginx.service")
+    server.wait_until_succeeds("curl --silent --fail http://127.0.0.1:8123/manifest.json", timeout=300)
+
+    def api(method, path, data=None, form=False, token=None):
+        args = ["curl --silent --fail --request", method, "-H 'Host: ha.test'"]
+        if token:
+            args.append(f"-H 'Authorization: Bearer {token}'")
+        if data is not None:
+            if form:
+                args += [f"--data-urlencode '{k}={v}'" for k, v in data.items()]
+            else:
+                args += ["-H 'Content-Type: application/json'", f"--data '{json.dumps(data)}'"]
+        args.append(f"http://127.0.0.1{path}")
+        return json.loads(server.succeed(" ".join(args)))
+
+    with subtest("the configuration and secrets load"):
+        server.succeed("test -L /var/lib/hass/secrets.yaml")
+        server.fail("journalctl -u home-assistant.service | grep -q 'Invalid config'")
+
+    with subtest("it only listens on loopback"):
+        server.fail("ss -Hltn 'sport = :8123' | grep -v -e '127.0.0.1:8123' -e '\\[::1\\]:8123' | grep -q .")
+        client.fail("curl --silent --max-time 5 http://server:8123/")
+
+    with subtest("the API answers through nginx"):
+        client_id = "http://ha.test/"
+        code = api("POST", "/api/onboarding/users", {
+            "client_id": client_id,
+            "name": "Test",
+            "username": "test",
+            "password": "test-password",
+            "language": "en",
+        })["auth_code"]
+        token = api("POST", "/auth/token", {
+            "grant_type": "authorization_code",
+            "code": code,
+            "client_id": client_id,
+        }, form=True)["access_token"]
+        # Home Assistant refuses forwarded requests from proxies it does not trust
+        assert api("GET", "/api/", token=token)["message"] == "API running."
+        config = api("GET", "/api/config", token=token)
+        assert config["latitude"] == 45.52, config
+
+    with subtest("the UI is for admin networks only"):
+        client.succeed("curl --silent --output /dev/null --write-out '%{http_code}' http://server/ | grep -qx 403")
+  '';
+}
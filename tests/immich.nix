@@ -0,0 +1,73 @@
+{
+  name = "immich";
+
+  nodes.server = {
+    inputs,
+    lib,
+    pkgs,
+    ...
+  }: {
+    imports = [
+      inputs.impermanence.nixosModules.impermanence
+      inputs.sops-nix.nixosModules.sops
+      ./../modules/nixos/resources.nix
+      ./../services/immich.nix
+    ];
+
+    # Stands in for the Nextcloud user data
+    doomlab.immich.externalLibraries = ["/srv/photos"];
+    systemd.tmpfiles.rules = [
+      "d /srv/photos 0755 root root"
+      "f /srv/photos/beach.jpg 0644 root root - not really a jpeg"
+    ];
+
+    doomlab.acme.vhosts = lib.mkForce {};
+    sops.secrets = lib.mkForce {};
+    # the Kopia repository token is one of those secrets
+    systemd.services.backup-immich = lib.mkForce {};
+    systemd.timers.backup-immich = lib.mkForce {};
+
+    environment.systemPackages = [pkgs.curl pkgs.jq];
+
+    # The VM has no GPU, like the servers
+    virtualisation = {
+      memorySize = 4096;
+      cores = 2;
+    };
+  };
+
+  testScript = ''
+    import json
+
+    server.wait_for_unit("postgresql.service")
+    server.wait_for_unit("immich-machine-learning.service")
+    server.wait_for_unit("immich-server.service")
+
+    api = "http://127.0.0.1:2283/api"
+
+    with subtest("the API and machine learning come up on the CPU"):
+        server.wait_until_succeeds(f"curl --silent --fail {api}/server/ping | grep -q pong", timeout=300)
+        server.wait_until_succeeds("curl --silent --fail http://127.0.0.1:3003/ping | grep -q pong", timeout=300)
+
+    def post(path, body):
+        return server.succeed(
+            f"curl --silent --fail -H 'Content-Type: application/json' --data '{json.dumps(body)}' {api}{path}"
+        )
+
+    with subtest("the declared settings apply"):
+        admin = {"email": "admin@example.com", "password": "test-password"}
+        post("/auth/admin-sign-up", admin | {"name": "Admin"})
+        token = json.loads(post("/auth/login", admin))["accessToken"]
+        config = json.loads(server.succeed(f"curl --silent --fail -H 'Authorization: Bearer {token}' {api}/system-config"))
+        assert config["ffmpeg"]["accel"] == "disabled", config["ffmpeg"]
+        assert config["server"]["externalDomain"] == "https://photos.orther.dev", config["server"]
+
+    with subtest("the library goes through nginx"):
+        server.succeed("curl --silent --fail -H 'Host: photos.orther.dev' http://127.0.0.1/api/server/ping | grep -q pong")
+
+    with subtest("external libraries are read-only to Immich"):
+        pid = server.succeed("systemctl show -p MainPID --value immich-server").strip()
+        server.succeed(f"nsenter --target {pid} --mount -- cat /srv/photos/beach.jpg")
+        server.fail(f"nsenter --target {pid} --mount -- touch /srv/photos/new.jpg")
+  '';
+}
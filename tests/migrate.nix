@@ -0,0 +1,156 @@
+{hostPkgs, ...}: let
+  # Key the admin node deploys with, authorized for orther on both hosts
+  sshKey = hostPkgs.runCommand "test-migrate-ssh-key" {nativeBuildInputs = [hostPkgs.openssh];} ''
+    mkdir $out
+    ssh-keygen -q -t ed25519 -N "" -C admin -f $out/id_ed25519
+  '';
+
+  # Both hosts run the same service; they only differ in the demo user's
+  # uid, so the copy has to restore ownership by name.
+  host = uid: {inputs, ...}: {
+    imports = [
+      inputs.impermanence.nixosModules.impermanence
+      ./../services/_registry.nix
+    ];
+
+    doomlab.services.demo = {
+      description = "Service whose state is migrated";
+      units = ["demo.service"];
+      persist = ["/var/lib/demo"];
+    };
+
+    environment.persistence."/nix/persist".directories = [
+      {
+        directory = "/var/lib/demo";
+        user = "demo";
+        group = "demo";
+      }
+    ];
+
+    users.groups.demo.gid = uid;
+    users.users.demo = {
+      inherit uid;
+      isSystemUser = true;
+      group = "demo";
+    };
+
+    systemd.services.demo = {
+      wantedBy = ["multi-user.target"];
+      script = ''
+        echo "started on $(cat /proc/sys/kernel/hostname)" >> /var/lib/demo/log
+        exec sleep infinity
+      '';
+      serviceConfig.User = "demo";
+    };
+
+    services.openssh.enable = true;
+    users.users.orther = {
+      isNormalUser = true;
+      extraGroups = ["wheel"];
+      openssh.authorizedKeys.keyFiles = ["${sshKey}/id_ed25519.pub"];
+    };
+    security.sudo.wheelNeedsPassword = false;
+  };
+
+  doomctl = args: "doomctl migrate -inventory /etc/doomlab-inventory.json -edit=false -dns=false ${args} demo source dest";
+in {
+  name = "migrate";
+
+  nodes = {
+    source = host 1500;
+
+    # the service is deployed but idle until its state arrives
+    dest = {lib, ...}: {
+      imports = [(host 1600)];
+      systemd.services.demo.wantedBy = lib.mkForce [];
+    };
+
+    admin = {
+      inputs,
+      lib,
+      nodes,
+      pkgs,
+      ...
+    }: {
+      environment.systemPackages = [
+        inputs.self.packages.${pkgs.system}.doomctl
+        # Stands in for nixos-rebuild, which cannot build the flake offline:
+        # it records each deploy, and fails the destination's while
+        # /tmp/fail-deploy exists
+        (lib.hiPrio (pkgs.writeShellScriptBin "nixos-rebuild" ''
+          echo "$*" >> /tmp/deploys
+          case "$* " in
+            *"#dest "*)
+              if [ -e /tmp/fail-deploy ]; then
+                echo "error: building dest failed" >&2
+                exit 1
+              fi
+              ;;
+          esac
+        ''))
+      ];
+
+      # what `doomctl inventory -format json` reports for the two hosts
+      environment.etc."doomlab-inventory.json".text = builtins.toJSON (import ./../lib/inventory.nix {inherit (pkgs) lib;} {
+        nixosConfigurations = {
+          source.config = nodes.source;
+          dest.config = nodes.dest;
+        };
+        darwinConfigurations = {};
+      });
+
+      programs.ssh.extraConfig = ''
+        StrictHostKeyChecking no
+        UserKnownHostsFile /dev/null
+      '';
+    };
+  };
+
+  testScript = ''
+    start_all()
+    source.wait_for_unit("demo.service")
+    for m in (source, dest):
+        m.wait_for_unit("sshd.service")
+    admin.succeed("install -D -m 600 ${sshKey}/id_ed25519 /root/.ssh/id_ed25519")
+
+    source.succeed("echo precious > /var/lib/demo/data && chown demo:demo /var/lib/demo/data")
+    dest.succeed("echo stale > /var/lib/demo/leftover")
+
+    with subtest("dry run only prints the plan"):
+        plan = admin.succeed("${doomctl "-dry-run"}")
+        assert "copy /nix/persist/var/lib/demo from source to dest" in plan, plan
+        assert "deploy dest" in plan, plan
+        source.succeed("systemctl is-active demo.service")
+        dest.fail("test -e /var/lib/demo/data")
+        admin.fail("test -e /tmp/deploys")
+
+    with subtest("a failed deploy starts the service on the source again"):
+        admin.succeed("touch /tmp/fail-deploy")
+        status, out = admin.execute("${doomctl ""}")
+        assert status != 0, out
+        assert "undo: stop demo.service on source" in out, out
+        source.succeed("systemctl is-active demo.service")
+        source.succeed("test $(grep -c 'started on source' /var/lib/demo/log) -eq 2")
+        dest.fail("systemctl is-active demo.service")
+        dest.fail("test -e /var/lib/demo/data")
+        admin.succeed("rm /tmp/fail-deploy /tmp/deploys")
+
+    with subtest("state moves with the service"):
+        admin.succeed("${doomctl ""}")
+        source.fail("systemctl is-active demo.service")
+        dest.succeed("systemctl is-active demo.service")
+        dest.succeed("grep -qx precious /var/lib/demo/data")
+        dest.fail("test -e /var/lib/demo/leftover")
+        dest.succeed("grep -q 'started on source' /var/lib/demo/log")
+        # the destination gets the service before the source loses it
+        deploys = admin.succeed("cat /tmp/deploys").splitlines()
+        assert len(deploys) == 2 and "#dest " in deploys[0] and "#source " in deploys[1], deploys
+
+    with subtest("ownership follows the user name, not the uid"):
+        owner = dest.succeed("stat -c '%U %u' /nix/persist/var/lib/demo/data").strip()
+        assert owner == "demo 1600", owner
+
+    with subtest("a service the source does not run is refused"):
+        admin.fail("doomctl migrate -inventory /etc/doomlab-inventory.json -edit=false -deploy=false missing source dest")
+  '';
+}
@@ -0,0 +1,160 @@
+{
+  hostPkgs,
+  lib,
+  ...
+}: let
+  # Configurations that must not evaluate, with the assertion each one trips
+  broken = {
+    "parent eth9 must be declared" = {
+      vlans.cameras = {
+        id = 10;
+        parent = "eth9";
+      };
+    };
+    "eth1 is in a bridge or bond" = {
+      interfaces.eth1.addresses = ["192.168.1.1/24"];
+      bridges.br0.interfaces = ["eth1"];
+    };
+    "VLAN 10 is tagged on eth1 twice" = {
+      interfaces.eth1 = {};
+      vlans.a = {
+        id = 10;
+        parent = "eth1";
+      };
+      vlans.b = {
+        id = 10;
+        parent = "eth1";
+      };
+    };
+    "gateway 10.0.0.1 of eth1 is not in any of its subnets" = {
+      interfaces.eth1 = {
+        addresses = ["192.168.1.2/24"];
+        gateway = "10.0.0.1";
+      };
+    };
+    "eth1, eth2 have overlapping subnets" = {
+      interfaces.eth1.addresses = ["192.168.0.1/16"];
+      interfaces.eth2.addresses = ["192.168.1.1/24"];
+    };
+    "gateway6 fd00:2::1 of eth1 is neither link-local nor in any of its subnets" = {
+      interfaces.eth1 = {
+        addresses = ["fd00:1::2/64"];
+        gateway6 = "fd00:2::1";
+      };
+    };
+    "eth2, eth3 have overlapping subnets" = {
+      interfaces.eth2.addresses = ["fd00:1::1/48"];
+      interfaces.eth3.addresses = ["fd00:1:0:1::1/64"];
+    };
+    "an interface can be in only one bridge or bond" = {
+      bridges.br0.interfaces = ["eth1"];
+      bonds.bond0.interfaces = ["eth1"];
+    };
+  };
+
+  failures = network:
+    map (a: a.message) (lib.filter (a: lib.hasPrefix "doomlab.network" a.message && !a.assertion) (import "${hostPkgs.path}/nixos/lib/eval-config.nix" {
+        system = null;
+        modules = [
+          ./../modules/nixos/network.nix
+          {
+            nixpkgs.hostPlatform = hostPkgs.stdenv.hostPlatform.system;
+            doomlab.network = network;
+          }
+        ];
+      })
+      .config
+      .assertions);
+
+  # The test driver addresses eth1 and up itself; these nodes leave that to
+  # doomlab.network and run dual-stack
+  node = network: {
+    imports = [./../modules/nixos/network.nix];
+    networking.interfaces = lib.mkForce {};
+    networking.firewall.enable = false;
+    doomlab.network = network;
+  };
+in {
+  name = "network";
+
+  nodes = {
+    # eth2 and eth3 are both on the second switch, bonded for failover
+    server = {
+      virtualisation.vlans = [1 2 2];
+      # the router on the first switch, advertising a prefix for SLAAC
+      systemd.network.networks."30-eth1" = {
+        networkConfig.IPv6SendRA = true;
+        ipv6Prefixes = [{Prefix = "fd00:1::/64";}];
+      };
+      imports = [
+        (node {
+          interfaces.eth1.addresses = ["192.168.1.1/24" "fd00:1::1/64"];
+          vlans.cameras = {
+            id = 10;
+            parent = "eth1";
+            addresses = ["10.0.10.1/24"];
+          };
+          bonds.bond0.interfaces = ["eth2" "eth3"];
+          bridges.br0 = {
+            interfaces = ["bond0"];
+            addresses = ["192.168.2.1/24"];
+          };
+        })
+      ];
+    };
+
+    client = {
+      virtualisation.vlans = [1 2];
+      imports = [
+        (node {
+          interfaces.eth1 = {
+            addresses = ["192.168.1.2/24"];
+            gateway = "192.168.1.1";
+          };
+          vlans.cameras = {
+            id = 10;
+            parent = "eth1";
+            addresses = ["10.0.10.2/24"];
+          };
+          interfaces.eth2.addresses = ["192.168.2.2/24"];
+        })
+      ];
+    };
+  };
+
+  testScript = ''
+    import json
+
+    start_all()
+    server.wait_for_unit("systemd-networkd.service")
+    client.wait_for_unit("systemd-networkd.service")
+
+    with subtest("static addresses"):
+        client.wait_until_succeeds("ping -c1 -W1 192.168.1.1")
+        client.succeed("ip route show default | grep -q 'via 192.168.1.1'")
+
+    with subtest("SLAAC from router advertisements"):
+        client.wait_until_succeeds("ip -6 addr show eth1 scope global | grep -q 'inet6 fd00:1:'")
+        client.wait_until_succeeds("ip -6 route show default | grep -q 'via fe80:'")
+        client.succeed("ping -c1 -W1 fd00:1::1")
+
+    with subtest("VLAN subinterfaces"):
+        server.succeed("ip -d link show cameras | grep -q 'vlan protocol 802.1Q id 10'")
+        client.wait_until_succeeds("ping -c1 -W1 10.0.10.1")
+
+    with subtest("bridge on a bond"):
+        server.succeed("ip -d link show bond0 | grep -q 'master br0'")
+        server.succeed("grep -q 'Bonding Mode: fault-tolerance (active-backup)' /proc/net/bonding/bond0")
+        client.wait_until_succeeds("ping -c1 -W1 192.168.2.1")
+
+    with subtest("bond fails over"):
+        active = server.succeed("sed -n 's/^Currently Active Slave: //p' /proc/net/bonding/bond0").strip()
+        server.succeed(f"ip link set {active} down")
+        server.wait_until_succeeds(f"! grep -q 'Currently Active Slave: {active}' /proc/net/bonding/bond0")
+        client.wait_until_succeeds("ping -c1 -W1 192.168.2.1")
+
+    with subtest("bad configurations do not evaluate"):
+        for expected, messages in json.loads('${builtins.toJSON (lib.mapAttrs (_: failures) broken)}').items():
+            assert any(expected in m for m in messages), f"{expected!r} not in {messages}"
+  '';
+}
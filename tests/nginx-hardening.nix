@@ -0,0 +1,67 @@
+{
+  name = "nginx-hardening";
+
+  nodes = {
+    server = {
+      config,
+      pkgs,
+      ...
+    }: {
+      imports = [
+        ./../services/_nginx.nix
+      ];
+
+      services.nginx.virtualHosts."web.test" = {
+        default = true;
+        root = pkgs.writeTextDir "index.html" "ok";
+        # a location with headers of its own keeps the server's
+        locations."/api/".extraConfig = ''
+          add_header Cache-Control "no-store" always;
+          include ${config.doomlab.nginx.hardening."web.test".headersSnippet};
+          return 200 "api";
+        '';
+      };
+
+      doomlab.nginx.hardening."web.test".rateLimit = {
+        rate = "1r/s";
+        burst = 1;
+      };
+
+      networking.firewall.allowedTCPPorts = [80];
+    };
+
+    client = {pkgs, ...}: {
+      environment.systemPackages = [pkgs.curl];
+    };
+  };
+
+  testScript = ''
+    start_all()
+    server.wait_for_unit("nginx.service")
+    server.wait_for_unit("fail2ban.service")
+    server.wait_for_open_port(80)
+    client.wait_for_unit("multi-user.target")
+
+    with subtest("security headers are sent"):
+        headers = client.succeed("curl --silent --head http://server/")
+        assert "Strict-Transport-Security" in headers, headers
+        headers = client.succeed("curl --silent --head http://server/api/")
+        assert "Strict-Transport-Security" in headers and "Cache-Control" in headers, headers
+
+    with subtest("scanners are refused"):
+        client.succeed("curl --silent --output /dev/null --write-out '%{http_code}' --user-agent sqlmap/1.8 http://server/ | grep -qx 403")
+
+    with subtest("bursts are rate limited"):
+        codes = client.succeed(
+            "for i in $(seq 30); do curl --silent --output /dev/null --write-out '%{http_code}\\n' http://server/; done"
+        )
+        assert "429" in codes, codes
+
+    with subtest("repeat offenders are banned"):
+        server.wait_until_succeeds(
+            "fail2ban-client status nginx-limit-req | grep -q 'Banned IP list:.*[0-9]'",
+            timeout=60,
+        )
+        client.fail("curl --silent --max-time 5 http://server/")
+  '';
+}
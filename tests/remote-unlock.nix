@@ -0,0 +1,108 @@
+{hostPkgs, ...}: let
+  # The admin's login key, and the initrd's host key, which has to be in the
+  # store for the boot loader to add it to the initrd here
+  keys = import (hostPkgs.path + "/nixos/tests/ssh-keys.nix") hostPkgs;
+  hostKey = hostPkgs.runCommand "test-initrd-host-key" {nativeBuildInputs = [hostPkgs.openssh];} ''
+    mkdir $out
+    ssh-keygen -q -t ed25519 -N "" -f $out/ssh_host_ed25519_key
+  '';
+in {
+  name = "remote-unlock";
+
+  nodes = {
+    # Boots once unencrypted to set up the LUKS disks, then from them like
+    # the servers, with two devices and one passphrase
+    server = {lib, ...}: {
+      imports = [
+        (hostPkgs.path + "/nixos/tests/common/auto-format-root-device.nix")
+        ./../modules/nixos/remote-unlock.nix
+      ];
+
+      users.users.orther = {
+        isNormalUser = true;
+        openssh.authorizedKeys.keys = [keys.snakeOilPublicKey];
+      };
+      boot.initrd.network.ssh.hostKeys = lib.mkForce ["${hostKey}/ssh_host_ed25519_key"];
+      # Nothing hands out IPv4 addresses here
+      doomlab.remoteUnlock.dhcp4 = false;
+
+      virtualisation = {
+        emptyDiskImages = [512 512];
+        useBootLoader = true;
+        useEFIBoot = true;
+      };
+      boot.loader.systemd-boot.enable = true;
+
+      specialisation.boot-luks.configuration = {
+        boot.initrd.luks = {
+          reusePassphrases = true;
+          devices = lib.mkVMOverride {
+            cryptroot.device = "/dev/vdb";
+            cryptdata.device = "/dev/vdc";
+          };
+        };
+        virtualisation.rootDevice = "/dev/mapper/cryptroot";
+      };
+    };
+
+    # The LAN router: advertises the prefix the initrd takes its address from
+    client = {pkgs, ...}: {
+      networking.interfaces.eth1.ipv6.addresses = [
+        {
+          address = "fd00:2::1";
+          prefixLength = 64;
+        }
+      ];
+      boot.kernel.sysctl."net.ipv6.conf.all.forwarding" = true;
+      services.radvd = {
+        enable = true;
+        config = ''
+          interface eth1 {
+            AdvSendAdvert on;
+            prefix fd00:2::/64 {
+              AdvOnLink on;
+              AdvAutonomous on;
+            };
+          };
+        '';
+      };
+      environment.systemPackages = [pkgs.netcat];
+    };
+  };
+
+  testScript = ''
+    start_all()
+    server.wait_for_unit("multi-user.target")
+    client.wait_for_unit("radvd.service")
+    client.succeed("install -D -m 600 ${keys.snakeOilPrivateKey} /root/.ssh/id_ecdsa")
+
+    # The initrd's SLAAC address in the advertised prefix, from the MAC
+    mac = [int(o, 16) for o in server.succeed("cat /sys/class/net/eth1/address").strip().split(":")]
+    mac[0] ^= 2
+    eui = mac[:3] + [0xFF, 0xFE] + mac[3:]
+    address = "fd00:2::" + ":".join(f"{eui[i] << 8 | eui[i + 1]:x}" for i in range(0, 8, 2))
+
+    server.succeed(
+        "echo -n supersecret | cryptsetup luksFormat -q --iter-time=1 /dev/vdb -",
+        "echo -n supersecret | cryptsetup luksFormat -q --iter-time=1 /dev/vdc -",
+        "bootctl set-default nixos-generation-1-specialisation-boot-luks.conf",
+        "sync",
+    )
+    server.crash()
+    server.start()
+    server.wait_for_console_text("Passphrase for")
+
+    with subtest("the prompt is reachable over SLAAC without IPv4"):
+        client.wait_until_succeeds(f"nc -z -w 2 {address} 22", timeout=120)
+
+    with subtest("one passphrase over SSH unlocks both devices"):
+        # cryptsetup-askpass exits non-zero once nothing asks any more
+        client.execute(
+            "printf 'supersecret\\n' | ssh -T -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null"
+            f" root@{address}"
+        )
+        server.wait_for_unit("multi-user.target")
+        assert "/dev/mapper/cryptroot on / type ext4" in server.succeed("mount")
+        server.succeed("test -b /dev/mapper/cryptdata")
+  '';
+}
@@ -0,0 +1,62 @@
+{
+  name = "resources";
+
+  nodes.server = {
+    inputs,
+    pkgs,
+    ...
+  }: {
+    imports = [
+      inputs.impermanence.nixosModules.impermanence
+      inputs.sops-nix.nixosModules.sops
+      ./../modules/nixos/resources.nix
+      ./../services/_registry.nix
+    ];
+
+    # A service with a backup job, like the ones in services/
+    doomlab.services.demo = {
+      description = "Service with a budget and a backup";
+      units = ["demo.service"];
+      backups = ["/var/lib/demo"];
+    };
+
+    doomlab.resources.classes.interactive = {
+      memoryMax = "256M";
+      # listed twice, as two modules sharing a unit would
+      units = ["demo.service" "demo.service"];
+    };
+
+    systemd.services = {
+      demo = {
+        wantedBy = ["multi-user.target"];
+        serviceConfig.ExecStart = "${pkgs.coreutils}/bin/sleep infinity";
+      };
+      # Long running so the test can look at its cgroup
+      backup-demo.serviceConfig.ExecStart = "${pkgs.coreutils}/bin/sleep infinity";
+    };
+  };
+
+  testScript = ''
+    start_all()
+    server.wait_for_unit("demo.service")
+    server.succeed("systemctl start backup-demo.service")
+
+    def cgroup(unit):
+        pid = server.succeed(f"systemctl show --property MainPID --value {unit}").strip()
+        return server.succeed(f"cat /proc/{pid}/cgroup").strip().split("::", 1)[1]
+
+    with subtest("a unit runs in its class's slice"):
+        path = cgroup("demo.service")
+        assert path == "/doomlab.slice/doomlab-interactive.slice/demo.service", path
+        server.succeed("systemctl show --property ManagedOOMPreference --value demo.service | grep -qx avoid")
+
+    with subtest("the slice has the configured MemoryMax"):
+        server.succeed("systemctl show --property MemoryMax --value doomlab-interactive.slice | grep -qx 268435456")
+        server.succeed("grep -qx 268435456 /sys/fs/cgroup/doomlab.slice/doomlab-interactive.slice/memory.max")
+
+    with subtest("backup jobs of registered services land in the backups class"):
+        path = cgroup("backup-demo.service")
+        assert path == "/doomlab.slice/doomlab-backups.slice/backup-demo.service", path
+        server.fail("grep -qx max /sys/fs/cgroup/doomlab.slice/doomlab-backups.slice/memory.max")
+  '';
+}
@@ -0,0 +1,108 @@
+{
+  name = "scrypted-recordings";
+
+  nodes.server = {
+    inputs,
+    lib,
+    pkgs,
+    ...
+  }: {
+    imports = [
+      inputs.impermanence.nixosModules.impermanence
+      inputs.sops-nix.nixosModules.sops
+      ./../modules/nixos/resources.nix
+      ./../services/scrypted.nix
+    ];
+
+    # A 32 MiB loopback filesystem stands in for the NAS share, small enough
+    # to fill; the test script creates it before mounting
+    virtualisation.fileSystems."/mnt/nvr" = {
+      device = "/var/lib/nvr.img";
+      fsType = "ext4";
+      options = ["loop" "noauto"];
+    };
+    environment.systemPackages = [pkgs.e2fsprogs];
+
+    doomlab.scrypted.recordings = {
+      path = "/mnt/nvr";
+      retentionDays = 30;
+      minFreePercent = 10;
+    };
+
+    # Only the pruning: no container to pull, certificate or Kopia secret
+    virtualisation.oci-containers.containers = lib.mkForce {};
+    systemd.services.podman-scrypted = lib.mkForce {};
+    doomlab.acme.vhosts = lib.mkForce {};
+    services.nginx.virtualHosts.scrypted-tunnel = lib.mkForce {};
+    doomlab.nginx.clientCa.enable = false;
+    sops.secrets = lib.mkForce {};
+    systemd.services.backup-scrypted = lib.mkForce {};
+    systemd.timers.backup-scrypted = lib.mkForce {};
+  };
+
+  testScript = ''
+    start_all()
+    server.wait_for_unit("multi-user.target")
+    server.succeed(
+        "truncate --size 32M /var/lib/nvr.img",
+        "mkfs.ext4 -q -m 0 /var/lib/nvr.img",
+        "systemctl start mnt-nvr.mount",
+        # and something outside it the job must never touch
+        "mkdir -p /root/outside",
+        "touch --date '90 days ago' /root/outside/old.mp4",
+    )
+
+    def prune():
+        server.succeed("systemctl start scrypted-recordings-prune.service")
+
+    def used():
+        return int(server.succeed("df --output=pcent /mnt/nvr | tail -n 1 | tr -dc 0-9"))
+
+    with subtest("recordings past retention go, index and metadata stay"):
+        server.succeed(
+            "mkdir -p /mnt/nvr/camera/old /mnt/nvr/camera/new",
+            "touch --date '40 days ago' /mnt/nvr/camera/old/0001.mp4 /mnt/nvr/camera/old/0001.m4s",
+            "touch --date '40 days ago' /mnt/nvr/camera/index.json /mnt/nvr/camera/old/segments.db",
+            "touch --date '2 days ago' /mnt/nvr/camera/new/0002.mp4",
+            "ln -s /root/outside /mnt/nvr/camera/outside",
+        )
+        prune()
+        server.fail("test -e /mnt/nvr/camera/old/0001.mp4")
+        server.fail("test -e /mnt/nvr/camera/old/0001.m4s")
+        server.succeed(
+            "test -e /mnt/nvr/camera/new/0002.mp4",
+            "test -e /mnt/nvr/camera/index.json",
+            "test -e /mnt/nvr/camera/old/segments.db",
+            "test -e /root/outside/old.mp4",
+        )
+
+    with subtest("the oldest recordings go until minFreePercent is free, and no more"):
+        server.succeed("rm -rf /mnt/nvr/camera/new")
+        # 2 MiB recordings, an hour apart, until more than 90% is used
+        hour = 0
+        while used() <= 90:
+            hour += 1
+            server.succeed(
+                f"head --bytes 2M /dev/urandom > /mnt/nvr/camera/{hour:04}.mp4",
+                f"touch --date '{100 - hour} hours ago' /mnt/nvr/camera/{hour:04}.mp4",
+            )
+        # an older metadata file is not a recording to make room with
+        server.succeed("touch --date '200 hours ago' /mnt/nvr/camera/index.json")
+        prune()
+
+        assert used() <= 90, f"{used()}% used after pruning"
+        remaining = [
+            h for h in range(1, hour + 1)
+            if server.execute(f"test -e /mnt/nvr/camera/{h:04}.mp4")[0] == 0
+        ]
+        deleted = [h for h in range(1, hour + 1) if h not in remaining]
+        assert deleted and deleted == list(range(1, len(deleted) + 1)), f"deleted {deleted}, not the oldest"
+        # one recording frees well over the overshoot
+        assert len(deleted) <= 2, f"deleted {deleted} to get under 90%"
+        server.succeed(
+            "test -e /mnt/nvr/camera/index.json",
+            "test -e /mnt/nvr/camera/old/segments.db",
+            "test -e /root/outside/old.mp4",
+        )
+  '';
+}
@@ -0,0 +1,91 @@
+{hostPkgs, ...}: let
+  # Throwaway PKI so the test runs offline without sops keys
+  pki = hostPkgs.runCommand "test-internal-ca" {nativeBuildInputs = [hostPkgs.step-cli];} ''
+    mkdir $out
+    echo test-password > $out/password
+    step certificate create "Test Root CA" $out/root_ca.crt $out/root_ca.key \
+      --profile root-ca --no-password --insecure
+    step certificate create "Test Intermediate CA" $out/intermediate_ca.crt $out/intermediate_ca.key \
+      --profile intermediate-ca --ca $out/root_ca.crt --ca-key $out/root_ca.key \
+      --password-file $out/password
+  '';
+
+  common = {
+    inputs,
+    nodes,
+    ...
+  }: {
+    imports = [
+      inputs.impermanence.nixosModules.impermanence
+      inputs.sops-nix.nixosModules.sops
+      ./../services/_internal-ca.nix
+    ];
+
+    doomlab.internalCa.address = nodes.ca.networking.primaryIPv6Address;
+
+    networking.hosts.${nodes.web.networking.primaryIPv6Address} = ["web.doomlab.internal"];
+
+    security.pki.certificateFiles = ["${pki}/root_ca.crt"];
+  };
+in {
+  name = "step-ca";
+
+  nodes = {
+    ca = {lib, ...}: {
+      imports = [
+        common
+        ./../services/step-ca.nix
+      ];
+
+      doomlab.stepCa = {
+        enable = true;
+        pkiDir = pki;
+        intermediateKeyFile = "${pki}/intermediate_ca.key";
+        passwordFile = "${pki}/password";
+      };
+
+      sops.secrets = lib.mkForce {};
+    };
+
+    web = {
+      imports = [
+        common
+        ./../services/_acme.nix
+        ./../services/_nginx.nix
+      ];
+
+      doomlab.acme.vhosts."web.doomlab.internal" = "internal";
+      services.nginx.virtualHosts."web.doomlab.internal".locations."/".return = "200 'internal ok'";
+    };
+
+    client = {pkgs, ...}: {
+      imports = [common];
+      environment.systemPackages = [pkgs.curl pkgs.openssl];
+    };
+  };
+
+  testScript = {nodes, ...}: let
+    address = nodes.ca.networking.primaryIPv6Address;
+  in ''
+    # lego gives up until its daily timer if the CA is not up yet
+    ca.start()
+    ca.wait_for_unit("step-ca.service")
+    ca.wait_for_open_port(8443, "${address}")
+
+    web.start()
+    client.start()
+    web.wait_for_unit("acme-finished-web.doomlab.internal.target")
+
+    with subtest("step-ca only listens on its address"):
+        ca.succeed("ss -Hltn 'sport = :8443' | grep -q '\\[${address}\\]:8443'")
+        ca.fail("ss -Hltn 'sport = :8443' | grep -q -e '\\[::\\]:8443' -e '0.0.0.0:8443' -e '\\*:8443'")
+
+    with subtest("internal vhost serves a certificate from step-ca"):
+        client.succeed("curl --fail --silent https://web.doomlab.internal/ | grep -q 'internal ok'")
+        issuer = client.succeed(
+            "openssl s_client -connect web.doomlab.internal:443 -servername web.doomlab.internal </dev/null 2>/dev/null"
+            " | openssl x509 -noout -issuer"
+        )
+        assert "Test Intermediate CA" in issuer, issuer
+  '';
+}
@@ -0,0 +1,89 @@
+{hostPkgs, ...}: let
+  # Stands in for the sops secret
+  env = hostPkgs.writeText "vaultwarden-env" ''
+    ADMIN_TOKEN=test-admin-token
+  '';
+in {
+  name = "vaultwarden";
+
+  nodes.server = {
+    inputs,
+    lib,
+    pkgs,
+    ...
+  }: {
+    imports = [
+      inputs.impermanence.nixosModules.impermanence
+      inputs.sops-nix.nixosModules.sops
+      ./../modules/nixos/resources.nix
+      ./../services/vaultwarden.nix
+    ];
+
+    doomlab.vaultwarden = {
+      domain = "vault.test";
+      environmentFile = "${env}";
+    };
+
+    doomlab.acme.vhosts = lib.mkForce {};
+    sops.secrets = lib.mkForce {};
+    # the Kopia repository token is one of those secrets
+    systemd.services.backup-vaultwarden = lib.mkForce {};
+    systemd.timers.backup-vaultwarden = lib.mkForce {};
+
+    # The local relay; mail to example.com just queues
+    services.postfix = {
+      enable = true;
+      hostname = "server.test";
+    };
+
+    environment.systemPackages = [pkgs.curl pkgs.jq pkgs.sqlite];
+  };
+
+  testScript = ''
+    server.wait_for_unit("vaultwarden.service")
+    server.wait_for_unit("postfix.service")
+    server.wait_for_open_port(8222)
+
+    vw = "http://127.0.0.1:8222"
+
+    def admin(args):
+        return server.succeed(f"curl --silent --fail --cookie /tmp/jar --cookie-jar /tmp/jar {args}")
+
+    def login():
+        admin(f"--data token=test-admin-token {vw}/admin")
+
+    def users():
+        return server.succeed(f"curl --silent --fail --cookie /tmp/jar {vw}/admin/users | jq -r '.[].email'").split()
+
+    login()
+
+    with subtest("signups are closed, invitations go through the relay"):
+        server.succeed("tr '\\0' '\\n' < /proc/$(systemctl show -p MainPID --value vaultwarden)/environ | grep -qx SIGNUPS_ALLOWED=false")
+        admin(f"--header 'Content-Type: application/json' --data '{{\"email\":\"alice@example.com\"}}' {vw}/admin/invite")
+        server.wait_until_succeeds("journalctl -u postfix.service | grep -q 'to=<alice@example.com>'", timeout=60)
+        assert "alice@example.com" in users()
+
+    with subtest("the backup is a consistent private copy"):
+        server.succeed("vaultwarden-backup")
+        server.succeed("test \"$(stat -c %a /var/backup/vaultwarden)\" = 700")
+        server.succeed("sqlite3 /var/backup/vaultwarden/db.sqlite3 'PRAGMA integrity_check' | grep -qx ok")
+        server.succeed("sqlite3 /var/backup/vaultwarden/db.sqlite3 'SELECT email FROM users' | grep -qx alice@example.com")
+        server.succeed("test -e /var/backup/vaultwarden/rsa_key.pem")
+
+    with subtest("a lost account comes back from the backup"):
+        uuid = server.succeed(f"curl --silent --fail --cookie /tmp/jar {vw}/admin/users | jq -r '.[] | select(.email == \"alice@example.com\") | .id'").strip()
+        admin(f"--request POST {vw}/admin/users/{uuid}/delete")
+        assert "alice@example.com" not in users()
+
+        server.succeed("vaultwarden-restore")
+        server.wait_for_unit("vaultwarden.service")
+        server.wait_for_open_port(8222)
+        login()
+        assert "alice@example.com" in users(), "the restore did not bring the account back"
+        server.succeed("stat -c %U /var/lib/vaultwarden/db.sqlite3 | grep -qx vaultwarden")
+
+    with subtest("a missing backup is refused without touching the vault"):
+        server.fail("vaultwarden-restore /var/backup/nothing")
+        server.succeed("systemctl is-active vaultwarden.service")
+  '';
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/orther/doomlab/tools/internal/ca"
+	"github.com/orther/doomlab/tools/internal/sops"
+)
+
+const day = 24 * time.Hour
+
+type caFlags struct {
+	dir     string
+	keyFile string
+}
+
+func (f *caFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.dir, "dir", "pki/client-ca", "directory holding the public CA certificate, CRL and device registry")
+	fs.StringVar(&f.keyFile, "key", "secrets/client-ca.key", "sops encrypted CA private key")
+}
+
+func runCA(args []string) error {
+	return subcommands("ca", args, []command{
+		{"init", "create the certificate authority", caInit},
+		{"issue", "issue a device certificate and export it as PKCS#12", caIssue},
+		{"revoke", "revoke a device's certificates and regenerate the CRL", caRevoke},
+		{"crl", "regenerate the CRL", caCRL},
+		{"list", "list issued device certificates", caList},
+	})
+}
+
+func caInit(args []string) error {
+	var f caFlags
+	fs := flag.NewFlagSet("ca init", flag.ContinueOnError)
+	f.register(fs)
+	name := fs.String("name", "doomlab client CA", "CA common name")
+	years := fs.Int("years", 10, "CA validity in years")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := ca.Init(f.dir, f.keyFile, *name, time.Duration(*years)*365*day); err != nil {
+		return err
+	}
+	fmt.Printf("created %s in %s with key %s\ncommit both, then deploy the nginx hosts\n", *name, f.dir, f.keyFile)
+	return nil
+}
+
+func caIssue(args []string) error {
+	var f caFlags
+	fs := flag.NewFlagSet("ca issue", flag.ContinueOnError)
+	f.register(fs)
+	secrets := fs.String("secrets", "secrets/secrets.yaml", "sops file holding PKCS#12 passwords under client-ca/<device>")
+	days := fs.Int("days", 825, "certificate validity in days")
+	out := fs.String("out", "", "PKCS#12 output path (default <device>.p12)")
+	legacy := fs.Bool("legacy", false, "use SHA1/3DES encryption for clients that cannot read modern PKCS#12")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: doomctl ca issue [flags] <device>")
+	}
+	device := fs.Arg(0)
+	if *out == "" {
+		*out = device + ".p12"
+	}
+
+	password, err := sops.Extract(*secrets, "client-ca", device)
+	if err != nil {
+		return fmt.Errorf("no password for %s; add client-ca/%s with `just sopsedit`: %w", device, device, err)
+	}
+	authority, err := ca.Load(f.dir, f.keyFile)
+	if err != nil {
+		return err
+	}
+	issued, certPEM, keyPEM, err := authority.Issue(device, time.Duration(*days)*day)
+	if err != nil {
+		return err
+	}
+	// Only a certificate whose key made it into the PKCS#12 is registered
+	if err := ca.ExportPKCS12(*out, device, certPEM, keyPEM, authority.CertPEM(), password, *legacy); err != nil {
+		return err
+	}
+	if err := authority.Register(issued); err != nil {
+		os.Remove(*out)
+		return err
+	}
+	fmt.Printf("wrote %s; install it on %s and delete the file\n", *out, device)
+	return nil
+}
+
+func caRevoke(args []string) error {
+	var f caFlags
+	fs := flag.NewFlagSet("ca revoke", flag.ContinueOnError)
+	f.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: doomctl ca revoke [flags] <device>")
+	}
+	authority, err := ca.Load(f.dir, f.keyFile)
+	if err != nil {
+		return err
+	}
+	n, err := authority.Revoke(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("revoked %d certificate(s) for %s; commit %s and deploy the nginx hosts\n", n, fs.Arg(0), f.dir)
+	return nil
+}
+
+func caCRL(args []string) error {
+	var f caFlags
+	fs := flag.NewFlagSet("ca crl", flag.ContinueOnError)
+	f.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	authority, err := ca.Load(f.dir, f.keyFile)
+	if err != nil {
+		return err
+	}
+	return authority.WriteCRL()
+}
+
+func caList(args []string) error {
+	var f caFlags
+	fs := flag.NewFlagSet("ca list", flag.ContinueOnError)
+	f.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	authority, err := ca.LoadPublic(f.dir)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DEVICE\tSERIAL\tEXPIRES\tSTATUS")
+	for _, d := range authority.Devices() {
+		status := "active"
+		switch {
+		case d.RevokedAt != nil:
+			status = "revoked " + d.RevokedAt.Format(time.DateOnly)
+		case !d.Active(now):
+			status = "expired"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", d.Name, d.Serial, d.NotAfter.Format(time.DateOnly), status)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	next, err := authority.CRLNextUpdate()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\nCRL valid until %s", next.Format(time.DateOnly))
+	if next.Sub(now) < 30*day {
+		fmt.Print(" (regenerate it with `doomctl ca crl` soon)")
+	}
+	fmt.Println()
+	return nil
+}
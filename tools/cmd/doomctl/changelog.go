@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/orther/doomlab/tools/internal/changelog"
+	"github.com/orther/doomlab/tools/internal/fleet"
+	"github.com/orther/doomlab/tools/internal/nix"
+)
+
+func runChangelog(args []string) error {
+	fs := flag.NewFlagSet("changelog", flag.ContinueOnError)
+	oldRev := fs.String("old", "HEAD", "git revision holding the flake.lock before the bump")
+	newRev := fs.String("new", "", "git revision holding the flake.lock after the bump (default the working tree)")
+	build := fs.Bool("build", true, "build the hosts this machine can build, for package changes and closure sizes")
+	format := fs.String("format", "markdown", "output format: markdown or json")
+	out := fs.String("o", "", "write the changelog to this file instead of stdout")
+	jobs := fs.Int("j", 1, "hosts to compare at once")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *format != "markdown" && *format != "json" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	tmp, err := os.MkdirTemp("", "doomctl-changelog-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	oldLock, err := lockAt(*oldRev, filepath.Join(tmp, "old.lock"))
+	if err != nil {
+		return err
+	}
+	newLock, err := lockAt(*newRev, filepath.Join(tmp, "new.lock"))
+	if err != nil {
+		return err
+	}
+
+	var report changelog.Report
+	if report.Inputs, err = changelog.Inputs(oldLock.data, newLock.data); err != nil {
+		return err
+	}
+	if len(report.Inputs) > 0 {
+		all, err := fleet.Hosts(ctx, ".")
+		if err != nil {
+			return err
+		}
+		hosts, unknown := fleet.Select(all, fs.Args())
+		if len(unknown) > 0 {
+			return fmt.Errorf("unknown hosts: %s", strings.Join(unknown, ", "))
+		}
+		var local string
+		if err := nix.JSON(ctx, &local, "eval", "--impure", "--json", "--expr", "builtins.currentSystem"); err != nil {
+			return err
+		}
+
+		report.Hosts = make([]changelog.Host, len(hosts))
+		sem := make(chan struct{}, max(*jobs, 1))
+		var wg sync.WaitGroup
+		for i, h := range hosts {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+				// Other systems are only evaluated: their toplevel and
+				// kernel still show whether they change.
+				report.Hosts[i] = changelog.Compare(ctx, ".", h, oldLock.path, newLock.path, *build && h.System == local)
+			}()
+		}
+		wg.Wait()
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	if *format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	return changelog.WriteMarkdown(w, report)
+}
+
+type lockFile struct {
+	path string
+	data []byte
+}
+
+// lockAt copies the flake.lock of a git revision, or of the working tree
+// when rev is empty, to path.
+func lockAt(rev, path string) (lockFile, error) {
+	var data []byte
+	var err error
+	if rev == "" {
+		data, err = os.ReadFile("flake.lock")
+	} else {
+		var stderr bytes.Buffer
+		cmd := exec.Command("git", "show", rev+":flake.lock")
+		cmd.Stderr = &stderr
+		if data, err = cmd.Output(); err != nil {
+			err = fmt.Errorf("git show %s:flake.lock: %w: %s", rev, err, strings.TrimSpace(stderr.String()))
+		}
+	}
+	if err != nil {
+		return lockFile{}, err
+	}
+	return lockFile{path, data}, os.WriteFile(path, data, 0o600)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/orther/doomlab/tools/internal/fleet"
+	"github.com/orther/doomlab/tools/internal/nix"
+	"github.com/orther/doomlab/tools/internal/remote"
+)
+
+const driftScript = `
+echo "toplevel=$(readlink -f /run/current-system)"
+echo "revision=$(cat /etc/doomlab-revision 2>/dev/null)"
+if command -v systemctl >/dev/null 2>&1; then
+  echo "upgrade=$(systemctl show -p Result --value nixos-upgrade.service 2>/dev/null)"
+fi
+`
+
+type drift struct {
+	host     fleet.Host
+	status   string
+	running  string
+	expected string
+	revision *fleet.Revision
+	upgrade  string
+	diff     string
+	err      error
+}
+
+func runDrift(args []string) error {
+	fs := flag.NewFlagSet("drift", flag.ContinueOnError)
+	flake := fs.String("flake", "github:orther/doomlab", "flake the hosts should be running, as pulled by auto-update")
+	var ssh remote.Options
+	ssh.Register(fs)
+	diff := fs.Bool("diff", true, "print closure diffs for drifted hosts; builds the expected systems and copies the running ones")
+	jobs := fs.Int("j", runtime.NumCPU(), "hosts to check at once")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	head, err := fleet.Metadata(ctx, *flake)
+	if err != nil {
+		return err
+	}
+	all, err := fleet.Hosts(ctx, *flake)
+	if err != nil {
+		return err
+	}
+	hosts, unknown := fleet.Select(all, fs.Args())
+	if len(unknown) > 0 {
+		return fmt.Errorf("unknown hosts: %s", strings.Join(unknown, ", "))
+	}
+
+	results := make([]drift, len(hosts))
+	sem := make(chan struct{}, max(*jobs, 1))
+	var wg sync.WaitGroup
+	for i, h := range hosts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i] = checkDrift(ctx, ssh, *flake, h, head, *diff)
+		}()
+	}
+	wg.Wait()
+
+	fmt.Printf("%s is at %s\n\n", *flake, head.Short())
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tSTATUS\tREVISION\tUPGRADE\tRUNNING")
+	drifted := 0
+	for _, r := range results {
+		if r.status != "current" {
+			drifted++
+		}
+		rev := "-"
+		if r.revision != nil {
+			rev = r.revision.Short()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.host.Name, r.status, rev, orDash(r.upgrade), orDash(r.running))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	for _, r := range results {
+		switch {
+		case r.err != nil:
+			fmt.Printf("\n%s: %v\n", r.host.Name, r.err)
+		case r.diff != "":
+			fmt.Printf("\n%s: %s -> %s\n%s", r.host.Name, r.running, r.expected, r.diff)
+		}
+	}
+
+	if drifted > 0 {
+		return fmt.Errorf("%d of %d hosts are not running %s", drifted, len(results), head.Short())
+	}
+	return nil
+}
+
+func checkDrift(ctx context.Context, ssh remote.Options, flake string, h fleet.Host, head fleet.Revision, diff bool) drift {
+	r := drift{host: h}
+	if h.Err != nil {
+		r.status, r.err = "eval failed", h.Err
+		return r
+	}
+	if err := nix.Eval(ctx, flake, h.Toplevel()+".outPath", &r.expected); err != nil {
+		r.status, r.err = "eval failed", err
+		return r
+	}
+	out, err := ssh.Run(ctx, h.Hostname, driftScript)
+	if err != nil {
+		r.status, r.err = "unreachable", err
+		return r
+	}
+	fields := remote.Fields(out)
+	r.running = fields["toplevel"]
+	switch fields["upgrade"] {
+	case "":
+	case "success":
+		r.upgrade = "ok"
+	default:
+		r.upgrade = "failed (" + fields["upgrade"] + ")"
+	}
+	if raw := fields["revision"]; raw != "" {
+		var rev fleet.Revision
+		if err := json.Unmarshal([]byte(raw), &rev); err == nil {
+			r.revision = &rev
+		}
+	}
+
+	switch {
+	case r.running == r.expected:
+		r.status = "current"
+		return r
+	case r.revision == nil:
+		r.status = "unknown revision"
+	case r.revision.Dirty:
+		r.status = "dirty tree"
+	case r.revision.Rev != head.Rev:
+		r.status = "other revision"
+	default:
+		// Same commit, different closure: built with overridden inputs
+		// or from an impure evaluation.
+		r.status = "diverged"
+	}
+
+	if diff {
+		r.diff, r.err = closureDiff(ctx, ssh, flake, h, r.running, r.expected)
+	}
+	return r
+}
+
+// closureDiff realises the expected system locally, copies the running one
+// from the host and compares the two.
+func closureDiff(ctx context.Context, ssh remote.Options, flake string, h fleet.Host, running, expected string) (string, error) {
+	if _, err := nix.Run(ctx, "build", "--no-link", flake+"#"+h.Toplevel()); err != nil {
+		return "", err
+	}
+	// Hosts build their own systems on auto-upgrade and sign nothing, so
+	// the running closure is only accepted without signatures
+	if _, err := nix.Run(ctx, "copy", "--no-check-sigs", "--from", "ssh-ng://"+ssh.Target(h.Hostname), running); err != nil {
+		return "", err
+	}
+	out, err := nix.Run(ctx, "store", "diff-closures", running, expected)
+	return string(out), err
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/orther/doomlab/tools/internal/fleet"
+	"github.com/orther/doomlab/tools/internal/remote"
+)
+
+// selection picks hosts by name, role or service, shared by exec and
+// journal.
+type selection struct {
+	flake    string
+	hosts    string
+	roles    string
+	services string
+	ssh      remote.Options
+	sudo     bool
+	jobs     int
+	timeout  time.Duration
+	json     bool
+}
+
+func (s *selection) register(fs *flag.FlagSet) {
+	fs.StringVar(&s.flake, "flake", ".", "flake listing the hosts")
+	fs.StringVar(&s.hosts, "hosts", "", "comma separated host names (default all)")
+	fs.StringVar(&s.roles, "role", "", "comma separated roles the hosts must have, e.g. server")
+	fs.StringVar(&s.services, "service", "", "comma separated doomlab.services the hosts must run")
+	s.ssh.Register(fs)
+	fs.BoolVar(&s.sudo, "sudo", false, "run as root with sudo, as deploys do")
+	fs.IntVar(&s.jobs, "j", 8, "hosts to run on at once")
+	fs.DurationVar(&s.timeout, "timeout", 0, "give up on a host after this long (default no limit)")
+	fs.BoolVar(&s.json, "json", false, "print one JSON result per host instead of streaming")
+}
+
+func (s *selection) resolve(ctx context.Context) ([]fleet.Host, error) {
+	all, err := fleet.Hosts(ctx, s.flake)
+	if err != nil {
+		return nil, err
+	}
+	selected, unknown := fleet.Select(all, splitList(s.hosts))
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("unknown hosts: %s", strings.Join(unknown, ", "))
+	}
+	// their roles and services are unknown, so they match no selection
+	var hosts []fleet.Host
+	for _, h := range selected {
+		if h.Err != nil {
+			fmt.Fprintf(os.Stderr, "skipping %s: %v\n", h.Name, h.Err)
+			continue
+		}
+		hosts = append(hosts, h)
+	}
+	hosts = fleet.Filter(hosts, splitList(s.roles), splitList(s.services))
+	if len(hosts) == 0 {
+		return nil, errors.New("no hosts match the selection")
+	}
+	return hosts, nil
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func runExec(args []string) error {
+	var sel selection
+	fs := flag.NewFlagSet("exec", flag.ContinueOnError)
+	sel.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: doomctl exec [flags] -- <command> [arguments]")
+		fmt.Fprintln(fs.Output(), "\nA single argument is run as a shell snippet, several are quoted as one command.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	script := fs.Arg(0)
+	if fs.NArg() > 1 {
+		script = quoteArgs(fs.Args())
+	}
+	return sel.run(func(fleet.Host) (string, error) { return script, nil })
+}
+
+func runJournal(args []string) error {
+	var sel selection
+	fs := flag.NewFlagSet("journal", flag.ContinueOnError)
+	sel.register(fs)
+	units := fs.String("u", "", "comma separated units (default the units of -service)")
+	since := fs.String("since", "", "show entries since, e.g. \"1h ago\" or \"today\"")
+	until := fs.String("until", "", "show entries until")
+	lines := fs.Int("n", 50, "number of entries per host")
+	priority := fs.String("p", "", "priority filter, e.g. err or warning..err")
+	grep := fs.String("g", "", "only entries whose message matches this pattern")
+	follow := fs.Bool("f", false, "keep streaming new entries")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments %q", fs.Args())
+	}
+
+	base := []string{"journalctl", "--no-pager", "--output=short-iso", "-n", strconv.Itoa(*lines)}
+	for _, opt := range [][2]string{{"--since", *since}, {"--until", *until}, {"-p", *priority}, {"-g", *grep}} {
+		if opt[1] != "" {
+			base = append(base, opt[0], opt[1])
+		}
+	}
+	if *follow {
+		base = append(base, "-f")
+	}
+
+	return sel.run(func(h fleet.Host) (string, error) {
+		wanted := splitList(*units)
+		if len(wanted) == 0 {
+			for _, s := range splitList(sel.services) {
+				wanted = append(wanted, h.Units[s]...)
+			}
+		}
+		if len(wanted) == 0 && sel.services != "" {
+			return "", fmt.Errorf("%s declares no units for %s", h.Name, sel.services)
+		}
+		cmd := append([]string(nil), base...)
+		for _, u := range wanted {
+			cmd = append(cmd, "-u", u)
+		}
+		return quoteArgs(cmd), nil
+	})
+}
+
+type execResult struct {
+	Host     string  `json:"host"`
+	ExitCode int     `json:"exitCode"`
+	Stdout   string  `json:"stdout"`
+	Stderr   string  `json:"stderr"`
+	Error    string  `json:"error,omitempty"`
+	Seconds  float64 `json:"seconds"`
+}
+
+// run runs the script built for each selected host, streaming output with
+// a host prefix or collecting it as JSON, and fails unless every host
+// exits 0.
+func (s *selection) run(build func(fleet.Host) (string, error)) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	hosts, err := s.resolve(ctx)
+	if err != nil {
+		return err
+	}
+
+	width := 0
+	for _, h := range hosts {
+		width = max(width, len(h.Name))
+	}
+	var mu sync.Mutex // serialises writes to stdout and stderr
+	results := make([]execResult, len(hosts))
+	sem := make(chan struct{}, max(s.jobs, 1))
+	var wg sync.WaitGroup
+	for i, h := range hosts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i] = s.runOne(ctx, h, build, width, &mu)
+		}()
+	}
+	wg.Wait()
+
+	if s.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			return err
+		}
+	}
+	failed := 0
+	for _, r := range results {
+		if r.ExitCode != 0 {
+			failed++
+			if !s.json {
+				msg := "exit " + strconv.Itoa(r.ExitCode)
+				if r.Error != "" {
+					msg = r.Error
+				}
+				fmt.Fprintf(os.Stderr, "%-*s | %s\n", width, r.Host, msg)
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed on %d of %d hosts", failed, len(results))
+	}
+	return nil
+}
+
+func (s *selection) runOne(ctx context.Context, h fleet.Host, build func(fleet.Host) (string, error), width int, mu *sync.Mutex) execResult {
+	r := execResult{Host: h.Name}
+	script, err := build(h)
+	if err != nil {
+		r.ExitCode, r.Error = -1, err.Error()
+		return r
+	}
+	if s.sudo {
+		script = "exec sudo -n sh -c " + remote.Quote(script)
+	}
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+
+	var stdout, stderr io.Writer
+	var outBuf, errBuf bytes.Buffer
+	if s.json {
+		stdout, stderr = &outBuf, &errBuf
+	} else {
+		prefix := fmt.Sprintf("%-*s | ", width, h.Name)
+		outLines := &prefixWriter{w: os.Stdout, prefix: prefix, mu: mu}
+		errLines := &prefixWriter{w: os.Stderr, prefix: prefix, mu: mu}
+		defer outLines.Flush()
+		defer errLines.Flush()
+		stdout, stderr = outLines, errLines
+	}
+
+	start := time.Now()
+	r.ExitCode, err = s.ssh.Stream(ctx, h.Hostname, script, stdout, stderr)
+	r.Seconds = time.Since(start).Seconds()
+	r.Stdout, r.Stderr = outBuf.String(), errBuf.String()
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r
+}
+
+// prefixWriter writes complete lines to w, each starting with prefix.
+type prefixWriter struct {
+	w      io.Writer
+	prefix string
+	mu     *sync.Mutex
+	buf    []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+		p.emit(p.buf[:i+1])
+		p.buf = p.buf[i+1:]
+	}
+}
+
+// Flush writes a trailing line that did not end in a newline.
+func (p *prefixWriter) Flush() {
+	if len(p.buf) > 0 {
+		p.emit(append(p.buf, '\n'))
+		p.buf = nil
+	}
+}
+
+func (p *prefixWriter) emit(line []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	w := bufio.NewWriter(p.w)
+	w.WriteString(p.prefix)
+	w.Write(line)
+	w.Flush()
+}
+
+func quoteArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = remote.Quote(a)
+	}
+	return strings.Join(quoted, " ")
+}
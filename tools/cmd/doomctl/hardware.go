@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+
+	"github.com/orther/doomlab/tools/internal/facter"
+	"github.com/orther/doomlab/tools/internal/fleet"
+	"github.com/orther/doomlab/tools/internal/remote"
+)
+
+func runHardware(args []string) error {
+	fs := flag.NewFlagSet("hardware", flag.ContinueOnError)
+	flake := fs.String("flake", ".", "flake listing the hosts")
+	var ssh remote.Options
+	ssh.Register(fs)
+	address := fs.String("address", "", "reach the host at this address instead of its hostname")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: doomctl hardware [flags] <host>...")
+		fmt.Fprintln(fs.Output(), "\nWrites machines/<host>/facter.json from nixos-facter run on each host.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	if *address != "" && fs.NArg() > 1 {
+		return fmt.Errorf("-address needs a single host")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var hosts []fleet.Host
+	if *address != "" {
+		hosts = []fleet.Host{{Name: fs.Arg(0), Hostname: *address}}
+	} else {
+		all, err := fleet.Hosts(ctx, *flake)
+		if err != nil {
+			return err
+		}
+		var unknown []string
+		if hosts, unknown = fleet.Select(all, fs.Args()); len(unknown) > 0 {
+			return fmt.Errorf("unknown hosts: %s", strings.Join(unknown, ", "))
+		}
+	}
+
+	for _, h := range hosts {
+		dir := filepath.Join("machines", h.Name)
+		if _, err := os.Stat(dir); err != nil {
+			return err
+		}
+		report, err := facter.Capture(ctx, ssh, h.Hostname)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, "facter.json")
+		if err := os.WriteFile(path, report, 0o644); err != nil {
+			return err
+		}
+		s, err := facter.Parse(report)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("wrote %s: %s", path, s.System)
+		if s.Microcode != "" {
+			fmt.Printf(", %s microcode", s.Microcode)
+		}
+		if len(s.Interfaces) > 0 {
+			fmt.Printf(", interfaces %s", strings.Join(s.Interfaces, " "))
+		}
+		if len(s.NetworkDrivers) > 0 {
+			fmt.Printf(", initrd network drivers %s", strings.Join(s.NetworkDrivers, " "))
+		}
+		fmt.Println()
+
+		hwConfig, err := os.ReadFile(filepath.Join(dir, "hardware-configuration.nix"))
+		if err == nil && !bytes.Contains(hwConfig, []byte("doomlab.hardware.report")) {
+			fmt.Printf("  set `doomlab.hardware.report = ./facter.json;` in %s/hardware-configuration.nix and drop the module lists and microcode it derives\n", dir)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"runtime"
+
+	"github.com/orther/doomlab/tools/internal/inventory"
+)
+
+func runInventory(args []string) error {
+	fs := flag.NewFlagSet("inventory", flag.ContinueOnError)
+	flake := fs.String("flake", ".", "flake to evaluate")
+	format := fs.String("format", "markdown", "output format: json, markdown or html")
+	out := fs.String("o", "", "write the report to this file instead of stdout")
+	jobs := fs.Int("j", runtime.NumCPU(), "hosts to evaluate at once")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var render func(io.Writer, []inventory.Host) error
+	switch *format {
+	case "json":
+		render = func(w io.Writer, hosts []inventory.Host) error {
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			return enc.Encode(hosts)
+		}
+	case "markdown", "md":
+		render = inventory.WriteMarkdown
+	case "html":
+		render = inventory.WriteHTML
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	hosts, err := inventory.Load(ctx, *flake, *jobs)
+	if err != nil {
+		return err
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := render(w, hosts); err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, h := range hosts {
+		if h.Error != "" {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", h.Name, h.Error)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d hosts failed to evaluate", failed, len(hosts))
+	}
+	return nil
+}
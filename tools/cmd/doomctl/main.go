@@ -0,0 +1,90 @@
+// Command doomctl collects the operational tooling for the doomlab fleet.
+//
+// Run it from the root of the repository; paths such as secrets/ and pki/
+// are resolved relative to the working directory.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands []command
+
+func register(name, summary string, run func(args []string) error) {
+	commands = append(commands, command{name, summary, run})
+}
+
+func main() {
+	register("ca", "manage the client certificate authority for mutual TLS", runCA)
+	register("scaffold", "generate a new machine from a role template and its hardware", runScaffold)
+	register("hardware", "capture nixos-facter hardware reports into machines/", runHardware)
+	register("inventory", "report what every host runs, from the evaluated flake", runInventory)
+	register("drift", "compare what hosts run with the flake", runDrift)
+	register("exec", "run a command on the hosts selected by name, role or service", runExec)
+	register("journal", "query the journal on the hosts selected by name, role or service", runJournal)
+	register("migrate", "move a service and its persisted state to another host", runMigrate)
+	register("resources", "report how each host's service classes use their resource budgets", runResources)
+	register("status", "live dashboard of every host's health over SSH", runStatus)
+	register("changelog", "summarise what a flake.lock bump changes on each host", runChangelog)
+
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	name := os.Args[1]
+	for _, c := range commands {
+		if c.name == name {
+			if err := c.run(os.Args[2:]); err != nil {
+				if errors.Is(err, flag.ErrHelp) {
+					os.Exit(2)
+				}
+				fmt.Fprintf(os.Stderr, "doomctl %s: %v\n", name, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+	if name != "help" && name != "-h" && name != "--help" {
+		fmt.Fprintf(os.Stderr, "doomctl: unknown command %q\n", name)
+	}
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: doomctl <command> [arguments]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "commands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", c.name, c.summary)
+	}
+}
+
+// subcommands dispatches the first argument to one of cmds, printing usage
+// for the parent command when it is missing or unknown.
+func subcommands(parent string, args []string, cmds []command) error {
+	if len(args) > 0 {
+		for _, c := range cmds {
+			if c.name == args[0] {
+				return c.run(args[1:])
+			}
+		}
+	}
+	fmt.Fprintf(os.Stderr, "usage: doomctl %s <command> [arguments]\n\ncommands:\n", parent)
+	for _, c := range cmds {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", c.name, c.summary)
+	}
+	if len(args) > 0 {
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+	return flag.ErrHelp
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"slices"
+	"strings"
+
+	"github.com/orther/doomlab/tools/internal/inventory"
+	"github.com/orther/doomlab/tools/internal/migrate"
+	"github.com/orther/doomlab/tools/internal/remote"
+	"github.com/orther/doomlab/tools/internal/sops"
+)
+
+type migrateStep struct {
+	desc string
+	run  func(ctx context.Context) error
+	// undo reverses the step if this or a later one fails, even when this
+	// one only got partway: local edits are restored and a service stopped
+	// for the move starts on the source again
+	undo func(ctx context.Context) error
+	// settled means the service runs on the destination, after which
+	// nothing is undone
+	settled bool
+}
+
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	flake := fs.String("flake", ".", "flake to edit and deploy; must be this checkout when editing")
+	inventoryFile := fs.String("inventory", "", "read hosts from `doomctl inventory -format json` output instead of evaluating the flake; needs -edit=false")
+	var ssh remote.Options
+	ssh.Register(fs)
+	dryRun := fs.Bool("dry-run", false, "print the steps without changing anything")
+	edit := fs.Bool("edit", true, "move the service import between the machine configurations")
+	deploy := fs.Bool("deploy", true, "deploy both hosts with nixos-rebuild")
+	dns := fs.Bool("dns", true, "re-point the service's tunnel hostnames at the destination")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: doomctl migrate [flags] <service> <from> <to>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 3 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	service, fromName, toName := fs.Arg(0), fs.Arg(1), fs.Arg(2)
+	if *inventoryFile != "" && *edit {
+		return errors.New("-inventory cannot be used with -edit, which evaluates the flake")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var from, to inventory.Host
+	if *inventoryFile != "" {
+		hosts, err := inventory.LoadFile(*inventoryFile)
+		if err != nil {
+			return err
+		}
+		for _, h := range hosts {
+			switch h.Name {
+			case fromName:
+				from = h
+			case toName:
+				to = h
+			}
+		}
+		for _, name := range []string{fromName, toName} {
+			if !slices.ContainsFunc(hosts, func(h inventory.Host) bool { return h.Name == name }) {
+				return fmt.Errorf("%s is not in %s", name, *inventoryFile)
+			}
+		}
+	} else {
+		var err error
+		if from, err = inventory.LoadHost(ctx, *flake, fromName); err != nil {
+			return err
+		}
+		if to, err = inventory.LoadHost(ctx, *flake, toName); err != nil {
+			return err
+		}
+	}
+
+	plan, err := migrate.NewPlan(service, from, to, !*edit)
+	if err != nil {
+		return err
+	}
+	var edits []migrate.Edit
+	if *edit {
+		if edits, err = migrate.MoveImport(*flake, service, fromName, toName); err != nil {
+			return err
+		}
+	}
+
+	// after is the destination as it will be evaluated once the import has
+	// moved; it is reloaded by the edit step
+	after := to
+	units := quoteArgs(plan.Units)
+	startSource := func(ctx context.Context) error {
+		return sshStep(ctx, ssh, from.Hostname, "sudo -n systemctl start "+units)
+	}
+	stopDestination := func(ctx context.Context) error {
+		return sshStep(ctx, ssh, to.Hostname, "sudo -n systemctl stop "+units)
+	}
+	kept := migrate.Originals{}
+	var addedKey string
+	var steps []migrateStep
+	for _, e := range edits {
+		steps = append(steps, migrateStep{desc: "edit " + e.Path + ": " + e.Summary, run: func(context.Context) error {
+			if err := kept.Keep(e.Path); err != nil {
+				return err
+			}
+			return e.Apply()
+		}, undo: func(context.Context) error {
+			return kept.Restore(e.Path)
+		}})
+	}
+	if *edit {
+		// .sops.yaml and the secrets re-encrypted for the destination
+		var sopsFiles []string
+		steps = append(steps, migrateStep{desc: "re-encrypt the secrets " + toName + " now needs for its age key", run: func(ctx context.Context) error {
+			var err error
+			if after, err = inventory.LoadHost(ctx, *flake, toName); err != nil {
+				return err
+			}
+			if after.Error != "" {
+				return fmt.Errorf("%s does not evaluate with %s: %s", toName, service, after.Error)
+			}
+			sopsFiles = append(sopsFiles, *flake+"/.sops.yaml")
+			if err := kept.Keep(sopsFiles...); err != nil {
+				return err
+			}
+			if addedKey, err = migrate.AddAgeKey(ctx, ssh, *flake, toName); err != nil {
+				return err
+			}
+			if addedKey != "" {
+				fmt.Printf("    added %s's age key %s to .sops.yaml\n", toName, addedKey)
+			}
+			var files []string
+			for _, s := range after.Secrets {
+				if !slices.ContainsFunc(to.Secrets, func(old inventory.Secret) bool { return old.File == s.File }) && !slices.Contains(files, s.File) {
+					files = append(files, s.File)
+				}
+			}
+			stale, err := migrate.Reencrypt(*flake, toName, files)
+			if err != nil {
+				return err
+			}
+			for _, f := range stale {
+				path := *flake + "/secrets/" + f
+				sopsFiles = append(sopsFiles, path)
+				if err := kept.Keep(path); err != nil {
+					return err
+				}
+				fmt.Printf("    sops updatekeys secrets/%s\n", f)
+				if err := sops.UpdateKeys(path); err != nil {
+					return err
+				}
+			}
+			return nil
+		}, undo: func(context.Context) error {
+			return kept.Restore(sopsFiles...)
+		}})
+	}
+	// From here until the service starts on the destination it runs
+	// nowhere, so a failure starts it on the source again
+	steps = append(steps, migrateStep{desc: "stop " + strings.Join(plan.Units, " ") + " on " + fromName, run: func(ctx context.Context) error {
+		return sshStep(ctx, ssh, from.Hostname, "sudo -n systemctl stop "+units)
+	}, undo: startSource})
+	if *deploy {
+		steps = append(steps, migrateStep{desc: "deploy " + toName, run: func(ctx context.Context) error {
+			return nixosRebuild(ctx, ssh, *flake, to)
+		}, undo: stopDestination})
+	}
+	steps = append(steps, migrateStep{desc: "stop " + strings.Join(plan.Units, " ") + " on " + toName + " before restoring its state", run: stopDestination})
+	for _, p := range plan.Paths {
+		steps = append(steps, migrateStep{desc: "copy " + migrate.PersistRoot + p + " from " + fromName + " to " + toName, run: func(ctx context.Context) error {
+			return migrate.Sync(ctx, ssh, from.Hostname, to.Hostname, p, os.Stderr)
+		}})
+	}
+	steps = append(steps, migrateStep{desc: "start " + strings.Join(plan.Units, " ") + " on " + toName, run: func(ctx context.Context) error {
+		return sshStep(ctx, ssh, to.Hostname, "sudo -n systemctl start "+units)
+	}, undo: stopDestination, settled: true})
+	if *deploy {
+		steps = append(steps, migrateStep{desc: "deploy " + fromName + " without " + service, run: func(ctx context.Context) error {
+			return nixosRebuild(ctx, ssh, *flake, from)
+		}})
+	}
+	if *dns && len(plan.Tunnels) > 0 {
+		var hostnames []string
+		for _, t := range plan.Tunnels {
+			hostnames = append(hostnames, t.Hostname)
+		}
+		steps = append(steps, migrateStep{desc: "route " + strings.Join(hostnames, " ") + " to the tunnels on " + toName, run: func(ctx context.Context) error {
+			var routes []string
+			for _, t := range after.Tunnels {
+				if !slices.Contains(hostnames, t.Hostname) {
+					continue
+				}
+				for _, name := range t.Tunnels {
+					if u := "cloudflared-route-" + name + ".service"; !slices.Contains(routes, u) {
+						routes = append(routes, u)
+					}
+				}
+			}
+			if len(routes) == 0 {
+				return fmt.Errorf("%s declares no tunnel for %s; add one to doomlab.cloudflared.tunnels", toName, strings.Join(hostnames, ", "))
+			}
+			// replica connectors have no route unit and leave DNS alone
+			return sshStep(ctx, ssh, to.Hostname, "for u in "+quoteArgs(routes)+`; do
+  if systemctl cat "$u" >/dev/null 2>&1; then sudo -n systemctl restart "$u"; fi
+done`)
+		}})
+	}
+
+	if *dryRun {
+		fmt.Printf("Would move %s from %s to %s:\n", service, fromName, toName)
+		for i, s := range steps {
+			fmt.Printf("  %d. %s\n", i+1, s.desc)
+		}
+	} else {
+		var done []migrateStep
+		for i, s := range steps {
+			fmt.Printf("==> %d/%d %s\n", i+1, len(steps), s.desc)
+			if err := s.run(ctx); err != nil {
+				err = fmt.Errorf("%s: %w", s.desc, err)
+				return rollback(ctx, append(done, s), err)
+			}
+			done = append(done, s)
+			if s.settled {
+				done = nil
+			}
+		}
+		fmt.Printf("Moved %s from %s to %s.\n", service, fromName, toName)
+	}
+
+	var notes []string
+	for _, p := range plan.Unpersisted {
+		notes = append(notes, p+" is not in "+fromName+"'s environment.persistence and is not copied")
+	}
+	for _, d := range plan.Domains {
+		if !slices.ContainsFunc(plan.Tunnels, func(t inventory.Tunnel) bool { return t.Hostname == d }) {
+			notes = append(notes, d+" is not published through a tunnel; point its A and AAAA records, or the IPv4 port forward, at "+toName)
+		}
+	}
+	if len(edits) > 0 && !*dryRun {
+		notes = append(notes, "commit the machine configuration changes")
+	}
+	if addedKey != "" {
+		notes = append(notes, "commit .sops.yaml with "+toName+"'s age key")
+	}
+	if len(notes) > 0 {
+		fmt.Println()
+		for _, n := range notes {
+			fmt.Println("note:", n)
+		}
+	}
+	return nil
+}
+
+// rollback undoes steps in reverse after err, so the checkout is as it was
+// and a service stopped for the move runs on the source again. It carries on
+// when interrupted, which is likely how err came about.
+func rollback(ctx context.Context, steps []migrateStep, err error) error {
+	ctx = context.WithoutCancel(ctx)
+	undone := false
+	for i := len(steps) - 1; i >= 0; i-- {
+		s := steps[i]
+		if s.undo == nil {
+			continue
+		}
+		fmt.Printf("==> undo: %s\n", s.desc)
+		if uerr := s.undo(ctx); uerr != nil {
+			return errors.Join(err, fmt.Errorf("undoing %s: %w", s.desc, uerr))
+		}
+		undone = true
+	}
+	if undone {
+		return fmt.Errorf("%w; the steps before it were undone", err)
+	}
+	return err
+}
+
+// sshStep runs a command on host, passing its output through.
+func sshStep(ctx context.Context, ssh remote.Options, host, script string) error {
+	code, err := ssh.Stream(ctx, host, script, os.Stdout, os.Stderr)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return fmt.Errorf("exit %d on %s", code, host)
+	}
+	return nil
+}
+
+// nixosRebuild deploys a host the way `just deploy <machine> <ip>` does,
+// building on the host itself.
+func nixosRebuild(ctx context.Context, ssh remote.Options, flake string, h inventory.Host) error {
+	target := ssh.Target(h.Hostname)
+	cmd := exec.CommandContext(ctx, "nixos-rebuild", "switch", "--fast",
+		"--flake", flake+"#"+h.Name,
+		"--use-remote-sudo", "--target-host", target, "--build-host", target)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	return cmd.Run()
+}
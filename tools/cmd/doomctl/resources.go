@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/orther/doomlab/tools/internal/fleet"
+	"github.com/orther/doomlab/tools/internal/remote"
+	"github.com/orther/doomlab/tools/internal/resources"
+)
+
+func runResources(args []string) error {
+	fs := flag.NewFlagSet("resources", flag.ContinueOnError)
+	flake := fs.String("flake", ".", "flake listing the hosts")
+	var ssh remote.Options
+	ssh.Register(fs)
+	units := fs.Bool("units", false, "list the services in each class by memory use")
+	jobs := fs.Int("j", runtime.NumCPU(), "hosts to query at once")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	all, err := fleet.Hosts(ctx, *flake)
+	if err != nil {
+		return err
+	}
+	selected, unknown := fleet.Select(all, fs.Args())
+	if len(unknown) > 0 {
+		return fmt.Errorf("unknown hosts: %s", strings.Join(unknown, ", "))
+	}
+	// darwin hosts have no slices to report on
+	var hosts []fleet.Host
+	for _, h := range selected {
+		if h.Kind == "nixos" || h.Err != nil {
+			hosts = append(hosts, h)
+		}
+	}
+	if len(hosts) == 0 {
+		return fmt.Errorf("no NixOS hosts in %s", *flake)
+	}
+
+	results := make([]resources.Host, len(hosts))
+	sem := make(chan struct{}, max(*jobs, 1))
+	var wg sync.WaitGroup
+	for i, h := range hosts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i] = resources.Collect(ctx, ssh, h)
+		}()
+	}
+	wg.Wait()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tCLASS\tMEMORY\tPEAK\tHIGH\tMAX\tPEAK/HIGH\tCPU\tIO")
+	over, failed := 0, 0
+	for _, r := range results {
+		switch {
+		case r.Host.Err != nil:
+			failed++
+			fmt.Fprintf(w, "%s\teval failed\t\t\t\t\t\t\t\n", r.Host.Name)
+			continue
+		case r.Err != nil:
+			failed++
+			fmt.Fprintf(w, "%s\tunreachable\t\t\t\t\t\t\t\n", r.Host.Name)
+			continue
+		case len(r.Slices) == 0:
+			fmt.Fprintf(w, "%s\tno budgets\t\t\t\t\t\t\t\n", r.Host.Name)
+			continue
+		}
+		for _, s := range r.Slices {
+			use := "-"
+			if p := s.HighPercent(); p >= 0 {
+				use = strconv.Itoa(p) + "%"
+			}
+			if s.OverHigh() {
+				over++
+				use += " over"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Host.Name, s.Class,
+				size(s.Memory), size(s.Peak), limit(s.High), limit(s.Max), use,
+				orDash(duration(s.CPU)), size(s.IO))
+			if !*units {
+				continue
+			}
+			for _, u := range s.Units {
+				fmt.Fprintf(w, "\t  %s\t%s\t%s\t\t\t\t%s\t%s\n", u.Name,
+					size(u.Memory), size(u.Peak), orDash(duration(u.CPU)), size(u.IO))
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	for _, r := range results {
+		switch {
+		case r.Err != nil:
+			fmt.Printf("\n%s: %v\n", r.Host.Name, r.Err)
+		case r.OOMKills > 0:
+			fmt.Printf("\n%s: systemd-oomd killed %d cgroups in the last week; see doomctl journal -hosts %s -u systemd-oomd -since -7d\n",
+				r.Host.Name, r.OOMKills, r.Host.Name)
+		}
+	}
+
+	switch {
+	case failed > 0:
+		return fmt.Errorf("%d of %d hosts could not be checked", failed, len(results))
+	case over > 0:
+		return fmt.Errorf("%d classes reached their MemoryHigh since boot", over)
+	}
+	return nil
+}
+
+// size formats a byte count, or a dash when there is none.
+func size(n int64) string {
+	if n == 0 {
+		return "-"
+	}
+	return kib(n / 1024)
+}
+
+func limit(n int64) string {
+	if n == 0 {
+		return "none"
+	}
+	return kib(n / 1024)
+}
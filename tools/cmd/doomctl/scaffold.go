@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/orther/doomlab/tools/internal/remote"
+	"github.com/orther/doomlab/tools/internal/scaffold"
+	"github.com/orther/doomlab/tools/internal/sops"
+)
+
+var machineNameRe = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+
+func runScaffold(args []string) error {
+	fs := flag.NewFlagSet("scaffold", flag.ContinueOnError)
+	profile := fs.String("profile", "server", "modules/profiles entry to start from: "+strings.Join(scaffold.Profiles, ", "))
+	ssh := remote.Options{}
+	fs.StringVar(&ssh.User, "user", "nixos", "SSH user on the target; the installer ISO's is nixos")
+	root := fs.String("root", "/mnt", "where install.sh mounted the new system, or / for an installed one")
+	enroll := fs.Bool("sops", true, "add the machine's age key to .sops.yaml and re-encrypt secrets/ for it")
+	dryRun := fs.Bool("dry-run", false, "print the generated files instead of writing them")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: doomctl scaffold [flags] <name> <address>")
+		fmt.Fprintln(fs.Output(), "\nRun from the repository root against a target booted from the installer ISO.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	name, address := fs.Arg(0), fs.Arg(1)
+	if !machineNameRe.MatchString(name) {
+		return fmt.Errorf("%q is not a valid host name", name)
+	}
+	dir := filepath.Join("machines", name)
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("%s already exists", dir)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	hw, err := scaffold.Probe(ctx, ssh, address, *root)
+	if err != nil {
+		return err
+	}
+	files, err := scaffold.Render(scaffold.Machine{Name: name, Profile: *profile, Hardware: hw})
+	if err != nil {
+		return err
+	}
+	flake, err := os.ReadFile("flake.nix")
+	if err != nil {
+		return err
+	}
+	if files["flake.nix"], err = scaffold.AddToFlake(flake, name, hw.System); err != nil {
+		return err
+	}
+	if *enroll && hw.AgeKey != "" {
+		sopsYAML, err := os.ReadFile(".sops.yaml")
+		if err != nil {
+			return err
+		}
+		if files[".sops.yaml"], err = scaffold.AddSopsKey(sopsYAML, name, hw.AgeKey); err != nil {
+			return err
+		}
+	}
+
+	paths := make([]string, 0, len(files))
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	if *dryRun {
+		for _, p := range paths {
+			fmt.Printf("==> %s\n%s\n", p, files[p])
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	for _, p := range paths {
+		if err := os.WriteFile(p, files[p], 0o644); err != nil {
+			return err
+		}
+		fmt.Println("wrote", p)
+	}
+	// flakes only see files git knows about
+	if out, err := exec.Command("git", "add", "--intent-to-add", dir).CombinedOutput(); err != nil {
+		return fmt.Errorf("git add: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	if _, ok := files[".sops.yaml"]; ok {
+		secrets, err := filepath.Glob("secrets/*")
+		if err != nil {
+			return err
+		}
+		for _, s := range secrets {
+			fmt.Println("sops updatekeys", s)
+			if err := sops.UpdateKeys(s); err != nil {
+				return err
+			}
+		}
+	}
+
+	fmt.Printf("\nNext steps for %s:\n", name)
+	step := 1
+	next := func(format string, args ...any) {
+		fmt.Printf("  %d. %s\n", step, fmt.Sprintf(format, args...))
+		step++
+	}
+	next("review %s, adding services and data disks", dir)
+	if hw.Driver == "" && hw.Report == nil && *profile == "server" {
+		next("find the NIC driver with `readlink /sys/class/net/<interface>/device/driver` and add it to boot.initrd.availableKernelModules for remote unlock")
+	}
+	switch {
+	case !*enroll:
+	case hw.AgeKey == "":
+		next("add the age key from `ssh-to-age < %s/nix/secret/initrd/ssh_host_ed25519_key.pub` to .sops.yaml as &%s and run `just sopsupdate`", strings.TrimSuffix(*root, "/"), name)
+	default:
+		next("check that %s's age key %s matches the host key on the target", name, hw.AgeKey)
+	}
+	next("run `just check` and commit %s, flake.nix and .sops.yaml", dir)
+	next("on the installer: sudo nixos-install --no-root-passwd --root %s --flake github:orther/doomlab#%s", *root, name)
+	return nil
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/orther/doomlab/tools/internal/fleet"
+	"github.com/orther/doomlab/tools/internal/remote"
+	"github.com/orther/doomlab/tools/internal/status"
+	"github.com/orther/doomlab/tools/internal/term"
+)
+
+func runStatus(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	flake := fs.String("flake", ".", "flake listing the hosts")
+	var ssh remote.Options
+	ssh.Register(fs)
+	interval := fs.Duration("interval", 30*time.Second, "how often the dashboard refreshes")
+	once := fs.Bool("once", false, "print a table and exit instead of opening the dashboard")
+	jobs := fs.Int("j", runtime.NumCPU(), "hosts to query at once")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	all, err := fleet.Hosts(ctx, *flake)
+	if err != nil {
+		return err
+	}
+	hosts, unknown := fleet.Select(all, fs.Args())
+	if len(unknown) > 0 {
+		return fmt.Errorf("unknown hosts: %s", strings.Join(unknown, ", "))
+	}
+	if len(hosts) == 0 {
+		return fmt.Errorf("no hosts in %s", *flake)
+	}
+
+	d := &dashboard{
+		ssh:      ssh,
+		hosts:    hosts,
+		statuses: make([]status.Host, len(hosts)),
+		jobs:     max(*jobs, 1),
+		interval: *interval,
+		redraw:   make(chan struct{}, 1),
+	}
+	for i, h := range hosts {
+		d.statuses[i] = status.Host{Host: h}
+	}
+	if *once || !term.IsTerminal(os.Stdin) || !term.IsTerminal(os.Stdout) {
+		d.collect(ctx)
+		return d.print()
+	}
+	return d.run(ctx)
+}
+
+type view int
+
+const (
+	fleetView view = iota
+	unitsView
+	journalView
+)
+
+type dashboard struct {
+	ssh      remote.Options
+	hosts    []fleet.Host
+	jobs     int
+	interval time.Duration
+	redraw   chan struct{}
+
+	mu         sync.Mutex
+	statuses   []status.Host
+	refreshing bool
+	refreshed  time.Time
+
+	view    view
+	host    int
+	unit    int
+	units   []string
+	journal []string
+	offset  int
+	loading bool
+}
+
+// collect queries every host and waits for the results.
+func (d *dashboard) collect(ctx context.Context) {
+	sem := make(chan struct{}, d.jobs)
+	var wg sync.WaitGroup
+	for i, h := range d.hosts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			s := status.Collect(ctx, d.ssh, h)
+			d.mu.Lock()
+			d.statuses[i] = s
+			d.mu.Unlock()
+			d.notify()
+		}()
+	}
+	wg.Wait()
+	d.mu.Lock()
+	d.refreshed = time.Now()
+	d.refreshing = false
+	d.mu.Unlock()
+	d.notify()
+}
+
+func (d *dashboard) refresh(ctx context.Context) {
+	d.mu.Lock()
+	if d.refreshing {
+		d.mu.Unlock()
+		return
+	}
+	d.refreshing = true
+	d.mu.Unlock()
+	go d.collect(ctx)
+}
+
+func (d *dashboard) notify() {
+	select {
+	case d.redraw <- struct{}{}:
+	default:
+	}
+}
+
+func (d *dashboard) print() error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(statusColumns, "\t"))
+	for _, s := range d.statuses {
+		fmt.Fprintln(w, strings.Join(statusRow(s, false), "\t"))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	for _, s := range d.statuses {
+		if s.Err != nil {
+			fmt.Printf("\n%s: %v", s.Host.Name, s.Err)
+		}
+		for _, u := range s.Failed {
+			fmt.Printf("\n%s: %s failed", s.Host.Name, u)
+		}
+	}
+	fmt.Println()
+	return nil
+}
+
+func (d *dashboard) run(ctx context.Context) error {
+	t, err := term.Open()
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	defer signal.Stop(winch)
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	keys := t.Keys()
+
+	d.refresh(ctx)
+	for {
+		d.mu.Lock()
+		rows, _ := t.Size()
+		t.Draw(d.render(rows))
+		d.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-d.redraw:
+		case <-winch:
+			t.Resize()
+		case <-ticker.C:
+			d.refresh(ctx)
+		case k, ok := <-keys:
+			if !ok || !d.handle(ctx, k, rows) {
+				return nil
+			}
+		}
+	}
+}
+
+// handle applies a key press and reports whether to keep running.
+func (d *dashboard) handle(ctx context.Context, k term.Key, rows int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	page := max(rows-3, 1)
+
+	switch d.view {
+	case fleetView:
+		switch k {
+		case "q":
+			return false
+		case term.Up, "k":
+			d.host = max(d.host-1, 0)
+		case term.Down, "j":
+			d.host = min(d.host+1, len(d.hosts)-1)
+		case "r":
+			go d.refresh(ctx)
+		case term.Enter:
+			d.units = d.statuses[d.host].Units()
+			d.unit = 0
+			d.view = unitsView
+		}
+	case unitsView:
+		switch k {
+		case "q", term.Escape:
+			d.view = fleetView
+		case term.Up, "k":
+			d.unit = max(d.unit-1, 0)
+		case term.Down, "j":
+			d.unit = min(d.unit+1, len(d.units)-1)
+		case term.Enter:
+			if len(d.units) > 0 {
+				d.view = journalView
+				d.loadJournal(ctx)
+			}
+		}
+	case journalView:
+		last := max(len(d.journal)-page, 0)
+		switch k {
+		case "q", term.Escape:
+			d.view = unitsView
+		case term.Up, "k":
+			d.offset = max(d.offset-1, 0)
+		case term.Down, "j":
+			d.offset = min(d.offset+1, last)
+		case term.PageUp:
+			d.offset = max(d.offset-page, 0)
+		case term.PageDown, " ":
+			d.offset = min(d.offset+page, last)
+		case term.Home, "g":
+			d.offset = 0
+		case term.End, "G":
+			d.offset = last
+		case "r":
+			d.loadJournal(ctx)
+		}
+	}
+	return true
+}
+
+// loadJournal fetches the selected unit's journal in the background; the
+// caller holds d.mu.
+func (d *dashboard) loadJournal(ctx context.Context) {
+	h, unit := d.hosts[d.host], d.units[d.unit]
+	d.loading = true
+	d.journal = nil
+	go func() {
+		out, err := status.Journal(ctx, d.ssh, h, unit, 500)
+		lines := strings.Split(strings.TrimRight(string(out), "\n"), "\n")
+		if err != nil {
+			lines = append(lines, term.Red(err.Error()))
+		}
+		d.mu.Lock()
+		d.journal = lines
+		d.offset = len(lines)
+		d.loading = false
+		d.mu.Unlock()
+		d.notify()
+	}()
+}
+
+// render draws the current view; the caller holds d.mu.
+func (d *dashboard) render(rows int) []string {
+	switch d.view {
+	case unitsView:
+		return d.renderUnits()
+	case journalView:
+		return d.renderJournal(rows)
+	}
+	return d.renderFleet()
+}
+
+var statusColumns = []string{"HOST", "GEN", "REV", "UPTIME", "KERNEL", "FAILED", "UPGRADE", "BACKUP", "DISK", "TAILSCALE"}
+
+func (d *dashboard) renderFleet() []string {
+	title := "doomlab fleet"
+	switch {
+	case d.refreshing:
+		title += " · refreshing…"
+	case !d.refreshed.IsZero():
+		title += " · updated " + d.refreshed.Format(time.TimeOnly) + ", every " + d.interval.String()
+	}
+	table := [][]string{statusColumns}
+	for _, s := range d.statuses {
+		table = append(table, statusRow(s, true))
+	}
+	widths := make([]int, len(statusColumns))
+	for _, row := range table {
+		for i, cell := range row {
+			widths[i] = max(widths[i], term.Width(cell))
+		}
+	}
+	lines := []string{term.Bold(title), ""}
+	for r, row := range table {
+		cells := make([]string, len(row))
+		for i, cell := range row {
+			cells[i] = term.Pad(cell, widths[i])
+		}
+		line := strings.Join(cells, "  ")
+		switch {
+		case r == 0:
+			line = term.Bold(line)
+		case r-1 == d.host:
+			// keep the highlight across the colored cells' resets
+			line = term.Reverse(strings.ReplaceAll(line, "\x1b[0m", "\x1b[0;7m"))
+		}
+		lines = append(lines, line)
+	}
+
+	lines = append(lines, "")
+	lines = append(lines, hostDetails(d.statuses[d.host])...)
+	lines = append(lines, "", "↑/↓ select · enter units and journals · r refresh · q quit")
+	return lines
+}
+
+func hostDetails(s status.Host) []string {
+	lines := []string{term.Bold(s.Host.Name) + " (" + s.Host.Hostname + ", " + strings.Join(s.Host.Roles, ", ") + ")"}
+	if s.Err != nil {
+		return append(lines, term.Red(s.Err.Error()))
+	}
+	if s.Checked.IsZero() {
+		return append(lines, "waiting for the first update")
+	}
+	if s.RebootPending() {
+		lines = append(lines, term.Yellow("booted "+s.BootedKernel), term.Yellow("current "+s.CurrentKernel))
+	}
+	for _, u := range s.Failed {
+		lines = append(lines, term.Red("failed "+u))
+	}
+	for _, u := range s.Units() {
+		if b, ok := s.Backups[u]; ok {
+			lines = append(lines, "backup "+u+": "+resultCell(b, 36*time.Hour, true))
+		}
+	}
+	for _, disk := range s.Disks {
+		kind := ""
+		if disk.Tmpfs() {
+			kind = " (tmpfs)"
+		}
+		lines = append(lines, fmt.Sprintf("disk %s%s: %s of %s", disk.Mount, kind,
+			percent(disk.Percent(), true), kib(disk.Size)))
+	}
+	if s.Tailscale != nil {
+		lines = append(lines, "tailscale "+s.Tailscale.BackendState+" "+strings.Join(s.Tailscale.IPs, " "))
+	}
+	return lines
+}
+
+func (d *dashboard) renderUnits() []string {
+	h := d.hosts[d.host]
+	lines := []string{term.Bold(h.Name + " units"), ""}
+	if len(d.units) == 0 {
+		lines = append(lines, "no failed, upgrade or backup units")
+	}
+	for i, u := range d.units {
+		if i == d.unit {
+			u = term.Reverse(u)
+		}
+		lines = append(lines, u)
+	}
+	return append(lines, "", "↑/↓ select · enter journal · esc back")
+}
+
+func (d *dashboard) renderJournal(rows int) []string {
+	h, unit := d.hosts[d.host], d.units[d.unit]
+	lines := []string{term.Bold(h.Name + " " + unit)}
+	if d.loading {
+		return append(lines, "loading…")
+	}
+	page := max(rows-3, 1)
+	d.offset = min(d.offset, max(len(d.journal)-page, 0))
+	end := min(d.offset+page, len(d.journal))
+	lines = append(lines, d.journal[d.offset:end]...)
+	for len(lines) < rows-1 {
+		lines = append(lines, "")
+	}
+	return append(lines, fmt.Sprintf("lines %d-%d of %d · ↑/↓ pgup/pgdn g/G scroll · r reload · esc back", d.offset+1, end, len(d.journal)))
+}
+
+// statusRow is one host's line in the fleet table; color marks problems
+// in red and warnings in yellow.
+func statusRow(s status.Host, color bool) []string {
+	paint := func(f func(string) string, v string) string {
+		if color {
+			return f(v)
+		}
+		return v
+	}
+	row := []string{s.Host.Name}
+	switch {
+	case s.Host.Err != nil:
+		return append(row, paint(term.Red, "eval failed"), "", "", "", "", "", "", "", "")
+	case s.Err != nil:
+		return append(row, paint(term.Red, "unreachable"), "", "", "", "", "", "", "", "")
+	case s.Checked.IsZero():
+		return append(row, "…", "", "", "", "", "", "", "", "")
+	}
+
+	row = append(row, orDash(itoaOrEmpty(s.Generation)))
+	if s.Revision != nil {
+		rev := s.Revision.Short()
+		if s.Revision.Dirty {
+			rev = paint(term.Yellow, rev)
+		}
+		row = append(row, rev)
+	} else {
+		row = append(row, "-")
+	}
+	row = append(row, orDash(duration(s.Uptime)))
+
+	kernel := orDash(s.KernelRelease)
+	if s.RebootPending() {
+		kernel += " " + paint(term.Yellow, "reboot")
+	}
+	row = append(row, kernel)
+
+	failed := strconv.Itoa(len(s.Failed))
+	if len(s.Failed) > 0 {
+		failed = paint(term.Red, failed)
+	}
+	row = append(row, failed)
+
+	if s.Upgrade != nil {
+		row = append(row, resultCell(*s.Upgrade, 48*time.Hour, color))
+	} else {
+		row = append(row, "-")
+	}
+
+	if len(s.Backups) == 0 {
+		row = append(row, "-")
+	} else {
+		last, ok := s.LastBackup()
+		text := "ok"
+		if !ok {
+			text = "failed"
+		}
+		row = append(row, resultCell(status.Result{OK: ok, Text: text, At: last}, 36*time.Hour, color))
+	}
+
+	var disks []string
+	for _, disk := range s.Disks {
+		if disk.Tmpfs() {
+			disks = append(disks, "tmpfs "+percent(disk.Percent(), color))
+		}
+	}
+	fullest := -1
+	for i, disk := range s.Disks {
+		if !disk.Tmpfs() && (fullest < 0 || disk.Percent() > s.Disks[fullest].Percent()) {
+			fullest = i
+		}
+	}
+	if fullest >= 0 {
+		disks = append(disks, s.Disks[fullest].Mount+" "+percent(s.Disks[fullest].Percent(), color))
+	}
+	row = append(row, orDash(strings.Join(disks, ", ")))
+
+	switch {
+	case s.Tailscale == nil:
+		row = append(row, "-")
+	case s.Tailscale.Online:
+		row = append(row, "online")
+	default:
+		row = append(row, paint(term.Red, strings.ToLower(s.Tailscale.BackendState)))
+	}
+	return row
+}
+
+// resultCell shows a unit's last result and age, flagging failures and
+// runs older than stale.
+func resultCell(r status.Result, stale time.Duration, color bool) string {
+	text := "ok"
+	if !r.OK {
+		text = r.Text
+	}
+	if r.At.IsZero() {
+		text += " (not run since boot)"
+	} else {
+		text += " " + duration(time.Since(r.At)) + " ago"
+	}
+	if !color {
+		return text
+	}
+	switch {
+	case !r.OK:
+		return term.Red(text)
+	case !r.At.IsZero() && time.Since(r.At) > stale:
+		return term.Yellow(text)
+	}
+	return text
+}
+
+func percent(p int, color bool) string {
+	text := strconv.Itoa(p) + "%"
+	switch {
+	case !color:
+	case p >= 90:
+		text = term.Red(text)
+	case p >= 80:
+		text = term.Yellow(text)
+	}
+	return text
+}
+
+func kib(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f TiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f GiB", float64(n)/(1<<20))
+	default:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<10))
+	}
+}
+
+// duration formats d coarsely, e.g. 3d4h, 5h12m or 42s.
+func duration(d time.Duration) string {
+	switch {
+	case d <= 0:
+		return ""
+	case d >= 24*time.Hour:
+		return fmt.Sprintf("%dd%dh", d/(24*time.Hour), d%(24*time.Hour)/time.Hour)
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh%dm", d/time.Hour, d%time.Hour/time.Minute)
+	case d >= time.Minute:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	}
+	return fmt.Sprintf("%ds", d/time.Second)
+}
+
+func itoaOrEmpty(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
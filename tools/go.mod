@@ -0,0 +1,3 @@
+module github.com/orther/doomlab/tools
+
+go 1.22
@@ -0,0 +1,337 @@
+// Package ca manages the internal certificate authority that issues client
+// certificates for mutual TLS on admin-only virtual hosts.
+//
+// Public material lives in a directory committed to the repo so nginx hosts can
+// reference it: the CA certificate, the CRL and a registry of issued device
+// certificates. The CA private key is a sops encrypted file under secrets/.
+package ca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/orther/doomlab/tools/internal/sops"
+)
+
+const (
+	certFile     = "ca.crt"
+	crlFile      = "crl.pem"
+	registryFile = "devices.json"
+
+	// nginx rejects every client certificate once the CRL expires. The
+	// client-crl-expiry unit on mutual TLS hosts alerts a month before.
+	crlValidity = 365 * 24 * time.Hour
+)
+
+// Device is a certificate issued to a registered device.
+type Device struct {
+	Name      string     `json:"name"`
+	Serial    string     `json:"serial"`
+	NotBefore time.Time  `json:"notBefore"`
+	NotAfter  time.Time  `json:"notAfter"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+// Active reports whether the certificate is neither revoked nor expired.
+func (d Device) Active(now time.Time) bool {
+	return d.RevokedAt == nil && now.Before(d.NotAfter)
+}
+
+// Authority is a loaded certificate authority.
+type Authority struct {
+	dir     string
+	cert    *x509.Certificate
+	certPEM []byte
+	key     crypto.Signer
+	devices []Device
+}
+
+// Init creates a new authority in dir and stores its key, sops encrypted, at keyFile.
+func Init(dir, keyFile, name string, validity time.Duration) error {
+	if _, err := os.Stat(filepath.Join(dir, certFile)); err == nil {
+		return fmt.Errorf("%s already holds a certificate authority", dir)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := sops.EncryptFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})); err != nil {
+		return err
+	}
+
+	a := &Authority{
+		dir:     dir,
+		cert:    cert,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		key:     key,
+	}
+	if err := os.WriteFile(filepath.Join(dir, certFile), a.certPEM, 0o644); err != nil {
+		return err
+	}
+	if err := a.save(); err != nil {
+		return err
+	}
+	return a.WriteCRL()
+}
+
+// Load reads the authority in dir, decrypting its key from keyFile.
+func Load(dir, keyFile string) (*Authority, error) {
+	a, err := LoadPublic(dir)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := sops.Decrypt(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM key", keyFile)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", keyFile, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported key type %T", keyFile, key)
+	}
+	a.key = signer
+	return a, nil
+}
+
+// LoadPublic reads the authority in dir without its key. It can list devices
+// but not issue or revoke them.
+func LoadPublic(dir string) (*Authority, error) {
+	certPEM, err := os.ReadFile(filepath.Join(dir, certFile))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM certificate", filepath.Join(dir, certFile))
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Authority{dir: dir, cert: cert, certPEM: certPEM}
+	data, err := os.ReadFile(filepath.Join(dir, registryFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		var reg struct {
+			Devices []Device `json:"devices"`
+		}
+		if err := json.Unmarshal(data, &reg); err != nil {
+			return nil, fmt.Errorf("%s: %w", registryFile, err)
+		}
+		a.devices = reg.Devices
+	}
+	return a, nil
+}
+
+// CertPEM returns the CA certificate.
+func (a *Authority) CertPEM() []byte { return a.certPEM }
+
+// Devices returns every certificate ever issued, including revoked ones.
+func (a *Authority) Devices() []Device { return a.devices }
+
+// Issue creates a client certificate for the named device. Nothing is recorded
+// until the returned device is passed to Register, which callers do once the
+// key has been handed over. A device may hold only one active certificate at
+// a time.
+func (a *Authority) Issue(name string, validity time.Duration) (d Device, certPEM, keyPEM []byte, err error) {
+	now := time.Now()
+	if err := a.checkUnused(name, now); err != nil {
+		return Device{}, nil, nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return Device{}, nil, nil, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return Device{}, nil, nil, err
+	}
+	notAfter := now.Add(validity)
+	if notAfter.After(a.cert.NotAfter) {
+		notAfter = a.cert.NotAfter
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, a.cert, &key.PublicKey, a.key)
+	if err != nil {
+		return Device{}, nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return Device{}, nil, nil, err
+	}
+
+	d = Device{
+		Name:      name,
+		Serial:    serial.Text(16),
+		NotBefore: tmpl.NotBefore.UTC(),
+		NotAfter:  tmpl.NotAfter.UTC(),
+	}
+	return d, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+// Register records a certificate returned by Issue in the registry.
+func (a *Authority) Register(d Device) error {
+	if err := a.checkUnused(d.Name, time.Now()); err != nil {
+		return err
+	}
+	a.devices = append(a.devices, d)
+	return a.save()
+}
+
+func (a *Authority) checkUnused(name string, now time.Time) error {
+	for _, d := range a.devices {
+		if d.Name == name && d.Active(now) {
+			return fmt.Errorf("device %q already has an active certificate (serial %s); revoke it first", name, d.Serial)
+		}
+	}
+	return nil
+}
+
+// Revoke marks every unrevoked certificate of the named device as revoked and
+// regenerates the CRL.
+func (a *Authority) Revoke(name string) (int, error) {
+	now := time.Now().UTC()
+	n := 0
+	for i := range a.devices {
+		if a.devices[i].Name == name && a.devices[i].RevokedAt == nil {
+			a.devices[i].RevokedAt = &now
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("device %q has no unrevoked certificates", name)
+	}
+	if err := a.save(); err != nil {
+		return 0, err
+	}
+	return n, a.WriteCRL()
+}
+
+// WriteCRL signs a fresh CRL listing every revoked certificate that has not
+// yet expired.
+func (a *Authority) WriteCRL() error {
+	now := time.Now()
+	var entries []x509.RevocationListEntry
+	for _, d := range a.devices {
+		if d.RevokedAt == nil || now.After(d.NotAfter) {
+			continue
+		}
+		serial, ok := new(big.Int).SetString(d.Serial, 16)
+		if !ok {
+			return fmt.Errorf("device %q: bad serial %q", d.Name, d.Serial)
+		}
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber:   serial,
+			RevocationTime: *d.RevokedAt,
+		})
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(now.Unix()),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(crlValidity),
+		RevokedCertificateEntries: entries,
+	}, a.cert, a.key)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(a.dir, crlFile), pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0o644)
+}
+
+// CRLNextUpdate returns when the committed CRL stops being accepted.
+func (a *Authority) CRLNextUpdate() (time.Time, error) {
+	data, err := os.ReadFile(filepath.Join(a.dir, crlFile))
+	if err != nil {
+		return time.Time{}, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return time.Time{}, fmt.Errorf("%s: no PEM CRL", crlFile)
+	}
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return crl.NextUpdate, nil
+}
+
+func (a *Authority) save() error {
+	devices := a.devices
+	if devices == nil {
+		devices = []Device{}
+	}
+	data, err := json.MarshalIndent(struct {
+		Devices []Device `json:"devices"`
+	}{devices}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(a.dir, registryFile), append(data, '\n'), 0o644)
+}
+
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
@@ -0,0 +1,231 @@
+package ca
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// newAuthority creates an authority in a temporary directory without going
+// through sops, which Init and Load need for the key.
+func newAuthority(t *testing.T) *Authority {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Authority{
+		dir:     t.TempDir(),
+		cert:    cert,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		key:     key,
+	}
+	if err := os.WriteFile(filepath.Join(a.dir, certFile), a.certPEM, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// issue issues and registers a certificate for name, returning it as PEM.
+func issue(t *testing.T, a *Authority, name string) []byte {
+	t.Helper()
+	d, certPEM, _, err := a.Issue(name, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Register(d); err != nil {
+		t.Fatal(err)
+	}
+	return certPEM
+}
+
+func readCRL(t *testing.T, a *Authority) *x509.RevocationList {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(a.dir, crlFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatal("no PEM CRL")
+	}
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := crl.CheckSignatureFrom(a.cert); err != nil {
+		t.Fatalf("CRL is not signed by the CA: %v", err)
+	}
+	return crl
+}
+
+func TestRevokedSerialsInCRL(t *testing.T) {
+	tests := []struct {
+		name    string
+		issue   []string
+		revoke  []string
+		revoked []string // devices whose serials the CRL lists
+	}{
+		{
+			name:  "nothing revoked",
+			issue: []string{"iphone", "laptop"},
+		},
+		{
+			name:    "one of two revoked",
+			issue:   []string{"iphone", "laptop"},
+			revoke:  []string{"laptop"},
+			revoked: []string{"laptop"},
+		},
+		{
+			name:    "all revoked",
+			issue:   []string{"iphone", "laptop", "ipad"},
+			revoke:  []string{"ipad", "iphone", "laptop"},
+			revoked: []string{"iphone", "laptop", "ipad"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newAuthority(t)
+			serials := make(map[string]string)
+			for _, name := range tt.issue {
+				block, _ := pem.Decode(issue(t, a, name))
+				cert, err := x509.ParseCertificate(block.Bytes)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := cert.CheckSignatureFrom(a.cert); err != nil {
+					t.Fatalf("%s: not signed by the CA: %v", name, err)
+				}
+				serials[name] = cert.SerialNumber.Text(16)
+			}
+			for _, name := range tt.revoke {
+				if n, err := a.Revoke(name); err != nil || n != 1 {
+					t.Fatalf("Revoke(%q) = %d, %v", name, n, err)
+				}
+			}
+			if err := a.WriteCRL(); err != nil {
+				t.Fatal(err)
+			}
+
+			var listed []string
+			for _, e := range readCRL(t, a).RevokedCertificateEntries {
+				listed = append(listed, e.SerialNumber.Text(16))
+			}
+			var want []string
+			for _, name := range tt.revoked {
+				want = append(want, serials[name])
+			}
+			slices.Sort(listed)
+			slices.Sort(want)
+			if !slices.Equal(listed, want) {
+				t.Errorf("CRL lists %v, want %v", listed, want)
+			}
+		})
+	}
+}
+
+func TestIssue(t *testing.T) {
+	tests := []struct {
+		name    string
+		revoke  bool // revoke the first certificate before issuing again
+		wantErr bool
+		devices int // registry entries afterwards
+	}{
+		{name: "second active certificate", wantErr: true, devices: 1},
+		{name: "reissue after revoking", revoke: true, devices: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newAuthority(t)
+			issue(t, a, "iphone")
+			if tt.revoke {
+				if _, err := a.Revoke("iphone"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			d, _, _, err := a.Issue("iphone", time.Hour)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Issue() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				if err := a.Register(d); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// the registry reads back as committed
+			loaded, err := LoadPublic(a.dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := len(loaded.Devices()); got != tt.devices {
+				t.Fatalf("registry has %d devices, want %d", got, tt.devices)
+			}
+			active := 0
+			for _, d := range loaded.Devices() {
+				if d.Active(time.Now()) {
+					active++
+				}
+			}
+			if active != 1 {
+				t.Errorf("%d active certificates, want 1", active)
+			}
+		})
+	}
+}
+
+func TestIssueWithoutRegister(t *testing.T) {
+	a := newAuthority(t)
+	if _, _, _, err := a.Issue("iphone", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	// an export that failed leaves nothing behind to revoke
+	if _, err := os.Stat(filepath.Join(a.dir, registryFile)); !os.IsNotExist(err) {
+		t.Fatalf("registry written before Register: %v", err)
+	}
+	if _, err := a.Revoke("iphone"); err == nil {
+		t.Fatal("an unregistered certificate could be revoked")
+	}
+	issue(t, a, "iphone")
+}
+
+func TestRevokeUnknownDevice(t *testing.T) {
+	a := newAuthority(t)
+	issue(t, a, "iphone")
+	if _, err := a.Revoke("laptop"); err == nil {
+		t.Fatal("revoking a device without certificates succeeded")
+	}
+	if _, err := a.Revoke("iphone"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Revoke("iphone"); err == nil {
+		t.Fatal("revoking an already revoked device succeeded")
+	}
+}
@@ -0,0 +1,55 @@
+package ca
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ExportPKCS12 bundles a device certificate, its key and the CA certificate
+// into a password protected PKCS#12 file that phones and browsers can import.
+// Legacy selects SHA1/3DES encryption for clients that cannot read the
+// OpenSSL 3 defaults, such as older iOS releases.
+func ExportPKCS12(out, name string, certPEM, keyPEM, caPEM, password []byte, legacy bool) error {
+	tmp, err := os.MkdirTemp("", "doomctl-pkcs12-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	files := map[string][]byte{
+		"cert.pem": certPEM,
+		"key.pem":  keyPEM,
+		"ca.pem":   caPEM,
+		"password": password,
+	}
+	for f, data := range files {
+		if err := os.WriteFile(filepath.Join(tmp, f), data, 0o600); err != nil {
+			return err
+		}
+	}
+
+	args := []string{
+		"pkcs12", "-export",
+		"-name", name,
+		"-in", filepath.Join(tmp, "cert.pem"),
+		"-inkey", filepath.Join(tmp, "key.pem"),
+		"-certfile", filepath.Join(tmp, "ca.pem"),
+		"-passout", "file:" + filepath.Join(tmp, "password"),
+		"-out", out,
+	}
+	if legacy {
+		args = append(args, "-keypbe", "PBE-SHA1-3DES", "-certpbe", "PBE-SHA1-3DES", "-macalg", "sha1")
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("openssl", args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("openssl pkcs12: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return os.Chmod(out, 0o600)
+}
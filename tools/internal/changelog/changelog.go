@@ -0,0 +1,239 @@
+// Package changelog summarises what a flake.lock bump changes on each host:
+// updated inputs, package versions, closure size, kernel and whether the
+// host needs a reboot to pick the change up.
+package changelog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/orther/doomlab/tools/internal/fleet"
+	"github.com/orther/doomlab/tools/internal/nix"
+)
+
+// Input is a flake input whose locked revision changed.
+type Input struct {
+	Name string `json:"name"`
+	Old  string `json:"old"`
+	New  string `json:"new"`
+}
+
+// Package is a version change reported by nix store diff-closures. Old or
+// New is empty when the package was added or removed.
+type Package struct {
+	Name string `json:"name"`
+	Old  string `json:"old"`
+	New  string `json:"new"`
+	Size string `json:"size,omitempty"`
+}
+
+// System is what a host evaluates to under one lock file.
+type System struct {
+	Toplevel    string `json:"toplevel"`
+	Kernel      string `json:"kernel"`
+	KernelPath  string `json:"kernelPath"`
+	Initrd      string `json:"initrd"`
+	Systemd     string `json:"systemd"`
+	Release     string `json:"release"`
+	ClosureSize int64  `json:"closureSize,omitempty"`
+}
+
+// Host is the change to one host.
+type Host struct {
+	Name     string    `json:"name"`
+	Old      System    `json:"old"`
+	New      System    `json:"new"`
+	Built    bool      `json:"built"`
+	Packages []Package `json:"packages,omitempty"`
+	Reboot   bool      `json:"reboot"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// Changed reports whether the bump changes the host's system at all.
+func (h Host) Changed() bool { return h.Old.Toplevel != h.New.Toplevel }
+
+// Report is the changelog of one bump.
+type Report struct {
+	Inputs []Input `json:"inputs"`
+	Hosts  []Host  `json:"hosts"`
+}
+
+// Inputs compares the locked revisions of two flake.lock files.
+func Inputs(oldLock, newLock []byte) ([]Input, error) {
+	old, err := lockedRevs(oldLock)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := lockedRevs(newLock)
+	if err != nil {
+		return nil, err
+	}
+	var inputs []Input
+	for name, rev := range updated {
+		if old[name] != rev {
+			inputs = append(inputs, Input{Name: name, Old: old[name], New: rev})
+		}
+	}
+	for name, rev := range old {
+		if _, ok := updated[name]; !ok {
+			inputs = append(inputs, Input{Name: name, Old: rev})
+		}
+	}
+	sort.Slice(inputs, func(i, j int) bool { return inputs[i].Name < inputs[j].Name })
+	return inputs, nil
+}
+
+func lockedRevs(lock []byte) (map[string]string, error) {
+	var parsed struct {
+		Nodes map[string]struct {
+			Locked struct {
+				Rev     string `json:"rev"`
+				NarHash string `json:"narHash"`
+			} `json:"locked"`
+		} `json:"nodes"`
+	}
+	if err := json.Unmarshal(lock, &parsed); err != nil {
+		return nil, fmt.Errorf("parsing flake.lock: %w", err)
+	}
+	revs := make(map[string]string)
+	for name, n := range parsed.Nodes {
+		switch {
+		case n.Locked.Rev != "":
+			revs[name] = n.Locked.Rev
+		case n.Locked.NarHash != "":
+			revs[name] = n.Locked.NarHash
+		}
+	}
+	return revs, nil
+}
+
+// systemExpr picks what decides whether a host needs a reboot: the kernel
+// and initrd only take effect on boot, and a new systemd is only partly
+// picked up by daemon-reexec. Darwin hosts have none of them.
+const systemExpr = `cfg: {
+  toplevel = cfg.system.build.toplevel.outPath;
+  kernel = cfg.boot.kernelPackages.kernel.version or "";
+  kernelPath = if cfg ? boot then cfg.system.build.kernel.outPath else "";
+  initrd = if cfg ? boot then cfg.system.build.initialRamdisk.outPath or "" else "";
+  systemd = cfg.systemd.package.version or "";
+  release = cfg.system.nixos.release or cfg.system.darwinLabel or "";
+}`
+
+// Compare evaluates a host under both lock files and, when build is set,
+// builds both systems and diffs their closures. The flake's source is the
+// same for both; only the lock file differs.
+func Compare(ctx context.Context, flake string, h fleet.Host, oldLock, newLock string, build bool) Host {
+	c := Host{Name: h.Name}
+	if h.Err != nil {
+		c.Error = h.Err.Error()
+		return c
+	}
+	for _, side := range []struct {
+		lock string
+		sys  *System
+	}{{oldLock, &c.Old}, {newLock, &c.New}} {
+		if err := nix.JSON(ctx, side.sys, "eval", "--json", "--no-write-lock-file",
+			"--reference-lock-file", side.lock, flake+"#"+h.Config(), "--apply", systemExpr); err != nil {
+			c.Error = err.Error()
+			return c
+		}
+	}
+	c.Reboot = c.Old.KernelPath != c.New.KernelPath || c.Old.Initrd != c.New.Initrd ||
+		majorVersion(c.Old.Systemd) != majorVersion(c.New.Systemd)
+	if !build || !c.Changed() {
+		return c
+	}
+
+	for _, side := range []struct {
+		lock string
+		sys  *System
+	}{{oldLock, &c.Old}, {newLock, &c.New}} {
+		if _, err := nix.Run(ctx, "build", "--no-link", "--no-write-lock-file",
+			"--reference-lock-file", side.lock, flake+"#"+h.Toplevel()); err != nil {
+			c.Error = err.Error()
+			return c
+		}
+		size, err := closureSize(ctx, side.sys.Toplevel)
+		if err != nil {
+			c.Error = err.Error()
+			return c
+		}
+		side.sys.ClosureSize = size
+	}
+	out, err := nix.Run(ctx, "store", "diff-closures", c.Old.Toplevel, c.New.Toplevel)
+	if err != nil {
+		c.Error = err.Error()
+		return c
+	}
+	c.Built = true
+	c.Packages = parseDiff(string(out))
+	return c
+}
+
+func majorVersion(v string) string {
+	major, _, _ := strings.Cut(v, ".")
+	return major
+}
+
+func closureSize(ctx context.Context, path string) (int64, error) {
+	out, err := nix.Run(ctx, "path-info", "--json", "--closure-size", path)
+	if err != nil {
+		return 0, err
+	}
+	type info struct {
+		Path        string `json:"path"`
+		ClosureSize int64  `json:"closureSize"`
+	}
+	// nix 2.19 changed the output from a list to an object keyed by path
+	var byPath map[string]info
+	if err := json.Unmarshal(out, &byPath); err == nil {
+		return byPath[path].ClosureSize, nil
+	}
+	var list []info
+	if err := json.Unmarshal(out, &list); err != nil {
+		return 0, fmt.Errorf("parsing nix path-info: %w", err)
+	}
+	for _, i := range list {
+		if i.Path == path {
+			return i.ClosureSize, nil
+		}
+	}
+	return 0, fmt.Errorf("nix path-info did not report %s", path)
+}
+
+// diff-closures prints lines such as
+//
+//	openssl: 3.0.14 → 3.0.15, +12.3 KiB
+//	foo: ∅ → 1.2, +1.1 MiB
+//	bar: +4.0 KiB
+//
+// where ∅ marks a package that is absent on one side and the last form is a
+// rebuild of the same version, which is left out.
+var (
+	diffLine = regexp.MustCompile(`^(\S+): (.+ → .+?)(?:, ([+-][\d.]+ \w+))?$`)
+	ansi     = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+)
+
+func parseDiff(out string) []Package {
+	var pkgs []Package
+	for _, line := range strings.Split(ansi.ReplaceAllString(out, ""), "\n") {
+		m := diffLine.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		old, updated, _ := strings.Cut(m[2], " → ")
+		pkgs = append(pkgs, Package{Name: m[1], Old: absent(old), New: absent(updated), Size: m[3]})
+	}
+	return pkgs
+}
+
+func absent(v string) string {
+	if v == "∅" {
+		return ""
+	}
+	return v
+}
@@ -0,0 +1,58 @@
+package changelog
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want []Package
+	}{
+		{
+			name: "upgrade with size",
+			out:  "openssl: 3.0.14 → 3.0.15, +12.3 KiB\n",
+			want: []Package{{Name: "openssl", Old: "3.0.14", New: "3.0.15", Size: "+12.3 KiB"}},
+		},
+		{
+			name: "added and removed",
+			out:  "foo: ∅ → 1.2, +1.1 MiB\nbar: 0.9 → ∅, -300.0 KiB\n",
+			want: []Package{
+				{Name: "foo", Old: "", New: "1.2", Size: "+1.1 MiB"},
+				{Name: "bar", Old: "0.9", New: "", Size: "-300.0 KiB"},
+			},
+		},
+		{
+			name: "without size",
+			out:  "linux: 6.6.50 → 6.6.52\n",
+			want: []Package{{Name: "linux", Old: "6.6.50", New: "6.6.52"}},
+		},
+		{
+			name: "several versions on one side",
+			out:  "python3: 3.11.9, 3.12.5 → 3.11.10, 3.12.6, +1.0 MiB\n",
+			want: []Package{{Name: "python3", Old: "3.11.9, 3.12.5", New: "3.11.10, 3.12.6", Size: "+1.0 MiB"}},
+		},
+		{
+			name: "rebuilds are left out",
+			out:  "bar: +4.0 KiB\nbaz: -1.0 KiB\n",
+		},
+		{
+			name: "colours are stripped",
+			out:  "\x1b[1mopenssl\x1b[0m: 3.0.14 → \x1b[32;1m3.0.15\x1b[0m, \x1b[31;1m+12.3 KiB\x1b[0m\n",
+			want: []Package{{Name: "openssl", Old: "3.0.14", New: "3.0.15", Size: "+12.3 KiB"}},
+		},
+		{
+			name: "empty",
+			out:  "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseDiff(tt.out); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseDiff() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package changelog
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// WriteMarkdown renders the report for a commit message or pull request
+// body.
+func WriteMarkdown(w io.Writer, r Report) error {
+	var b strings.Builder
+
+	if len(r.Inputs) == 0 {
+		b.WriteString("No flake inputs changed.\n")
+	} else {
+		b.WriteString("| Input | Old | New |\n| --- | --- | --- |\n")
+		for _, in := range r.Inputs {
+			fmt.Fprintf(&b, "| %s | %s | %s |\n", in.Name, orDash(short(in.Old)), orDash(short(in.New)))
+		}
+	}
+
+	b.WriteString("\n| Host | System | Kernel | Closure | Reboot |\n| --- | --- | --- | --- | --- |\n")
+	for _, h := range r.Hosts {
+		switch {
+		case h.Error != "":
+			fmt.Fprintf(&b, "| %s | failed | | | |\n", h.Name)
+		case !h.Changed():
+			fmt.Fprintf(&b, "| %s | unchanged | %s | | |\n", h.Name, h.New.Kernel)
+		default:
+			fmt.Fprintf(&b, "| %s | %s | %s | %s | %s |\n", h.Name, changeSummary(h), arrow(h.Old.Kernel, h.New.Kernel),
+				closure(h), yesNo(h.Reboot))
+		}
+	}
+
+	for _, h := range r.Hosts {
+		if h.Error != "" {
+			fmt.Fprintf(&b, "\n**%s** could not be compared: `%s`\n", h.Name, h.Error)
+			continue
+		}
+		if len(h.Packages) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\n<details><summary>%s: %d packages</summary>\n\n", h.Name, len(h.Packages))
+		b.WriteString("| Package | Old | New | Size |\n| --- | --- | --- | --- |\n")
+		for _, p := range h.Packages {
+			fmt.Fprintf(&b, "| %s | %s | %s | %s |\n", p.Name, orDash(p.Old), orDash(p.New), p.Size)
+		}
+		b.WriteString("\n</details>\n")
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func changeSummary(h Host) string {
+	if !h.Built {
+		return "changed (not built)"
+	}
+	var added, removed, updated int
+	for _, p := range h.Packages {
+		switch {
+		case p.Old == "":
+			added++
+		case p.New == "":
+			removed++
+		default:
+			updated++
+		}
+	}
+	return fmt.Sprintf("%d updated, %d added, %d removed", updated, added, removed)
+}
+
+func closure(h Host) string {
+	if !h.Built {
+		return ""
+	}
+	delta := h.New.ClosureSize - h.Old.ClosureSize
+	sign := "+"
+	if delta < 0 {
+		sign, delta = "-", -delta
+	}
+	return fmt.Sprintf("%s (%s%s)", bytes(h.New.ClosureSize), sign, bytes(delta))
+}
+
+func bytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func arrow(old, updated string) string {
+	if old == updated {
+		return updated
+	}
+	return orDash(old) + " → " + orDash(updated)
+}
+
+// short trims git revisions to 7 characters and NAR hashes to a prefix
+// long enough to tell them apart.
+func short(rev string) string {
+	if strings.HasPrefix(rev, "sha256-") && len(rev) > 19 {
+		return rev[:19]
+	}
+	if len(rev) > 7 {
+		return rev[:7]
+	}
+	return rev
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "**yes**"
+	}
+	return "no"
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,104 @@
+// Package facter captures nixos-facter hardware reports over SSH and reads
+// the parts modules/nixos/hardware.nix derives settings from.
+package facter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	"github.com/orther/doomlab/tools/internal/remote"
+)
+
+// nixos-facter reads hardware details only root can see.
+const captureScript = "sudo -n nix --extra-experimental-features 'nix-command flakes' run nixpkgs#nixos-facter\n"
+
+// Capture runs nixos-facter on host and returns its report, indented for
+// committing.
+func Capture(ctx context.Context, ssh remote.Options, host string) ([]byte, error) {
+	out, err := ssh.Run(ctx, host, captureScript)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := Parse(out); err != nil {
+		return nil, fmt.Errorf("nixos-facter on %s: %w", host, err)
+	}
+	var b bytes.Buffer
+	if err := json.Indent(&b, bytes.TrimSpace(out), "", "  "); err != nil {
+		return nil, err
+	}
+	b.WriteByte('\n')
+	return b.Bytes(), nil
+}
+
+type named struct {
+	Name string `json:"name"`
+}
+
+type device struct {
+	SubClass        named    `json:"sub_class"`
+	DriverModules   []string `json:"driver_modules"`
+	UnixDeviceNames []string `json:"unix_device_names"`
+}
+
+type report struct {
+	System         string `json:"system"`
+	Virtualisation string `json:"virtualisation"`
+	Hardware       struct {
+		CPU []struct {
+			VendorName string `json:"vendor_name"`
+		} `json:"cpu"`
+		NetworkController []device `json:"network_controller"`
+		NetworkInterface  []device `json:"network_interface"`
+	} `json:"hardware"`
+}
+
+// Summary is what a report resolves to on the machine.
+type Summary struct {
+	System         string
+	Virtualisation string
+	Microcode      string // "intel", "amd" or empty
+	Interfaces     []string
+	NetworkDrivers []string
+}
+
+// Parse reads a report the way hardware.nix does.
+func Parse(data []byte) (*Summary, error) {
+	var r report
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	if r.System == "" {
+		return nil, fmt.Errorf("report has no system")
+	}
+	s := &Summary{System: r.System, Virtualisation: r.Virtualisation}
+	if len(r.Hardware.CPU) > 0 {
+		switch r.Hardware.CPU[0].VendorName {
+		case "GenuineIntel":
+			s.Microcode = "intel"
+		case "AuthenticAMD":
+			s.Microcode = "amd"
+		}
+	}
+	add := func(list *[]string, items []string) {
+		for _, item := range items {
+			if !slices.Contains(*list, item) {
+				*list = append(*list, item)
+			}
+		}
+	}
+	for _, c := range r.Hardware.NetworkController {
+		if c.SubClass.Name == "Ethernet controller" {
+			add(&s.NetworkDrivers, c.DriverModules)
+		}
+	}
+	for _, i := range r.Hardware.NetworkInterface {
+		if i.SubClass.Name == "Ethernet" {
+			add(&s.NetworkDrivers, i.DriverModules)
+			add(&s.Interfaces, i.UnixDeviceNames)
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,88 @@
+package facter
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	sample, err := os.ReadFile("testdata/report.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	intel, err := os.ReadFile("testdata/intel.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		report  string
+		want    *Summary
+		wantErr bool
+	}{
+		{
+			// the reports lib/hardware-check.nix evaluates hardware.nix against
+			name:   "sample",
+			report: string(sample),
+			want: &Summary{
+				System:         "x86_64-linux",
+				Virtualisation: "none",
+				Microcode:      "amd",
+				Interfaces:     []string{"enp1s0"},
+				NetworkDrivers: []string{"r8169"},
+			},
+		},
+		{
+			name:   "intel sample",
+			report: string(intel),
+			want: &Summary{
+				System:         "x86_64-linux",
+				Virtualisation: "none",
+				Microcode:      "intel",
+				Interfaces:     []string{"enp2s0"},
+				NetworkDrivers: []string{"igc"},
+			},
+		},
+		{
+			name: "intel guest",
+			report: `{"system": "x86_64-linux", "virtualisation": "kvm", "hardware": {
+				"cpu": [{"vendor_name": "GenuineIntel"}],
+				"network_interface": [{"sub_class": {"name": "Ethernet"}, "driver_modules": ["virtio_net"], "unix_device_names": ["ens3"]}]
+			}}`,
+			want: &Summary{
+				System:         "x86_64-linux",
+				Virtualisation: "kvm",
+				Microcode:      "intel",
+				Interfaces:     []string{"ens3"},
+				NetworkDrivers: []string{"virtio_net"},
+			},
+		},
+		{
+			name:   "no hardware",
+			report: `{"system": "aarch64-linux"}`,
+			want:   &Summary{System: "aarch64-linux"},
+		},
+		{
+			name:    "no system",
+			report:  `{"hardware": {}}`,
+			wantErr: true,
+		},
+		{
+			name:    "not JSON",
+			report:  "nixos-facter: permission denied",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse([]byte(tt.report))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+// Package fleet lists the hosts of the flake and evaluates what each of
+// them should be running.
+package fleet
+
+import (
+	"context"
+	"runtime"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/orther/doomlab/tools/internal/nix"
+)
+
+// Host is a deployable configuration of the flake.
+type Host struct {
+	Name     string   `json:"name"`
+	Kind     string   `json:"kind"`
+	System   string   `json:"system"`
+	Hostname string   `json:"hostname"`
+	Roles    []string `json:"roles"`
+	Services []string `json:"services"`
+	// Units maps each service to its systemd units.
+	Units map[string][]string `json:"units"`
+
+	// Err is set instead of the fields above when the host fails to
+	// evaluate, so one broken machine does not hide the rest.
+	Err error `json:"-"`
+}
+
+// summary keeps the host's evaluation on the nix side; only the fields of
+// Host cross over.
+const summary = `h: {
+  inherit (h) name kind system hostname roles;
+  services = builtins.attrNames h.services;
+  units = builtins.mapAttrs (_: s: s.units) h.services;
+}`
+
+// Hosts evaluates the hosts of the flake, a few at a time, and returns them
+// sorted by name, leaving out installer images, which never run as a
+// deployed system. Hosts that fail to evaluate are returned with Err set.
+func Hosts(ctx context.Context, flake string) ([]Host, error) {
+	var names []string
+	if err := nix.EvalApply(ctx, flake, "inventory", "builtins.attrNames", &names); err != nil {
+		return nil, err
+	}
+
+	all := make([]Host, len(names))
+	sem := make(chan struct{}, runtime.NumCPU())
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if err := nix.EvalApply(ctx, flake, "inventory."+name, summary, &all[i]); err != nil {
+				all[i] = Host{Name: name, Hostname: name, Err: err}
+			}
+		}()
+	}
+	wg.Wait()
+
+	var hosts []Host
+	for _, h := range all {
+		if !slices.Contains(h.Roles, "installer") {
+			hosts = append(hosts, h)
+		}
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Name < hosts[j].Name })
+	return hosts, nil
+}
+
+// Select returns the hosts named in names, or all of them when names is
+// empty, and the names that matched no host.
+func Select(hosts []Host, names []string) (selected []Host, unknown []string) {
+	if len(names) == 0 {
+		return hosts, nil
+	}
+	for _, n := range names {
+		i := slices.IndexFunc(hosts, func(h Host) bool { return h.Name == n })
+		if i < 0 {
+			unknown = append(unknown, n)
+			continue
+		}
+		selected = append(selected, hosts[i])
+	}
+	return selected, unknown
+}
+
+// Config is the flake attribute of the host's evaluated configuration.
+func (h Host) Config() string {
+	if h.Kind == "darwin" {
+		return "darwinConfigurations." + h.Name + ".config"
+	}
+	return "nixosConfigurations." + h.Name + ".config"
+}
+
+// Filter returns the hosts that have every role in roles and run every
+// service in services.
+func Filter(hosts []Host, roles, services []string) []Host {
+	var matched []Host
+	for _, h := range hosts {
+		if containsAll(h.Roles, roles) && containsAll(h.Services, services) {
+			matched = append(matched, h)
+		}
+	}
+	return matched
+}
+
+func containsAll(have, want []string) bool {
+	for _, w := range want {
+		if !slices.Contains(have, w) {
+			return false
+		}
+	}
+	return true
+}
+
+// Toplevel is the flake attribute of the host's system closure.
+func (h Host) Toplevel() string {
+	return h.Config() + ".system.build.toplevel"
+}
+
+// Revision is the flake revision a system was built from, as written to
+// /etc/doomlab-revision by modules/_fleet.nix.
+type Revision struct {
+	Rev          string `json:"rev"`
+	Dirty        bool   `json:"dirty"`
+	LastModified int64  `json:"lastModified"`
+}
+
+// Short returns the first 7 characters of the revision, keeping the
+// -dirty suffix nix adds to dirty revisions.
+func (r Revision) Short() string {
+	if len(r.Rev) < 7 {
+		return r.Rev
+	}
+	short := r.Rev[:7]
+	if r.Dirty {
+		short += "-dirty"
+	}
+	return short
+}
+
+// Metadata returns the revision of a flake reference, e.g. the head of main
+// for "github:orther/doomlab".
+func Metadata(ctx context.Context, flake string) (Revision, error) {
+	var meta struct {
+		Revision      string `json:"revision"`
+		DirtyRevision string `json:"dirtyRevision"`
+		LastModified  int64  `json:"lastModified"`
+	}
+	if err := nix.JSON(ctx, &meta, "flake", "metadata", "--json", flake); err != nil {
+		return Revision{}, err
+	}
+	if meta.Revision == "" {
+		return Revision{Rev: meta.DirtyRevision, Dirty: true, LastModified: meta.LastModified}, nil
+	}
+	return Revision{Rev: meta.Revision, LastModified: meta.LastModified}, nil
+}
@@ -0,0 +1,163 @@
+// Package inventory loads the per-host facts exposed by the flake's
+// `inventory` output (lib/inventory.nix) and renders them as reports.
+package inventory
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/orther/doomlab/tools/internal/nix"
+)
+
+// Host is what one nixosConfiguration or darwinConfiguration runs.
+type Host struct {
+	Name     string             `json:"name"`
+	Kind     string             `json:"kind"`
+	System   string             `json:"system"`
+	Hostname string             `json:"hostname"`
+	Roles    []string           `json:"roles"`
+	Services map[string]Service `json:"services"`
+	Firewall Firewall           `json:"firewall"`
+	Vhosts   []Vhost            `json:"vhosts"`
+	Tunnels  []Tunnel           `json:"tunnels"`
+	Persist  []string           `json:"persist"`
+	Secrets  []Secret           `json:"secrets"`
+	Backups  []Backup           `json:"backups"`
+
+	// Error is set instead of the fields above when the host fails to
+	// evaluate, so one broken machine does not hide the rest.
+	Error string `json:"error,omitempty"`
+}
+
+// Service is an entry of doomlab.services (services/_registry.nix).
+type Service struct {
+	Description string   `json:"description"`
+	Units       []string `json:"units"`
+	Ports       Ports    `json:"ports"`
+	HostNetwork bool     `json:"hostNetwork"`
+	Persist     []string `json:"persist"`
+	Backups     []string `json:"backups"`
+}
+
+// Ports a service listens on.
+type Ports struct {
+	TCP    []int `json:"tcp"`
+	UDP    []int `json:"udp"`
+	Shared []int `json:"shared"`
+}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	From int `json:"from"`
+	To   int `json:"to"`
+}
+
+// Rules are the ports opened globally or on one interface.
+type Rules struct {
+	TCP       []int       `json:"tcp"`
+	UDP       []int       `json:"udp"`
+	TCPRanges []PortRange `json:"tcpRanges"`
+	UDPRanges []PortRange `json:"udpRanges"`
+}
+
+// Firewall is the host's networking.firewall.
+type Firewall struct {
+	Enable bool `json:"enable"`
+	Rules
+	Interfaces map[string]Rules `json:"interfaces"`
+}
+
+// Vhost is an nginx virtual host.
+type Vhost struct {
+	Name       string   `json:"name"`
+	ServerName string   `json:"serverName"`
+	Aliases    []string `json:"aliases"`
+	TLS        bool     `json:"tls"`
+	Issuer     *string  `json:"issuer"`
+	Upstreams  []string `json:"upstreams"`
+	ClientCert bool     `json:"clientCert"`
+	Allow      []string `json:"allow"`
+}
+
+// Tunnel is a hostname published through Cloudflare Tunnel.
+type Tunnel struct {
+	Hostname string   `json:"hostname"`
+	Service  string   `json:"service"`
+	Tunnels  []string `json:"tunnels"`
+}
+
+// Secret is a sops secret rendered on the host.
+type Secret struct {
+	Name  string  `json:"name"`
+	File  string  `json:"file"`
+	Owner *string `json:"owner"`
+}
+
+// Backup is a backup-<name> job.
+type Backup struct {
+	Name     string   `json:"name"`
+	Unit     string   `json:"unit"`
+	Schedule *string  `json:"schedule"`
+	Paths    []string `json:"paths"`
+}
+
+// Load evaluates every host of the flake, a few at a time, and returns them
+// sorted by name. Hosts that fail to evaluate are returned with Error set.
+func Load(ctx context.Context, flake string, jobs int) ([]Host, error) {
+	var names []string
+	if err := nix.EvalApply(ctx, flake, "inventory", "builtins.attrNames", &names); err != nil {
+		return nil, err
+	}
+
+	hosts := make([]Host, len(names))
+	sem := make(chan struct{}, max(jobs, 1))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if err := nix.Eval(ctx, flake, "inventory."+name, &hosts[i]); err != nil {
+				hosts[i] = Host{Name: name, Error: err.Error()}
+			}
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Name < hosts[j].Name })
+	return hosts, nil
+}
+
+// LoadHost evaluates a single host of the flake.
+func LoadHost(ctx context.Context, flake, name string) (Host, error) {
+	var h Host
+	err := nix.Eval(ctx, flake, "inventory."+name, &h)
+	return h, err
+}
+
+// LoadFile reads an inventory written by `doomctl inventory -format json`,
+// or the flake's `inventory` output as an attribute set of hosts.
+func LoadFile(path string) ([]Host, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var hosts []Host
+	if err := json.Unmarshal(data, &hosts); err == nil {
+		return hosts, nil
+	}
+	var byName map[string]Host
+	if err := json.Unmarshal(data, &byName); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for _, h := range byName {
+		hosts = append(hosts, h)
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Name < hosts[j].Name })
+	return hosts, nil
+}
@@ -0,0 +1,146 @@
+package inventory
+
+import (
+	_ "embed"
+	htmltemplate "html/template"
+	"io"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+)
+
+// Placement answers "where does this service run": its host, ports, the
+// domains that proxy to it and where it is backed up.
+type Placement struct {
+	Service     string
+	Description string
+	Host        string
+	TCP         []int
+	UDP         []int
+	Domains     []string
+	Backups     []string
+	Schedule    string
+}
+
+// Placements lists every service of every host, sorted by service name.
+func Placements(hosts []Host) []Placement {
+	var out []Placement
+	for _, h := range hosts {
+		for name, s := range h.Services {
+			p := Placement{
+				Service:     name,
+				Description: s.Description,
+				Host:        h.Name,
+				TCP:         s.Ports.TCP,
+				UDP:         s.Ports.UDP,
+				Backups:     s.Backups,
+			}
+			for _, v := range h.Vhosts {
+				// loopback listeners such as a tunnel's origin have no domain
+				if v.ServerName == "localhost" {
+					continue
+				}
+				if proxiesTo(v.Upstreams, s.Ports.TCP) {
+					p.Domains = append(p.Domains, v.ServerName)
+				}
+			}
+			for _, t := range h.Tunnels {
+				if proxiesTo([]string{t.Service}, s.Ports.TCP) && !slices.Contains(p.Domains, t.Hostname) {
+					p.Domains = append(p.Domains, t.Hostname)
+				}
+			}
+			for _, b := range h.Backups {
+				if b.Name == name && b.Schedule != nil {
+					p.Schedule = *b.Schedule
+				}
+			}
+			sort.Strings(p.Domains)
+			out = append(out, p)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Service != out[j].Service {
+			return out[i].Service < out[j].Service
+		}
+		return out[i].Host < out[j].Host
+	})
+	return out
+}
+
+// proxiesTo reports whether any upstream URL points at one of ports on the
+// local host.
+func proxiesTo(upstreams []string, ports []int) bool {
+	for _, u := range upstreams {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			continue
+		}
+		switch parsed.Hostname() {
+		case "localhost", "127.0.0.1", "::1":
+		default:
+			continue
+		}
+		port, err := strconv.Atoi(parsed.Port())
+		if err == nil && slices.Contains(ports, port) {
+			return true
+		}
+	}
+	return false
+}
+
+var funcs = map[string]any{
+	"join": strings.Join,
+	"ports": func(ports []int, ranges []PortRange) string {
+		var s []string
+		for _, p := range ports {
+			s = append(s, strconv.Itoa(p))
+		}
+		for _, r := range ranges {
+			s = append(s, strconv.Itoa(r.From)+"-"+strconv.Itoa(r.To))
+		}
+		return strings.Join(s, ", ")
+	},
+	"deref": func(s *string) string {
+		if s == nil {
+			return ""
+		}
+		return *s
+	},
+	"sortedKeys": func(m map[string]Rules) []string {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return keys
+	},
+}
+
+type report struct {
+	Hosts      []Host
+	Placements []Placement
+}
+
+//go:embed report.md.tmpl
+var markdownSource string
+
+//go:embed report.html.tmpl
+var htmlSource string
+
+var (
+	markdownTemplate = texttemplate.Must(texttemplate.New("markdown").Funcs(funcs).Parse(markdownSource))
+	htmlTemplate     = htmltemplate.Must(htmltemplate.New("html").Funcs(funcs).Parse(htmlSource))
+)
+
+// WriteMarkdown renders the inventory as a Markdown document.
+func WriteMarkdown(w io.Writer, hosts []Host) error {
+	return markdownTemplate.Execute(w, report{hosts, Placements(hosts)})
+}
+
+// WriteHTML renders the inventory as a standalone HTML page.
+func WriteHTML(w io.Writer, hosts []Host) error {
+	return htmlTemplate.Execute(w, report{hosts, Placements(hosts)})
+}
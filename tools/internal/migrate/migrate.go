@@ -0,0 +1,289 @@
+// Package migrate moves a doomlab.services entry and its persisted state
+// from one host to another: it edits the machine imports, checks the
+// destination can decrypt the secrets it will need and copies the service's
+// directories under the persistence root between hosts.
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/orther/doomlab/tools/internal/inventory"
+	"github.com/orther/doomlab/tools/internal/remote"
+	"github.com/orther/doomlab/tools/internal/scaffold"
+	"github.com/orther/doomlab/tools/internal/sops"
+)
+
+// PersistRoot is where impermanence keeps the state that survives a
+// reboot (modules/nixos/base.nix).
+const PersistRoot = "/nix/persist"
+
+// Plan is a service move that has passed the preflight checks.
+type Plan struct {
+	Service string
+	From    inventory.Host
+	To      inventory.Host
+	Units   []string
+	// Paths are the service's persist entries that the source host
+	// actually persists, and so are copied.
+	Paths []string
+	// Unpersisted are persist entries missing from the source's
+	// environment.persistence; they are lost on reboot and not copied.
+	Unpersisted []string
+	// Domains proxy to the service on the source host.
+	Domains []string
+	// Tunnels are published through Cloudflare Tunnel on the source host.
+	Tunnels []inventory.Tunnel
+}
+
+// NewPlan checks service can move from one host to another. moved reports
+// whether the destination already declares the service, as it does once
+// the machine imports are edited; otherwise it must not.
+func NewPlan(service string, from, to inventory.Host, moved bool) (*Plan, error) {
+	for _, h := range []inventory.Host{from, to} {
+		if h.Error != "" {
+			return nil, fmt.Errorf("%s does not evaluate: %s", h.Name, h.Error)
+		}
+		if h.Kind != "nixos" {
+			return nil, fmt.Errorf("%s is a %s host; services only run on nixos hosts", h.Name, h.Kind)
+		}
+	}
+	if from.Name == to.Name {
+		return nil, errors.New("source and destination are the same host")
+	}
+	svc, ok := from.Services[service]
+	if !ok {
+		return nil, fmt.Errorf("%s does not run %s", from.Name, service)
+	}
+	if _, ok := to.Services[service]; ok && !moved {
+		return nil, fmt.Errorf("%s already runs %s", to.Name, service)
+	}
+	if len(svc.Units) == 0 {
+		return nil, fmt.Errorf("%s declares no units to stop", service)
+	}
+
+	p := &Plan{Service: service, From: from, To: to, Units: svc.Units}
+	for _, path := range svc.Persist {
+		if slices.Contains(from.Persist, path) {
+			p.Paths = append(p.Paths, path)
+		} else {
+			p.Unpersisted = append(p.Unpersisted, path)
+		}
+	}
+	for _, pl := range inventory.Placements([]inventory.Host{from}) {
+		if pl.Service == service {
+			p.Domains = pl.Domains
+		}
+	}
+	for _, t := range from.Tunnels {
+		if slices.Contains(p.Domains, t.Hostname) {
+			p.Tunnels = append(p.Tunnels, t)
+		}
+	}
+	return p, nil
+}
+
+// Edit is a change to a file in the repository.
+type Edit struct {
+	Path    string
+	Summary string
+	Data    []byte
+}
+
+// Apply writes the edited file.
+func (e Edit) Apply() error { return os.WriteFile(e.Path, e.Data, 0o644) }
+
+// Originals holds files in the repository as they were before a move
+// changed them, so a move that fails can leave the checkout as it found it.
+type Originals map[string][]byte
+
+// Keep reads the files that are not kept yet. Files kept earlier keep
+// their first contents.
+func (o Originals) Keep(paths ...string) error {
+	for _, path := range paths {
+		if _, ok := o[path]; ok {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		o[path] = data
+	}
+	return nil
+}
+
+// Restore writes the kept contents of paths back.
+func (o Originals) Restore(paths ...string) error {
+	var errs []error
+	for _, path := range paths {
+		if data, ok := o[path]; ok {
+			errs = append(errs, os.WriteFile(path, data, 0o644))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// MoveImport edits machines/<from>/configuration.nix and
+// machines/<to>/configuration.nix under root so the service module is
+// imported by the destination instead of the source. A commented out
+// import on the destination is uncommented; otherwise the import is added
+// after the last service import.
+func MoveImport(root, service, from, to string) ([]Edit, error) {
+	module := "./../../services/" + service + ".nix"
+	importRe := regexp.MustCompile(`(?m)^([ \t]*)(#[ \t]*)?` + regexp.QuoteMeta(module) + `[ \t]*\n`)
+
+	fromPath := filepath.Join(root, "machines", from, "configuration.nix")
+	src, err := os.ReadFile(fromPath)
+	if err != nil {
+		return nil, err
+	}
+	var removed bool
+	src = importRe.ReplaceAllFunc(src, func(line []byte) []byte {
+		if m := importRe.FindSubmatch(line); m[2] != nil {
+			return line
+		}
+		removed = true
+		return nil
+	})
+	if !removed {
+		return nil, fmt.Errorf("%s does not import %s", fromPath, module)
+	}
+
+	toPath := filepath.Join(root, "machines", to, "configuration.nix")
+	dst, err := os.ReadFile(toPath)
+	if err != nil {
+		return nil, err
+	}
+	switch m := importRe.FindSubmatchIndex(dst); {
+	case m != nil && m[4] >= 0:
+		// uncomment
+		dst = slices.Concat(dst[:m[4]], dst[m[5]:])
+	case m != nil:
+		return nil, fmt.Errorf("%s already imports %s", toPath, module)
+	default:
+		last := regexp.MustCompile(`(?m)^([ \t]*)\./\.\./\.\./services/[^\n]*\n`).FindAllSubmatchIndex(dst, -1)
+		imports := regexp.MustCompile(`(?m)^([ \t]*)imports = \[[ \t]*\n`).FindSubmatchIndex(dst)
+		var at int
+		var indent string
+		switch {
+		case last != nil:
+			at, indent = last[len(last)-1][1], string(dst[last[len(last)-1][2]:last[len(last)-1][3]])
+		case imports != nil:
+			at, indent = imports[1], string(dst[imports[2]:imports[3]])+"  "
+		default:
+			return nil, fmt.Errorf("%s has no imports list to add %s to", toPath, module)
+		}
+		dst = slices.Concat(dst[:at], []byte(indent+module+"\n"), dst[at:])
+	}
+
+	return []Edit{
+		{Path: fromPath, Summary: "stop importing " + module, Data: src},
+		{Path: toPath, Summary: "import " + module, Data: dst},
+	}, nil
+}
+
+// AddAgeKey anchors host's age key in .sops.yaml under root if it is not
+// there yet, deriving it from the initrd SSH host key sops-nix decrypts
+// with (modules/nixos/base.nix). It returns the key it added, if any.
+func AddAgeKey(ctx context.Context, ssh remote.Options, root, host string) (string, error) {
+	path := filepath.Join(root, ".sops.yaml")
+	keys, err := sops.Keys(path)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := keys[host]; ok {
+		return "", nil
+	}
+	out, err := ssh.Run(ctx, host, "nix --extra-experimental-features 'nix-command flakes' run nixpkgs#ssh-to-age < /nix/secret/initrd/ssh_host_ed25519_key.pub")
+	if err != nil {
+		return "", fmt.Errorf("no age key for %s in .sops.yaml and reading it failed: %w", host, err)
+	}
+	key := strings.TrimSpace(string(out))
+	if !strings.HasPrefix(key, "age1") {
+		return "", fmt.Errorf("no age key for %s in .sops.yaml and ssh-to-age printed %q", host, key)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if data, err = scaffold.AddSopsKey(data, host, key); err != nil {
+		return "", err
+	}
+	return key, os.WriteFile(path, data, 0o644)
+}
+
+// Reencrypt returns the sops files among files that the host's age key,
+// anchored by host name in .sops.yaml under root, cannot decrypt yet.
+func Reencrypt(root, host string, files []string) ([]string, error) {
+	keys, err := sops.Keys(filepath.Join(root, ".sops.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	key, ok := keys[host]
+	if !ok {
+		return nil, fmt.Errorf("no age key for %s in .sops.yaml; add `- &%s <key>` from `ssh-to-age < /nix/secret/initrd/ssh_host_ed25519_key.pub` on %s and list it in the creation rules", host, host, host)
+	}
+	var stale []string
+	for _, f := range files {
+		recipients, err := sops.Recipients(filepath.Join(root, "secrets", f))
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(recipients, key) {
+			stale = append(stale, f)
+		}
+	}
+	return stale, nil
+}
+
+// Sync copies path, as persisted under PersistRoot, from one host to the
+// other through this machine. The destination copy is emptied first, so it
+// ends up identical to the source. Ownership is restored by user and group
+// name, which the destination has once the service is deployed there.
+func Sync(ctx context.Context, ssh remote.Options, from, to, path string, stderr io.Writer) error {
+	rel := strings.TrimPrefix(path, "/")
+	persisted := PersistRoot + "/" + rel
+
+	check := ssh.Exec(ctx, from, "sudo -n test -e "+remote.Quote(persisted))
+	if err := check.Run(); err != nil {
+		return fmt.Errorf("%s has no %s", from, persisted)
+	}
+
+	pack := ssh.Exec(ctx, from, "sudo -n tar -C "+PersistRoot+" --acls --xattrs -cpf - "+remote.Quote(rel))
+	// the persisted directory is bind mounted into place, so only its
+	// contents are removed
+	unpack := ssh.Exec(ctx, to, "sudo -n sh -c "+remote.Quote(
+		"if [ -d "+remote.Quote(persisted)+" ]; then find "+remote.Quote(persisted)+" -mindepth 1 -delete; fi && "+
+			"tar -C "+PersistRoot+" --acls --xattrs --same-owner -xpf -"))
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	pack.Stdout, pack.Stderr = w, stderr
+	unpack.Stdin, unpack.Stderr = r, stderr
+	if err := unpack.Start(); err != nil {
+		r.Close()
+		w.Close()
+		return err
+	}
+	r.Close()
+	packErr := pack.Run()
+	w.Close()
+	unpackErr := unpack.Wait()
+	if packErr != nil {
+		return fmt.Errorf("reading %s on %s: %w", persisted, from, packErr)
+	}
+	if unpackErr != nil {
+		return fmt.Errorf("writing %s on %s: %w", persisted, to, unpackErr)
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package migrate
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const source = `{
+  imports = [
+    ./hardware-configuration.nix
+
+    ./../../modules/profiles/server.nix
+
+    ./../../services/tailscale.nix
+    ./../../services/nixarr.nix
+  ];
+}
+`
+
+func TestMoveImport(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to string
+		wantFrom string
+		wantTo   string
+		wantErr  string
+	}{
+		{
+			name: "uncommented on the destination",
+			from: source,
+			to: `{
+  imports = [
+    ./../../services/tailscale.nix
+    #./../../services/nixarr.nix
+  ];
+}
+`,
+			wantFrom: `{
+  imports = [
+    ./hardware-configuration.nix
+
+    ./../../modules/profiles/server.nix
+
+    ./../../services/tailscale.nix
+  ];
+}
+`,
+			wantTo: `{
+  imports = [
+    ./../../services/tailscale.nix
+    ./../../services/nixarr.nix
+  ];
+}
+`,
+		},
+		{
+			name: "after the last service import",
+			from: source,
+			to: `{
+  imports = [
+    ./hardware-configuration.nix
+
+    ./../../services/tailscale.nix
+    # ./../../services/netdata.nix
+  ];
+}
+`,
+			wantTo: `{
+  imports = [
+    ./hardware-configuration.nix
+
+    ./../../services/tailscale.nix
+    ./../../services/nixarr.nix
+    # ./../../services/netdata.nix
+  ];
+}
+`,
+		},
+		{
+			name: "first service on the destination",
+			from: source,
+			to: `{
+  imports = [
+    ./hardware-configuration.nix
+  ];
+}
+`,
+			wantTo: `{
+  imports = [
+    ./../../services/nixarr.nix
+    ./hardware-configuration.nix
+  ];
+}
+`,
+		},
+		{
+			name:    "already on the destination",
+			from:    source,
+			to:      source,
+			wantErr: "already imports",
+		},
+		{
+			name: "commented out on the source",
+			from: `{
+  imports = [
+    #./../../services/nixarr.nix
+  ];
+}
+`,
+			to:      source,
+			wantErr: "does not import",
+		},
+		{
+			name:    "no imports on the destination",
+			from:    source,
+			to:      "{\n  networking.hostName = \"zinc\";\n}\n",
+			wantErr: "no imports list",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			for host, data := range map[string]string{"svr2chng": tt.from, "zinc": tt.to} {
+				dir := filepath.Join(root, "machines", host)
+				if err := os.MkdirAll(dir, 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(dir, "configuration.nix"), []byte(data), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			edits, err := MoveImport(root, "nixarr", "svr2chng", "zinc")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("MoveImport() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(edits) != 2 {
+				t.Fatalf("MoveImport() returned %d edits, want 2", len(edits))
+			}
+			if tt.wantFrom != "" && string(edits[0].Data) != tt.wantFrom {
+				t.Errorf("source =\n%s\nwant\n%s", edits[0].Data, tt.wantFrom)
+			}
+			if string(edits[1].Data) != tt.wantTo {
+				t.Errorf("destination =\n%s\nwant\n%s", edits[1].Data, tt.wantTo)
+			}
+		})
+	}
+}
+
+func TestOriginalsRestore(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		filepath.Join(root, "machines", "svr2chng", "configuration.nix"): source,
+		filepath.Join(root, "machines", "zinc", "configuration.nix"):     "{\n  imports = [\n    ./hardware-configuration.nix\n  ];\n}\n",
+	}
+	for path, data := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	edits, err := MoveImport(root, "nixarr", "svr2chng", "zinc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := Originals{}
+	for _, e := range edits {
+		if err := kept.Keep(e.Path); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.Apply(); err != nil {
+			t.Fatal(err)
+		}
+		// kept again after the edit, as a retried step would
+		if err := kept.Keep(e.Path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := kept.Restore(edits[0].Path, edits[1].Path, filepath.Join(root, "never-kept")); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range files {
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s =\n%s\nwant\n%s", path, got, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "never-kept")); !os.IsNotExist(err) {
+		t.Errorf("restoring a file that was never kept created it: %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+// Package nix evaluates the flake with the nix binary so doomctl reads the
+// same configurations that nixos-rebuild and darwin-rebuild build.
+package nix
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Eval evaluates an attribute of a flake, e.g. Eval(ctx, ".", "inventory.noir",
+// &host), and decodes the JSON result into v.
+func Eval(ctx context.Context, flake, attr string, v any) error {
+	return eval(ctx, v, flake+"#"+attr)
+}
+
+// EvalApply is Eval with a function applied to the attribute first, which
+// keeps large attribute sets on the nix side: EvalApply(ctx, ".",
+// "inventory", "builtins.attrNames", &names).
+func EvalApply(ctx context.Context, flake, attr, apply string, v any) error {
+	return eval(ctx, v, flake+"#"+attr, "--apply", apply)
+}
+
+func eval(ctx context.Context, v any, args ...string) error {
+	return JSON(ctx, v, append([]string{"eval", "--json"}, args...)...)
+}
+
+// JSON runs a nix command that prints JSON and decodes it into v.
+func JSON(ctx context.Context, v any, args ...string) error {
+	out, err := Run(ctx, args...)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(out, v)
+}
+
+// Run runs nix with flakes enabled and returns its standard output.
+func Run(ctx context.Context, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "nix", append([]string{"--extra-experimental-features", "nix-command flakes"}, args...)...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("nix %s: %w: %s", args[0], err, lastLine(stderr.String()))
+	}
+	return out, nil
+}
+
+// lastLine keeps the error nix ends with rather than the whole trace.
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
@@ -0,0 +1,108 @@
+// Package remote runs shell scripts on fleet hosts over SSH, using the
+// caller's SSH configuration and agent.
+package remote
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// DefaultUser is the account `just deploy` logs in as; it is in wheel on
+// every host and has the deploy keys authorized.
+const DefaultUser = "orther"
+
+// Options control how hosts are reached.
+type Options struct {
+	// User to log in as; empty uses the SSH configuration.
+	User string
+	// ConnectTimeout in seconds; zero uses 10.
+	ConnectTimeout int
+}
+
+// Register adds the -user flag to fs.
+func (o *Options) Register(fs *flag.FlagSet) {
+	fs.StringVar(&o.User, "user", DefaultUser, "SSH user; empty uses your SSH configuration")
+}
+
+// Target returns the SSH destination for host.
+func (o Options) Target(host string) string {
+	if o.User == "" {
+		return host
+	}
+	return o.User + "@" + host
+}
+
+// Command returns an ssh command that runs script with sh on host. The
+// script is passed on stdin so it needs no quoting.
+func (o Options) Command(ctx context.Context, host, script string) *exec.Cmd {
+	cmd := o.Exec(ctx, host, "sh -s")
+	cmd.Stdin = strings.NewReader(script)
+	return cmd
+}
+
+// Exec returns an ssh command that runs command on host, leaving stdin and
+// stdout free for piping data through it. command is interpreted by the
+// remote shell, so arguments must be quoted.
+func (o Options) Exec(ctx context.Context, host, command string) *exec.Cmd {
+	timeout := o.ConnectTimeout
+	if timeout == 0 {
+		timeout = 10
+	}
+	return exec.CommandContext(ctx, "ssh",
+		"-o", "BatchMode=yes",
+		"-o", fmt.Sprintf("ConnectTimeout=%d", timeout),
+		o.Target(host), command)
+}
+
+// Run runs script on host and returns its standard output.
+func (o Options) Run(ctx context.Context, host, script string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := o.Command(ctx, host, script)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return out, fmt.Errorf("ssh %s: %w: %s", host, err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// Fields parses key=value lines, as printed by the scripts doomctl runs.
+func Fields(out []byte) map[string]string {
+	fields := make(map[string]string)
+	for _, line := range strings.Split(string(out), "\n") {
+		if k, v, ok := strings.Cut(line, "="); ok {
+			fields[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	return fields
+}
+
+// Stream runs script on host, copying its output to stdout and stderr as
+// it arrives, and returns the remote exit code. A non-nil error means the
+// script could not be run at all, including ssh failing to connect.
+func (o Options) Stream(ctx context.Context, host, script string, stdout, stderr io.Writer) (int, error) {
+	cmd := o.Command(ctx, host, script)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	var exit *exec.ExitError
+	switch {
+	case err == nil:
+		return 0, nil
+	case errors.As(err, &exit) && exit.ExitCode() != 255:
+		return exit.ExitCode(), nil
+	}
+	// ssh exits with 255 when it cannot connect
+	return -1, fmt.Errorf("ssh %s: %w", host, err)
+}
+
+// Quote quotes s for the remote POSIX shell.
+func Quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,77 @@
+package remote
+
+import (
+	"os/exec"
+	"reflect"
+	"testing"
+)
+
+func TestFields(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want map[string]string
+	}{
+		{
+			name: "key value lines",
+			out:  "generation=42\nrevision={\"rev\":\"abc\"}\n",
+			want: map[string]string{"generation": "42", "revision": `{"rev":"abc"}`},
+		},
+		{
+			name: "values keep later equals signs",
+			out:  "cmdline=init=/nix/store/x-init root=fstab\n",
+			want: map[string]string{"cmdline": "init=/nix/store/x-init root=fstab"},
+		},
+		{
+			name: "spaces trimmed, empty values kept",
+			out:  "  interface = enp2s0 \ndriver=\n",
+			want: map[string]string{"interface": "enp2s0", "driver": ""},
+		},
+		{
+			name: "other lines ignored",
+			out:  "Welcome to noir\n\nuptime=12\r\n",
+			want: map[string]string{"uptime": "12"},
+		},
+		{
+			name: "last one wins",
+			out:  "a=1\na=2\n",
+			want: map[string]string{"a": "2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Fields([]byte(tt.out)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Fields() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuote(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		want string
+	}{
+		{name: "plain", s: "/var/lib/jellyfin", want: "'/var/lib/jellyfin'"},
+		{name: "empty", s: "", want: "''"},
+		{name: "spaces and expansions", s: "a b $HOME `id`", want: "'a b $HOME `id`'"},
+		{name: "single quotes", s: "it's", want: `'it'\''s'`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Quote(tt.s)
+			if got != tt.want {
+				t.Errorf("Quote(%q) = %s, want %s", tt.s, got, tt.want)
+			}
+			// the shell hands back exactly the input
+			out, err := exec.Command("sh", "-c", "printf %s "+got).Output()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != tt.s {
+				t.Errorf("sh read %s as %q, want %q", got, out, tt.s)
+			}
+		})
+	}
+}
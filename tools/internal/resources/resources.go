@@ -0,0 +1,169 @@
+// Package resources reads how the doomlab slices set up by
+// modules/nixos/resources.nix use their budgets, straight from cgroupfs.
+package resources
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/orther/doomlab/tools/internal/fleet"
+	"github.com/orther/doomlab/tools/internal/remote"
+)
+
+// The script prints <cgroup>.<stat>=<value> lines for every class slice and
+// the services in it, where cgroup is relative to doomlab.slice, e.g.
+// doomlab-interactive.slice/jellyfin.service. memory.high and memory.max
+// read "max" when unlimited.
+const script = `
+cg=/sys/fs/cgroup/doomlab.slice
+for d in "$cg"/*.slice "$cg"/*.slice/*.service; do
+  [ -d "$d" ] || continue
+  k=${d#"$cg"/}
+  echo "$k.memory=$(cat "$d/memory.current")"
+  echo "$k.peak=$(cat "$d/memory.peak" 2>/dev/null)"
+  echo "$k.high=$(cat "$d/memory.high")"
+  echo "$k.max=$(cat "$d/memory.max")"
+  echo "$k.cpu=$(awk '$1 == "usage_usec" {print $2}' "$d/cpu.stat")"
+  echo "$k.io=$(awk '{for (i = 2; i <= NF; i++) {split($i, f, "="); if (f[1] == "rbytes" || f[1] == "wbytes") n += f[2]}} END {print n + 0}' "$d/io.stat" 2>/dev/null)"
+done
+echo "memtotal=$(awk '$1 == "MemTotal:" {print $2 * 1024}' /proc/meminfo)"
+echo "oomkills=$(journalctl -u systemd-oomd.service --since -7d -o cat 2>/dev/null | grep -c '^Killed')"
+`
+
+// Usage is what a cgroup has used since it was created, which for the class
+// slices is since boot.
+type Usage struct {
+	Memory int64 // bytes
+	Peak   int64 // bytes, zero on kernels without memory.peak
+	CPU    time.Duration
+	IO     int64 // bytes read and written
+}
+
+// Unit is a service running in a class.
+type Unit struct {
+	Name string
+	Usage
+}
+
+// Slice is one class and its budget.
+type Slice struct {
+	Class string
+	Usage
+	High  int64 // bytes, zero when unlimited
+	Max   int64 // bytes, zero when unlimited
+	Units []Unit
+}
+
+// HighPercent returns the slice's peak memory as a share of MemoryHigh, or
+// -1 without a limit.
+func (s Slice) HighPercent() int {
+	if s.High == 0 {
+		return -1
+	}
+	return int(s.Peak * 100 / s.High)
+}
+
+// OverHigh reports whether the slice has been throttled for reaching
+// MemoryHigh since boot.
+func (s Slice) OverHigh() bool { return s.High > 0 && s.Peak >= s.High }
+
+// Host is the usage of every class on one host.
+type Host struct {
+	Host     fleet.Host
+	Err      error
+	MemTotal int64
+	OOMKills int // systemd-oomd kills over the last week
+	Slices   []Slice
+}
+
+// Collect reads the class slices on a host. Hosts without resource budgets
+// come back with no slices.
+func Collect(ctx context.Context, ssh remote.Options, h fleet.Host) Host {
+	r := Host{Host: h}
+	if h.Err != nil {
+		r.Err = h.Err
+		return r
+	}
+	out, err := ssh.Run(ctx, h.Hostname, script)
+	if err != nil {
+		r.Err = err
+		return r
+	}
+	fields := remote.Fields(out)
+	r.MemTotal, _ = strconv.ParseInt(fields["memtotal"], 10, 64)
+	r.OOMKills, _ = strconv.Atoi(fields["oomkills"])
+
+	slices := make(map[string]*Slice)
+	units := make(map[string]*Unit)
+	for k, v := range fields {
+		cgroup, stat, ok := cutLast(k, ".")
+		if !ok || !strings.HasSuffix(cgroup, ".slice") && !strings.HasSuffix(cgroup, ".service") {
+			continue
+		}
+		parent, unit, nested := strings.Cut(cgroup, "/")
+		s := slices[parent]
+		if s == nil {
+			s = &Slice{Class: strings.TrimSuffix(strings.TrimPrefix(parent, "doomlab-"), ".slice")}
+			slices[parent] = s
+		}
+		usage := &s.Usage
+		if nested {
+			u := units[cgroup]
+			if u == nil {
+				u = &Unit{Name: unit}
+				units[cgroup] = u
+			}
+			usage = &u.Usage
+		}
+		n := parseBytes(v)
+		switch stat {
+		case "memory":
+			usage.Memory = n
+		case "peak":
+			usage.Peak = n
+		case "cpu":
+			usage.CPU = time.Duration(n) * time.Microsecond
+		case "io":
+			usage.IO = n
+		case "high":
+			if !nested {
+				s.High = n
+			}
+		case "max":
+			if !nested {
+				s.Max = n
+			}
+		}
+	}
+
+	for key, u := range units {
+		parent, _, _ := strings.Cut(key, "/")
+		slices[parent].Units = append(slices[parent].Units, *u)
+	}
+	for _, s := range slices {
+		sort.Slice(s.Units, func(i, j int) bool { return s.Units[i].Memory > s.Units[j].Memory })
+		r.Slices = append(r.Slices, *s)
+	}
+	sort.Slice(r.Slices, func(i, j int) bool { return r.Slices[i].Class < r.Slices[j].Class })
+	return r
+}
+
+// parseBytes reads a cgroup value, where "max" and anything unreadable mean
+// no number.
+func parseBytes(v string) int64 {
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
@@ -0,0 +1,281 @@
+// Package scaffold writes a new machine: its configuration.nix from a
+// profile template, a nixos-facter report and hardware-configuration.nix from what
+// the target reports over SSH, its nixosConfigurations entry in flake.nix
+// and its age key in .sops.yaml.
+package scaffold
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/orther/doomlab/tools/internal/facter"
+	"github.com/orther/doomlab/tools/internal/remote"
+)
+
+//go:embed templates/*.nix.tmpl
+var templateFS embed.FS
+
+var templates = template.Must(template.New("").Funcs(template.FuncMap{
+	"list": func(items []string) string {
+		quoted := make([]string, len(items))
+		for i, s := range items {
+			quoted[i] = strconv.Quote(s)
+		}
+		return strings.Join(quoted, " ")
+	},
+}).ParseFS(templateFS, "templates/*.nix.tmpl"))
+
+// Profiles are the modules/profiles a new machine can start from; each has
+// a template.
+var Profiles = []string{"server", "desktop"}
+
+// Luks is an encrypted device unlocked in the initrd.
+type Luks struct {
+	Name   string
+	Device string
+}
+
+// Hardware is what the target reports about itself.
+type Hardware struct {
+	// Report is the nixos-facter report, from which hardware.nix derives
+	// the kernel modules, microcode and system. Without one they are
+	// written out from nixos-generate-config.
+	Report []byte
+	// Imports are the profiles nixos-generate-config picked, such as
+	// not-detected.nix on bare metal or qemu-guest.nix in a VM.
+	Imports             []string
+	InitrdModules       []string
+	InitrdKernelModules []string
+	KernelModules       []string
+	System              string
+	Microcode           string // "intel", "amd" or empty
+	// Interface carries the default route; its Driver is added to the
+	// initrd so remote unlock has a network.
+	Interface string
+	Driver    string
+	Luks      []Luks
+	// AgeKey is the sops recipient derived from the initrd SSH host key,
+	// empty if it could not be read or converted.
+	AgeKey string
+}
+
+const factsScript = `
+iface=$(ip route show default 2>/dev/null | awk '{for (i = 1; i < NF; i++) if ($i == "dev") {print $(i+1); exit}}')
+echo "interface=$iface"
+if [ -n "$iface" ] && [ -e "/sys/class/net/$iface/device/driver" ]; then
+  echo "driver=$(basename "$(readlink "/sys/class/net/$iface/device/driver")")"
+fi
+for dev in $(lsblk -nrpo NAME,FSTYPE | awk '$2 == "crypto_LUKS" {print $1}'); do
+  echo "luks.$dev=$(lsblk -nro NAME,TYPE "$dev" | awk '$2 == "crypt" {print $1; exit}')"
+done
+for pub in "$ROOT/nix/secret/initrd/ssh_host_ed25519_key.pub" /nix/secret/initrd/ssh_host_ed25519_key.pub; do
+  if [ -r "$pub" ]; then
+    echo "age=$(nix --extra-experimental-features 'nix-command flakes' run nixpkgs#ssh-to-age < "$pub" 2>/dev/null)"
+    break
+  fi
+done
+`
+
+// Probe collects the hardware of host, an installer that has run
+// install.sh with the new system mounted at root, or an installed system
+// when root is "/". nixos-generate-config stands in for nixos-facter when
+// the target cannot run it.
+func Probe(ctx context.Context, ssh remote.Options, host, root string) (*Hardware, error) {
+	out, err := ssh.Run(ctx, host, "ROOT="+remote.Quote(strings.TrimSuffix(root, "/"))+"\n"+factsScript)
+	if err != nil {
+		return nil, err
+	}
+	facts := remote.Fields(out)
+
+	if report, err := facter.Capture(ctx, ssh, host); err == nil {
+		return fromReport(report, facts)
+	}
+	generated, err := ssh.Run(ctx, host, "sudo -n nixos-generate-config --show-hardware-config --no-filesystems\n")
+	if err != nil {
+		return nil, err
+	}
+	return parse(string(generated), facts)
+}
+
+func fromReport(report []byte, facts map[string]string) (*Hardware, error) {
+	s, err := facter.Parse(report)
+	if err != nil {
+		return nil, err
+	}
+	hw := &Hardware{
+		Report:    report,
+		Imports:   []string{`(modulesPath + "/installer/scan/not-detected.nix")`},
+		System:    s.System,
+		Microcode: s.Microcode,
+	}
+	switch s.Virtualisation {
+	case "", "none":
+	default:
+		hw.Imports = []string{`(modulesPath + "/profiles/qemu-guest.nix")`}
+	}
+	hw.setFacts(facts)
+	return hw, nil
+}
+
+var (
+	quotedRe  = regexp.MustCompile(`"([^"]*)"`)
+	importsRe = regexp.MustCompile(`(?s)imports\s*=\s*\[(.*?)\];`)
+	importRe  = regexp.MustCompile(`\([^()]*\)`)
+	systemRe  = regexp.MustCompile(`nixpkgs\.hostPlatform\s*=\s*lib\.mkDefault\s*"([^"]+)"`)
+	ucodeRe   = regexp.MustCompile(`hardware\.cpu\.(intel|amd)\.updateMicrocode`)
+)
+
+// stringList returns the strings of a `attr = [ "a" "b" ];` line.
+func stringList(generated, attr string) []string {
+	re := regexp.MustCompile(`(?m)^[ \t]*` + regexp.QuoteMeta(attr) + `\s*=\s*\[([^\]]*)\];`)
+	m := re.FindStringSubmatch(generated)
+	if m == nil {
+		return nil
+	}
+	var items []string
+	for _, q := range quotedRe.FindAllStringSubmatch(m[1], -1) {
+		items = append(items, q[1])
+	}
+	return items
+}
+
+func parse(generated string, facts map[string]string) (*Hardware, error) {
+	hw := &Hardware{
+		InitrdModules:       stringList(generated, "boot.initrd.availableKernelModules"),
+		InitrdKernelModules: stringList(generated, "boot.initrd.kernelModules"),
+		KernelModules:       stringList(generated, "boot.kernelModules"),
+	}
+	if m := importsRe.FindStringSubmatch(generated); m != nil {
+		hw.Imports = importRe.FindAllString(m[1], -1)
+	}
+	m := systemRe.FindStringSubmatch(generated)
+	if m == nil {
+		return nil, fmt.Errorf("nixos-generate-config did not report nixpkgs.hostPlatform")
+	}
+	hw.System = m[1]
+	if m := ucodeRe.FindStringSubmatch(generated); m != nil {
+		hw.Microcode = m[1]
+	}
+	hw.setFacts(facts)
+	if hw.Driver != "" && !slices.Contains(hw.InitrdModules, hw.Driver) {
+		hw.InitrdModules = append(hw.InitrdModules, hw.Driver)
+	}
+	return hw, nil
+}
+
+// setFacts fills in what the facts script found.
+func (hw *Hardware) setFacts(facts map[string]string) {
+	hw.Interface = facts["interface"]
+	hw.Driver = facts["driver"]
+	if age := facts["age"]; strings.HasPrefix(age, "age1") {
+		hw.AgeKey = age
+	}
+	for k, name := range facts {
+		if dev, ok := strings.CutPrefix(k, "luks."); ok {
+			hw.Luks = append(hw.Luks, Luks{Name: name, Device: dev})
+		}
+	}
+	sort.Slice(hw.Luks, func(i, j int) bool { return hw.Luks[i].Device < hw.Luks[j].Device })
+	// install.sh opens the root partition as cryptroot; name any device
+	// that is not open after its position
+	for i := range hw.Luks {
+		if hw.Luks[i].Name == "" {
+			hw.Luks[i].Name = "crypt" + strconv.Itoa(i)
+		}
+	}
+}
+
+// Machine is a machine to generate.
+type Machine struct {
+	Name    string
+	Profile string
+	*Hardware
+}
+
+// Render returns the machine's files by path relative to the repository.
+func Render(m Machine) (map[string][]byte, error) {
+	if !slices.Contains(Profiles, m.Profile) {
+		return nil, fmt.Errorf("unknown profile %q, expected one of %s", m.Profile, strings.Join(Profiles, ", "))
+	}
+	files := make(map[string][]byte)
+	for path, tmpl := range map[string]string{
+		"configuration.nix":          m.Profile + ".nix.tmpl",
+		"hardware-configuration.nix": "hardware.nix.tmpl",
+	} {
+		var b bytes.Buffer
+		if err := templates.ExecuteTemplate(&b, tmpl, m); err != nil {
+			return nil, err
+		}
+		files["machines/"+m.Name+"/"+path] = b.Bytes()
+	}
+	if m.Report != nil {
+		files["machines/"+m.Name+"/facter.json"] = m.Report
+	}
+	return files, nil
+}
+
+var nixosConfigurationsRe = regexp.MustCompile(`(?m)^([ \t]*)nixosConfigurations = \{\n`)
+
+// AddToFlake adds a nixosConfigurations entry for the machine to flake.nix,
+// after the last entry.
+func AddToFlake(flake []byte, name, system string) ([]byte, error) {
+	loc := nixosConfigurationsRe.FindSubmatchIndex(flake)
+	if loc == nil {
+		return nil, fmt.Errorf("flake.nix has no nixosConfigurations")
+	}
+	if regexp.MustCompile(`(?m)^[ \t]*` + regexp.QuoteMeta(name) + ` = nixpkgs\.lib\.nixosSystem`).Match(flake) {
+		return nil, fmt.Errorf("flake.nix already has %s", name)
+	}
+	indent := string(flake[loc[2]:loc[3]])
+	closing := regexp.MustCompile(`(?m)^` + regexp.QuoteMeta(indent) + `\};\n`).FindIndex(flake[loc[1]:])
+	if closing == nil {
+		return nil, fmt.Errorf("cannot find the end of nixosConfigurations in flake.nix")
+	}
+	at := loc[1] + closing[0]
+	entry := fmt.Sprintf(`
+%[1]s  %[2]s = nixpkgs.lib.nixosSystem {
+%[1]s    system = %[3]q;
+%[1]s    specialArgs = {inherit inputs outputs;};
+%[1]s    modules = [./machines/%[2]s/configuration.nix];
+%[1]s  };
+`, indent, name, system)
+	return slices.Concat(flake[:at], []byte(entry), flake[at:]), nil
+}
+
+// AddSopsKey anchors the machine's age key in .sops.yaml and adds it to
+// every creation rule, so `sops updatekeys` encrypts the secrets for it.
+func AddSopsKey(sopsYAML []byte, name, key string) ([]byte, error) {
+	if regexp.MustCompile(`(?m)&` + regexp.QuoteMeta(name) + `\s`).Match(sopsYAML) {
+		return nil, fmt.Errorf(".sops.yaml already has a key for %s", name)
+	}
+	anchors := regexp.MustCompile(`(?m)^([ \t]*)- &[\w.-]+ age1[0-9a-z]+\n`).FindAllSubmatchIndex(sopsYAML, -1)
+	if anchors == nil {
+		return nil, fmt.Errorf(".sops.yaml has no age keys to add %s next to", name)
+	}
+	last := anchors[len(anchors)-1]
+	indent := string(sopsYAML[last[2]:last[3]])
+	out := slices.Concat(sopsYAML[:last[1]], []byte(indent+"- &"+name+" "+key+"\n"), sopsYAML[last[1]:])
+
+	// each rule's age list ends with its last alias
+	var b bytes.Buffer
+	lines := strings.SplitAfter(string(out), "\n")
+	aliasRe := regexp.MustCompile(`^(\s*)- \*[\w.-]+\s*$`)
+	for i, line := range lines {
+		b.WriteString(line)
+		if m := aliasRe.FindStringSubmatch(line); m != nil {
+			if i+1 < len(lines) && aliasRe.MatchString(lines[i+1]) {
+				continue
+			}
+			b.WriteString(m[1] + "- *" + name + "\n")
+		}
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,167 @@
+package scaffold
+
+import (
+	"strings"
+	"testing"
+)
+
+const flake = `{
+  outputs = {self, nixpkgs, ...} @ inputs: {
+    darwinConfigurations = {
+      mair = nix-darwin.lib.darwinSystem {
+        system = "x86_64-darwin";
+      };
+    };
+
+    nixosConfigurations = {
+      noir = nixpkgs.lib.nixosSystem {
+        system = "x86_64-linux";
+        specialArgs = {inherit inputs outputs;};
+        modules = [./machines/noir/configuration.nix];
+      };
+    };
+  };
+}
+`
+
+func TestAddToFlake(t *testing.T) {
+	tests := []struct {
+		name    string
+		flake   string
+		host    string
+		system  string
+		want    string
+		wantErr string
+	}{
+		{
+			name:   "after the last entry",
+			flake:  flake,
+			host:   "svr4chng",
+			system: "x86_64-linux",
+			want: `        modules = [./machines/noir/configuration.nix];
+      };
+
+      svr4chng = nixpkgs.lib.nixosSystem {
+        system = "x86_64-linux";
+        specialArgs = {inherit inputs outputs;};
+        modules = [./machines/svr4chng/configuration.nix];
+      };
+    };
+  };
+}
+`,
+		},
+		{
+			name:    "already there",
+			flake:   flake,
+			host:    "noir",
+			system:  "x86_64-linux",
+			wantErr: "already has noir",
+		},
+		{
+			name:    "darwin only",
+			flake:   "{\n  darwinConfigurations = {\n  };\n}\n",
+			host:    "svr4chng",
+			system:  "x86_64-linux",
+			wantErr: "no nixosConfigurations",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := AddToFlake([]byte(tt.flake), tt.host, tt.system)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("AddToFlake() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasSuffix(string(got), tt.want) {
+				t.Errorf("AddToFlake() =\n%s\nwant it to end with\n%s", got, tt.want)
+			}
+			if !strings.HasPrefix(string(got), tt.flake[:strings.Index(tt.flake, "    nixosConfigurations")]) {
+				t.Errorf("AddToFlake() changed what comes before nixosConfigurations:\n%s", got)
+			}
+		})
+	}
+}
+
+const sopsYAML = `keys:
+  - &noir age1hychfwplt2rpkzdxvz5lxy7zjf0dt0y6qrcwe2gvnm4mkelsnc7syu2y25
+  - &zinc age12pc2l7dyq0tlj0mm56vrwez6yr8nlve6vrucexf7x92dg7qlzcxskrf2tv
+creation_rules:
+  - path_regex: secrets/[^/]+(\.(yaml|json|env|ini|conf))?$
+    key_groups:
+      - age:
+          - *noir
+          - *zinc
+  - path_regex: secrets/cloudflare-tunnel$
+    key_groups:
+      - age:
+          - *noir
+`
+
+func TestAddSopsKey(t *testing.T) {
+	const key = "age1qqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqq"
+	tests := []struct {
+		name    string
+		yaml    string
+		host    string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "anchored and added to every rule",
+			yaml: sopsYAML,
+			host: "svr4chng",
+			want: `keys:
+  - &noir age1hychfwplt2rpkzdxvz5lxy7zjf0dt0y6qrcwe2gvnm4mkelsnc7syu2y25
+  - &zinc age12pc2l7dyq0tlj0mm56vrwez6yr8nlve6vrucexf7x92dg7qlzcxskrf2tv
+  - &svr4chng ` + key + `
+creation_rules:
+  - path_regex: secrets/[^/]+(\.(yaml|json|env|ini|conf))?$
+    key_groups:
+      - age:
+          - *noir
+          - *zinc
+          - *svr4chng
+  - path_regex: secrets/cloudflare-tunnel$
+    key_groups:
+      - age:
+          - *noir
+          - *svr4chng
+`,
+		},
+		{
+			name:    "already anchored",
+			yaml:    sopsYAML,
+			host:    "zinc",
+			wantErr: "already has a key for zinc",
+		},
+		{
+			name:    "no keys",
+			yaml:    "creation_rules: []\n",
+			host:    "svr4chng",
+			wantErr: "no age keys",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := AddSopsKey([]byte(tt.yaml), tt.host, key)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("AddSopsKey() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("AddSopsKey() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+// Package sops shells out to the sops binary so secrets handled by doomctl
+// are encrypted with the same keys and creation rules as the rest of the repo.
+package sops
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// Decrypt returns the plaintext of a sops encrypted file.
+func Decrypt(path string) ([]byte, error) {
+	return run("--decrypt", path)
+}
+
+// Extract returns a single value from a sops encrypted YAML or JSON file.
+// Keys name the path to the value, e.g. Extract(f, "client-ca", "iphone").
+func Extract(path string, keys ...string) ([]byte, error) {
+	var expr strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&expr, "[%q]", k)
+	}
+	out, err := run("--decrypt", "--extract", expr.String(), path)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(out, "\n"), nil
+}
+
+// EncryptFile writes plaintext to path and encrypts it in place as a binary
+// secret. The plaintext is removed if encryption fails.
+func EncryptFile(path string, plaintext []byte) error {
+	if err := os.WriteFile(path, plaintext, 0o600); err != nil {
+		return err
+	}
+	if _, err := run("--encrypt", "--in-place", "--input-type", "binary", "--output-type", "binary", path); err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+var (
+	recipientRe = regexp.MustCompile(`recipient"?:\s*"?(age1[0-9a-z]+)`)
+	anchorRe    = regexp.MustCompile(`(?m)^\s*-\s*&([\w.-]+)\s+(age1[0-9a-z]+)`)
+)
+
+// Recipients lists the age keys a sops encrypted file is encrypted for,
+// read from its metadata without decrypting it.
+func Recipients(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, m := range recipientRe.FindAllSubmatch(data, -1) {
+		keys = append(keys, string(m[1]))
+	}
+	return keys, nil
+}
+
+// Keys returns the age keys declared as YAML anchors in a .sops.yaml, such
+// as `- &noir age1...`, by anchor name. Hosts are anchored by their name.
+func Keys(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]string)
+	for _, m := range anchorRe.FindAllSubmatch(data, -1) {
+		keys[string(m[1])] = string(m[2])
+	}
+	return keys, nil
+}
+
+// UpdateKeys re-encrypts the data key of path for the recipients its
+// creation rule in .sops.yaml lists.
+func UpdateKeys(path string) error {
+	_, err := run("updatekeys", "--yes", path)
+	return err
+}
+
+func run(args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("sops", args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("sops %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
@@ -0,0 +1,69 @@
+package sops
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want map[string]string
+	}{
+		{
+			name: "anchored hosts",
+			yaml: `keys:
+  - &noir age1hychfwplt2rpkzdxvz5lxy7zjf0dt0y6qrcwe2gvnm4mkelsnc7syu2y25
+  - &svr1chng age1x9ynm5k77c2ammaxcqx9dv5rsw4xg0xfaud0cgtyauurz3utjgfqgh6fyz
+creation_rules:
+  - key_groups:
+      - age:
+          - *noir
+          - *svr1chng
+`,
+			want: map[string]string{
+				"noir":     "age1hychfwplt2rpkzdxvz5lxy7zjf0dt0y6qrcwe2gvnm4mkelsnc7syu2y25",
+				"svr1chng": "age1x9ynm5k77c2ammaxcqx9dv5rsw4xg0xfaud0cgtyauurz3utjgfqgh6fyz",
+			},
+		},
+		{
+			name: "aliases and other recipients are not keys",
+			yaml: `creation_rules:
+  - key_groups:
+      - age:
+          - *noir
+          - age1x9ynm5k77c2ammaxcqx9dv5rsw4xg0xfaud0cgtyauurz3utjgfqgh6fyz
+`,
+			want: map[string]string{},
+		},
+		{
+			name: "dotted names and extra spaces",
+			yaml: "keys:\n  -  &admin.orther   age1qqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqq\n",
+			want: map[string]string{"admin.orther": "age1qqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqq"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), ".sops.yaml")
+			if err := os.WriteFile(path, []byte(tt.yaml), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := Keys(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Keys() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeysMissingFile(t *testing.T) {
+	if _, err := Keys(filepath.Join(t.TempDir(), ".sops.yaml")); err == nil {
+		t.Fatal("Keys() of a missing file succeeded")
+	}
+}
@@ -0,0 +1,226 @@
+// Package status collects the health of a host over SSH: generation,
+// revision, kernels, failed units, auto-upgrade and backup results, disk
+// usage and Tailscale.
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/orther/doomlab/tools/internal/fleet"
+	"github.com/orther/doomlab/tools/internal/remote"
+)
+
+// The script prints key=value lines; repeated facts use dotted keys such as
+// backup.<unit> and disk.<mountpoint>. Every probe tolerates darwin hosts,
+// which have no systemd or /proc.
+const script = `
+gen=$(readlink /nix/var/nix/profiles/system 2>/dev/null)
+echo "generation=$(echo "$gen" | sed -n 's/^system-\([0-9]*\)-link$/\1/p')"
+echo "revision=$(cat /etc/doomlab-revision 2>/dev/null)"
+if [ -r /proc/uptime ]; then
+  echo "uptime=$(cut -d' ' -f1 /proc/uptime)"
+fi
+echo "kernel.booted=$(readlink -f /run/booted-system/kernel 2>/dev/null)"
+echo "kernel.current=$(readlink -f /run/current-system/kernel 2>/dev/null)"
+echo "kernel.release=$(uname -r)"
+if command -v systemctl >/dev/null 2>&1; then
+  echo "failed=$(systemctl list-units --failed --plain --no-legend 2>/dev/null | awk '{print $1}' | tr '\n' ' ')"
+  systemctl cat nixos-upgrade.service >/dev/null 2>&1 &&
+    echo "upgrade=$(systemctl show --timestamp=unix -p Result --value nixos-upgrade.service) $(systemctl show --timestamp=unix -p ExecMainExitTimestamp --value nixos-upgrade.service)"
+  for unit in $(systemctl list-units 'backup-*.service' --all --plain --no-legend 2>/dev/null | awk '{print $1}'); do
+    echo "backup.$unit=$(systemctl show --timestamp=unix -p Result --value "$unit") $(systemctl show --timestamp=unix -p ExecMainExitTimestamp --value "$unit")"
+  done
+fi
+for m in / /nix /nix/persist /boot /fun; do
+  df -Pk "$m" 2>/dev/null | awk -v m="$m" 'NR == 2 && $6 == m {print "disk." m "=" $1 " " $2 " " $3}'
+done
+if command -v tailscale >/dev/null 2>&1; then
+  echo "tailscale=$(tailscale status --json --peers=false 2>/dev/null | tr -d '\n')"
+fi
+`
+
+// Result is the outcome of a oneshot unit's last run.
+type Result struct {
+	OK   bool
+	Text string    // systemd's Result, e.g. "success" or "exit-code"
+	At   time.Time // zero when the unit has not run since boot
+}
+
+// Disk is the usage of one mounted filesystem.
+type Disk struct {
+	Mount  string
+	Source string
+	Size   int64 // KiB
+	Used   int64 // KiB
+}
+
+// Percent returns the share of the filesystem in use.
+func (d Disk) Percent() int {
+	if d.Size == 0 {
+		return 0
+	}
+	return int(d.Used * 100 / d.Size)
+}
+
+// Tmpfs reports whether the filesystem lives in memory, as / does under
+// impermanence.
+func (d Disk) Tmpfs() bool { return d.Source == "tmpfs" || d.Source == "none" }
+
+// Tailscale is the host's own Tailscale state.
+type Tailscale struct {
+	BackendState string
+	Online       bool
+	IPs          []string
+}
+
+// Host is the health of one host at a point in time.
+type Host struct {
+	Host          fleet.Host
+	Checked       time.Time
+	Err           error
+	Generation    int
+	Revision      *fleet.Revision
+	Uptime        time.Duration
+	BootedKernel  string
+	CurrentKernel string
+	KernelRelease string
+	Failed        []string
+	Upgrade       *Result
+	Backups       map[string]Result
+	Disks         []Disk
+	Tailscale     *Tailscale
+}
+
+// RebootPending reports whether the current system has a different kernel
+// than the one the host booted.
+func (h Host) RebootPending() bool {
+	return h.BootedKernel != "" && h.CurrentKernel != "" && h.BootedKernel != h.CurrentKernel
+}
+
+// Collect runs the probe script on a host.
+func Collect(ctx context.Context, ssh remote.Options, h fleet.Host) Host {
+	s := Host{Host: h, Checked: time.Now()}
+	if h.Err != nil {
+		s.Err = h.Err
+		return s
+	}
+	out, err := ssh.Run(ctx, h.Hostname, script)
+	if err != nil {
+		s.Err = err
+		return s
+	}
+	fields := remote.Fields(out)
+
+	s.Generation, _ = strconv.Atoi(fields["generation"])
+	if raw := fields["revision"]; raw != "" {
+		var rev fleet.Revision
+		if json.Unmarshal([]byte(raw), &rev) == nil {
+			s.Revision = &rev
+		}
+	}
+	if secs, err := strconv.ParseFloat(fields["uptime"], 64); err == nil {
+		s.Uptime = time.Duration(secs) * time.Second
+	}
+	s.BootedKernel = fields["kernel.booted"]
+	s.CurrentKernel = fields["kernel.current"]
+	s.KernelRelease = fields["kernel.release"]
+	s.Failed = strings.Fields(fields["failed"])
+	if v, ok := fields["upgrade"]; ok {
+		r := parseResult(v)
+		s.Upgrade = &r
+	}
+
+	s.Backups = make(map[string]Result)
+	for k, v := range fields {
+		switch {
+		case strings.HasPrefix(k, "backup."):
+			s.Backups[strings.TrimPrefix(k, "backup.")] = parseResult(v)
+		case strings.HasPrefix(k, "disk."):
+			f := strings.Fields(v)
+			if len(f) != 3 {
+				continue
+			}
+			d := Disk{Mount: strings.TrimPrefix(k, "disk."), Source: f[0]}
+			d.Size, _ = strconv.ParseInt(f[1], 10, 64)
+			d.Used, _ = strconv.ParseInt(f[2], 10, 64)
+			s.Disks = append(s.Disks, d)
+		}
+	}
+	sort.Slice(s.Disks, func(i, j int) bool { return s.Disks[i].Mount < s.Disks[j].Mount })
+
+	if raw := fields["tailscale"]; raw != "" {
+		var ts struct {
+			BackendState string
+			Self         struct {
+				Online       bool
+				TailscaleIPs []string
+			}
+		}
+		if json.Unmarshal([]byte(raw), &ts) == nil {
+			s.Tailscale = &Tailscale{BackendState: ts.BackendState, Online: ts.Self.Online, IPs: ts.Self.TailscaleIPs}
+		}
+	}
+	return s
+}
+
+// parseResult reads "<Result> @<unix seconds>" as printed by systemctl show
+// --timestamp=unix.
+func parseResult(v string) Result {
+	text, ts, _ := strings.Cut(strings.TrimSpace(v), " ")
+	r := Result{Text: text, OK: text == "success"}
+	if secs, err := strconv.ParseInt(strings.TrimPrefix(strings.TrimSpace(ts), "@"), 10, 64); err == nil && secs > 0 {
+		r.At = time.Unix(secs, 0)
+	}
+	return r
+}
+
+// LastBackup returns the most recent backup run, and whether every backup
+// unit's last run succeeded.
+func (h Host) LastBackup() (last time.Time, ok bool) {
+	ok = true
+	for _, b := range h.Backups {
+		if !b.OK {
+			ok = false
+		}
+		if b.At.After(last) {
+			last = b.At
+		}
+	}
+	return last, ok
+}
+
+// Units lists what can be drilled into on the host: failed units first,
+// then auto-upgrade and backups.
+func (h Host) Units() []string {
+	units := append([]string(nil), h.Failed...)
+	add := func(u string) {
+		for _, existing := range units {
+			if existing == u {
+				return
+			}
+		}
+		units = append(units, u)
+	}
+	if h.Upgrade != nil {
+		add("nixos-upgrade.service")
+	}
+	var backups []string
+	for u := range h.Backups {
+		backups = append(backups, u)
+	}
+	sort.Strings(backups)
+	for _, u := range backups {
+		add(u)
+	}
+	return units
+}
+
+// Journal returns the last lines of a unit's journal on the host.
+func Journal(ctx context.Context, ssh remote.Options, h fleet.Host, unit string, lines int) ([]byte, error) {
+	return ssh.Run(ctx, h.Hostname, "journalctl --no-pager --output=short-iso -n "+strconv.Itoa(lines)+" -u "+remote.Quote(unit)+"\n")
+}
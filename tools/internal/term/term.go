@@ -0,0 +1,217 @@
+// Package term drives an ANSI terminal for doomctl's full-screen views
+// without any dependencies: stty switches the tty to raw mode and the
+// screen is redrawn with escape sequences.
+package term
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"unicode/utf8"
+)
+
+// Key is a key press decoded from the terminal.
+type Key string
+
+const (
+	Up       Key = "up"
+	Down     Key = "down"
+	PageUp   Key = "pgup"
+	PageDown Key = "pgdn"
+	Home     Key = "home"
+	End      Key = "end"
+	Enter    Key = "enter"
+	Escape   Key = "esc"
+)
+
+// Terminal is a tty in raw mode showing the alternate screen.
+type Terminal struct {
+	in    *os.File
+	out   io.Writer
+	saved string
+	// rows and cols as of Open or the last Resize
+	rows, cols int
+}
+
+// IsTerminal reports whether f is a terminal.
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Open puts the terminal on stdin into raw mode and switches to the
+// alternate screen. Close restores both.
+func Open() (*Terminal, error) {
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stty("raw", "-echo"); err != nil {
+		return nil, err
+	}
+	t := &Terminal{in: os.Stdin, out: os.Stdout, saved: strings.TrimSpace(saved)}
+	t.Resize()
+	fmt.Fprint(t.out, "\x1b[?1049h\x1b[?25l")
+	return t, nil
+}
+
+// Close leaves the alternate screen and restores the terminal settings.
+func (t *Terminal) Close() error {
+	fmt.Fprint(t.out, "\x1b[?25h\x1b[?1049l")
+	_, err := stty(t.saved)
+	return err
+}
+
+// Size returns the terminal's rows and columns without asking the tty;
+// callers Resize on SIGWINCH.
+func (t *Terminal) Size() (rows, cols int) {
+	return t.rows, t.cols
+}
+
+// Resize queries the terminal's size again, falling back to 24x80.
+func (t *Terminal) Resize() {
+	t.rows, t.cols = 24, 80
+	out, err := stty("size")
+	if err != nil {
+		return
+	}
+	var rows, cols int
+	if _, err := fmt.Sscan(out, &rows, &cols); err == nil && rows > 0 && cols > 0 {
+		t.rows, t.cols = rows, cols
+	}
+}
+
+// Keys decodes key presses from the terminal until it is closed.
+func (t *Terminal) Keys() <-chan Key {
+	keys := make(chan Key)
+	go func() {
+		defer close(keys)
+		buf := make([]byte, 16)
+		for {
+			n, err := t.in.Read(buf)
+			if err != nil {
+				return
+			}
+			keys <- decode(buf[:n])
+		}
+	}()
+	return keys
+}
+
+func decode(b []byte) Key {
+	switch string(b) {
+	case "\x1b[A", "\x1bOA":
+		return Up
+	case "\x1b[B", "\x1bOB":
+		return Down
+	case "\x1b[5~":
+		return PageUp
+	case "\x1b[6~":
+		return PageDown
+	case "\x1b[H", "\x1b[1~", "\x1bOH":
+		return Home
+	case "\x1b[F", "\x1b[4~", "\x1bOF":
+		return End
+	case "\r", "\n":
+		return Enter
+	case "\x1b":
+		return Escape
+	case "\x03":
+		// raw mode swallows SIGINT; treat ^C like q
+		return "q"
+	}
+	return Key(b)
+}
+
+// Draw replaces the screen with lines, cut to the terminal's width.
+func (t *Terminal) Draw(lines []string) {
+	rows, cols := t.Size()
+	var b strings.Builder
+	b.WriteString("\x1b[H")
+	for i, line := range lines {
+		if i == rows {
+			break
+		}
+		if i > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString(Truncate(line, cols))
+		b.WriteString("\x1b[K")
+	}
+	b.WriteString("\x1b[J")
+	fmt.Fprint(t.out, b.String())
+}
+
+// Bold, Reverse, Red, Yellow and Green wrap s in SGR sequences.
+func Bold(s string) string    { return "\x1b[1m" + s + "\x1b[0m" }
+func Reverse(s string) string { return "\x1b[7m" + s + "\x1b[0m" }
+func Red(s string) string     { return "\x1b[31m" + s + "\x1b[0m" }
+func Yellow(s string) string  { return "\x1b[33m" + s + "\x1b[0m" }
+func Green(s string) string   { return "\x1b[32m" + s + "\x1b[0m" }
+
+// Truncate cuts s to width visible characters, skipping over escape
+// sequences, and resets attributes if it cut any.
+func Truncate(s string, width int) string {
+	var b strings.Builder
+	visible := 0
+	for i := 0; i < len(s); {
+		if s[i] == '\x1b' {
+			end := strings.IndexByte(s[i:], 'm')
+			if end < 0 {
+				break
+			}
+			b.WriteString(s[i : i+end+1])
+			i += end + 1
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == '\t' {
+			r, size = ' ', 1
+		}
+		if visible == width {
+			b.WriteString("\x1b[0m")
+			break
+		}
+		b.WriteRune(r)
+		visible++
+		i += size
+	}
+	return b.String()
+}
+
+// Width returns the number of visible characters in s.
+func Width(s string) int {
+	n := 0
+	for i := 0; i < len(s); {
+		if s[i] == '\x1b' {
+			if end := strings.IndexByte(s[i:], 'm'); end >= 0 {
+				i += end + 1
+				continue
+			}
+		}
+		_, size := utf8.DecodeRuneInString(s[i:])
+		n++
+		i += size
+	}
+	return n
+}
+
+// Pad right-pads s with spaces to width visible characters.
+func Pad(s string, width int) string {
+	if w := Width(s); w < width {
+		return s + strings.Repeat(" ", width-w)
+	}
+	return s
+}
+
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("stty %s: %w", strings.Join(args, " "), err)
+	}
+	return string(out), nil
+}
@@ -0,0 +1,33 @@
+package term
+
+import "testing"
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		name  string
+		s     string
+		width int
+		want  string
+	}{
+		{name: "fits", s: "noir", width: 10, want: "noir"},
+		{name: "exact", s: "noir", width: 4, want: "noir"},
+		{name: "cut", s: "svr2chng", width: 3, want: "svr\x1b[0m"},
+		{name: "zero width", s: "noir", width: 0, want: "\x1b[0m"},
+		{name: "colour kept", s: Red("failed"), width: 10, want: "\x1b[31mfailed\x1b[0m"},
+		{name: "colour cut", s: Red("failed"), width: 4, want: "\x1b[31mfail\x1b[0m"},
+		{name: "runes", s: "…ünïcode", width: 3, want: "…ün\x1b[0m"},
+		{name: "tabs are spaces", s: "a\tb", width: 3, want: "a b"},
+		{name: "unterminated escape dropped", s: "ab\x1b[31", width: 5, want: "ab"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Truncate(tt.s, tt.width)
+			if got != tt.want {
+				t.Errorf("Truncate(%q, %d) = %q, want %q", tt.s, tt.width, got, tt.want)
+			}
+			if w := Width(got); w > tt.width {
+				t.Errorf("Truncate(%q, %d) is %d wide", tt.s, tt.width, w)
+			}
+		})
+	}
+}